@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"net/url"
+	"strings"
+)
+
+const attachmentPrefix = "attachment:"
+
+var attachmentNameErr = errors.New("Invalid attachment name")
+
+// Find the attachment an attachment:name or attachment:Page/name link on
+// the page being rendered points to.  Without a wiki to look in the
+// attachment is taken to exist.
+func resolveAttachment(ctx *RenderContext, target string) (pageName, name string, exists bool, err error) {
+	target = strings.TrimPrefix(strings.TrimSpace(target), attachmentPrefix)
+	pageName, name = ctx.PageName, target
+	if i := strings.LastIndexByte(target, '/'); i >= 0 {
+		if pageName, err = ResolvePageName(ctx.PageName, target[:i]); err != nil {
+			return
+		}
+		name = target[i+1:]
+	}
+	if pageName == "" || !attachment_re.MatchString(name) {
+		return "", "", false, attachmentNameErr
+	}
+
+	var page Page
+	switch {
+	case pageName == ctx.PageName && ctx.Page != nil:
+		page = ctx.Page
+	case ctx.ReqInfo != nil && ctx.ReqInfo.DB != nil:
+		if !ctx.ReqInfo.CanRead() {
+			return "", "", false, errors.New("you may not read " + pageName)
+		}
+		if found, _ := ctx.ReqInfo.DB.PageExists(pageName); !found {
+			return pageName, name, false, nil
+		}
+		if page, err = ctx.ReqInfo.DB.GetPage(pageName); err != nil {
+			return
+		}
+	default:
+		return pageName, name, true, nil
+	}
+	_, err = page.GetAttachment(name)
+	return pageName, name, err == nil, nil
+}
+
+// An attachment link as HTML, a missing attachment links to the page where
+// it can be uploaded.  false is returned if target is not an attachment.
+func attachmentLinkHTML(ctx *RenderContext, target, label string) (string, bool) {
+	pageName, name, exists, err := resolveAttachment(ctx, target)
+	if err != nil {
+		return "", false
+	}
+	if exists {
+		return `<a class="attachment" href="` + html.EscapeString(PageURL(pageName)+name) + `">` + html.EscapeString(label) + "</a>", true
+	}
+	if ctx.ReqInfo != nil && !ctx.ReqInfo.CanEdit() {
+		return `<span class="attachment-missing">` + html.EscapeString(label) + "</span>", true
+	}
+	upload := EditURL(pageName) + "?attachment=" + url.QueryEscape(name) + "#attachments"
+	return `<a class="attachment-missing" href="` + html.EscapeString(upload) + `" title="Upload ` + html.EscapeString(name) + `">` + html.EscapeString(label) + "</a>", true
+}
+
+// Point a markdown [label](attachment:name) link or ![alt](attachment:name)
+// image at the attachment, a missing attachment becomes a link to upload it
+func writeAttachmentLink(buf *bytes.Buffer, value []byte, ctx *RenderContext) {
+	open := bytes.Index(value, []byte("]("))
+	if open < 0 || value[len(value)-1] != ')' {
+		buf.Write(value)
+		return
+	}
+	inner := value[open+2 : len(value)-1]
+	target := inner
+	if i := bytes.IndexAny(inner, " \t"); i >= 0 {
+		target = inner[:i]
+	}
+	if !bytes.HasPrefix(target, []byte(attachmentPrefix)) {
+		buf.Write(value)
+		return
+	}
+	pageName, name, exists, err := resolveAttachment(ctx, string(target))
+	switch {
+	case err != nil:
+		buf.Write(value)
+	case exists:
+		buf.Write(value[:open+2])
+		buf.WriteString(PageURL(pageName) + name)
+		buf.Write(value[open+2+len(target):])
+	default:
+		label := string(value[bytes.IndexByte(value, '[')+1 : open])
+		if label == "" {
+			label = name
+		}
+		link, _ := attachmentLinkHTML(ctx, string(target), label)
+		buf.WriteString(link)
+	}
+}
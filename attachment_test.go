@@ -0,0 +1,57 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentLinks(t *testing.T) {
+	Convey("Given pages with attachments", t, func() {
+		db, _ := newMemDB()
+		page, _ := db.GetPage("PageOne")
+		page.AddRevision([]byte("text"))
+		page.AddAttachment(strings.NewReader("data"), "report.pdf")
+		other, _ := db.GetPage("Project/Notes")
+		other.AddRevision([]byte("text"))
+		other.AddAttachment(strings.NewReader("data"), "diagram.png")
+		reqInfo := &RequestInfo{DB: db}
+		render := func(format, src string) string {
+			return string(RenderPage(format, []byte(src), &RenderContext{PageName: "PageOne", Page: page, ReqInfo: reqInfo}))
+		}
+
+		Convey("The lexer finds attachment links", func() {
+			So(lexSummary("See attachment:report.pdf."), ShouldResemble, []string{"Lexed text: See ", "Lexed attachment link: attachment:report.pdf", "Lexed text: ."})
+			So(lexSummary("attachment: alone"), ShouldResemble, []string{"Lexed text: attachment: alone"})
+		})
+
+		Convey("Attachments on this page and others are linked", func() {
+			So(render("markdown", "Read attachment:report.pdf and attachment:Project/Notes/diagram.png"), ShouldEqual,
+				`<p>Read <a class="attachment" href="/PageOne/report.pdf">attachment:report.pdf</a> and <a class="attachment" href="/Project/Notes/diagram.png">attachment:Project/Notes/diagram.png</a></p>`+"\n")
+			So(render("markdown", "[[attachment:report.pdf|the report]]"), ShouldContainSubstring, `<a class="attachment" href="/PageOne/report.pdf">the report</a>`)
+			So(render("markdown", "![diagram](attachment:Project/Notes/diagram.png \"Notes\")"), ShouldContainSubstring, `<img src="/Project/Notes/diagram.png" alt="diagram" title="Notes" />`)
+			So(render("markdown", "[report](attachment:report.pdf)"), ShouldContainSubstring, `<a href="/PageOne/report.pdf">report</a>`)
+			So(render("moin", "attachment:report.pdf [[attachment:Project/Notes/diagram.png|diagram]]"), ShouldEqual,
+				`<p><a class="attachment" href="/PageOne/report.pdf">attachment:report.pdf</a> <a class="attachment" href="/Project/Notes/diagram.png">diagram</a></p>`+"\n")
+		})
+
+		Convey("Missing attachments link to where they can be uploaded", func() {
+			upload := `<a class="attachment-missing" href="/edit/PageOne/?attachment=notes.txt#attachments" title="Upload notes.txt">`
+			So(render("markdown", "attachment:notes.txt"), ShouldContainSubstring, upload+"attachment:notes.txt</a>")
+			So(render("markdown", "![the notes](attachment:notes.txt)"), ShouldContainSubstring, upload+"the notes</a>")
+			So(render("creole", "[[attachment:notes.txt|notes]]"), ShouldContainSubstring, upload+"notes</a>")
+			So(render("markdown", "attachment:NoSuchPage/a.png"), ShouldContainSubstring, `href="/edit/NoSuchPage/?attachment=a.png#attachments"`)
+
+			Convey("unless the reader cannot upload them", func() {
+				reqInfo.Policy = &EditPolicy{Mode: PolicyReadOnly}
+				So(render("markdown", "attachment:notes.txt"), ShouldContainSubstring, `<span class="attachment-missing">attachment:notes.txt</span>`)
+			})
+		})
+
+		Convey("Links that are not to attachments are left alone", func() {
+			So(render("markdown", "attachment:bad/../x [[attachment:a b]]"), ShouldEqual, "<p>attachment:bad/../x [[attachment:a b]]</p>\n")
+			So(string(ExpandWikiWords([]byte("[x](attachment:a.png)"))), ShouldEqual, "[x](attachment:a.png)")
+			So(string(ExpandPageWikiWords([]byte("[x](attachment:a.png)"), "PageOne")), ShouldEqual, "[x](/PageOne/a.png)")
+		})
+	})
+}
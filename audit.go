@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type AuditAction string
+
+const (
+	AuditRevision   AuditAction = "revision"   // a page revision was added
+	AuditAttachment AuditAction = "attachment" // an attachment was uploaded
+	AuditLogin      AuditAction = "login"      // a login attempt, Detail is "failed" when it did not succeed
+	AuditDenied     AuditAction = "denied"     // a request was refused by the permission checks
+
+	auditDateFormat = "2006-01-02"
+)
+
+// A single entry in the audit log, written as one JSON object per line
+type AuditEntry struct {
+	Time       time.Time   `json:"time"`
+	Action     AuditAction `json:"action"`
+	User       string      `json:"user"`
+	RemoteAddr string      `json:"remote_addr"`
+	Page       string      `json:"page,omitempty"`
+	Detail     string      `json:"detail,omitempty"`
+}
+
+// Selects entries from the audit log, empty/zero fields match everything.
+// From and To are inclusive.
+type AuditFilter struct {
+	User string
+	Page string
+	From time.Time
+	To   time.Time
+}
+
+// An append only JSON Lines audit log.  When the log grows beyond maxSize
+// it is rotated to path.1, path.2, ... keeping at most keep old files.
+// A nil *auditLog discards everything.
+type auditLog struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+// A DB that records every change made through it in the audit log.  One is
+// created per request so the entries carry the requesting user.
+type auditDB struct {
+	DB
+	log        *auditLog
+	user       string
+	remoteAddr string
+}
+
+type auditPage struct {
+	Page
+	db *auditDB
+}
+
+func newAuditLog(path string, maxSize int64, keep int) (*auditLog, error) {
+	al := &auditLog{path: path, maxSize: maxSize, keep: keep}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *auditLog) open() error {
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	al.f = f
+	al.size = info.Size()
+	return nil
+}
+
+func (al *auditLog) rotatedName(index int) string {
+	return fmt.Sprintf("%s.%d", al.path, index)
+}
+
+func (al *auditLog) rotate() error {
+	al.f.Close()
+	os.Remove(al.rotatedName(al.keep))
+	for i := al.keep - 1; i > 0; i-- {
+		os.Rename(al.rotatedName(i), al.rotatedName(i+1))
+	}
+	if al.keep > 0 {
+		if err := os.Rename(al.path, al.rotatedName(1)); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(al.path)
+	}
+	return al.open()
+}
+
+// Append an entry to the log, the time is filled in if it is not set
+func (al *auditLog) Record(entry AuditEntry) error {
+	if al == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.User == "" {
+		entry.User = AnonymousUser
+	}
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	if al.maxSize > 0 && al.size > 0 && al.size+int64(len(data)) > al.maxSize {
+		if err := al.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := al.f.Write(data)
+	al.size += int64(n)
+	return err
+}
+
+// Record an entry for the given request
+func (al *auditLog) RecordRequest(r *http.Request, action AuditAction, page, detail string) error {
+	return al.Record(AuditEntry{Action: action, User: CurUser(r).Username(), RemoteAddr: remoteHost(r), Page: page, Detail: detail})
+}
+
+// Return the entries matching the filter, oldest first
+func (al *auditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	results := make([]AuditEntry, 0)
+	if al == nil {
+		return results, nil
+	}
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	files := make([]string, 0, al.keep+1)
+	for i := al.keep; i > 0; i-- {
+		files = append(files, al.rotatedName(i))
+	}
+	files = append(files, al.path)
+	for _, fname := range files {
+		f, err := os.Open(fname)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		results, err = filterAuditEntries(f, filter, results)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func filterAuditEntries(input io.Reader, filter AuditFilter, results []AuditEntry) ([]AuditEntry, error) {
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if filter.Matches(&entry) {
+			results = append(results, entry)
+		}
+	}
+	return results, scanner.Err()
+}
+
+func (filter *AuditFilter) Matches(entry *AuditEntry) bool {
+	if filter.User != "" && filter.User != entry.User {
+		return false
+	}
+	if filter.Page != "" && filter.Page != entry.Page {
+		return false
+	}
+	if !filter.From.IsZero() && entry.Time.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && entry.Time.After(filter.To) {
+		return false
+	}
+	return true
+}
+
+// The address of the client without the port
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Wrap db so that all changes made for this user are audited
+func newAuditDB(db DB, log *auditLog, user *UserInfo, remoteAddr string) DB {
+	if log == nil {
+		return db
+	}
+	return &auditDB{DB: db, log: log, user: user.Username(), remoteAddr: remoteAddr}
+}
+
+func (adb *auditDB) record(action AuditAction, page, detail string) {
+	adb.log.Record(AuditEntry{Action: action, User: adb.user, RemoteAddr: adb.remoteAddr, Page: page, Detail: detail})
+}
+
+func (adb *auditDB) GetPage(key string) (Page, error) {
+	page, err := adb.DB.GetPage(key)
+	if err != nil {
+		return nil, err
+	}
+	return &auditPage{Page: page, db: adb}, nil
+}
+
+func (ap *auditPage) AddRevision(value []byte) error {
+	if err := ap.Page.AddRevision(value); err != nil {
+		return err
+	}
+	ap.db.record(AuditRevision, ap.Name(), fmt.Sprintf("revision %d", ap.Revisions()-1))
+	return nil
+}
+
+func (ap *auditPage) AddRevisionWithMeta(value []byte, meta RevisionMeta) error {
+	if err := ap.Page.AddRevisionWithMeta(value, meta); err != nil {
+		return err
+	}
+	ap.db.record(AuditRevision, ap.Name(), fmt.Sprintf("revision %d", ap.Revisions()-1))
+	return nil
+}
+
+func (ap *auditPage) AddRevisionIfLatest(revision int, value []byte, meta RevisionMeta) error {
+	if err := ap.Page.AddRevisionIfLatest(revision, value, meta); err != nil {
+		return err
+	}
+	ap.db.record(AuditRevision, ap.Name(), fmt.Sprintf("revision %d", revision+1))
+	return nil
+}
+
+func (ap *auditPage) AddAttachment(data io.Reader, key string) error {
+	if err := ap.Page.AddAttachment(data, key); err != nil {
+		return err
+	}
+	ap.db.record(AuditAttachment, ap.Name(), key)
+	return nil
+}
+
+func newAuditLogHandler(log *auditLog) func(*RequestInfo, http.ResponseWriter, *http.Request) {
+	return func(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
+		var details struct {
+			User    string
+			Page    string
+			From    string
+			To      string
+			Entries []AuditEntry
+			ReqInfo *RequestInfo
+		}
+		details.ReqInfo = reqInfo
+		details.User = r.FormValue("user")
+		details.Page = r.FormValue("page")
+		details.From = r.FormValue("from")
+		details.To = r.FormValue("to")
+
+		filter := AuditFilter{User: details.User, Page: details.Page}
+		var err error
+		if details.From != "" {
+			if filter.From, err = time.ParseInLocation(auditDateFormat, details.From, time.Local); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if details.To != "" {
+			if filter.To, err = time.ParseInLocation(auditDateFormat, details.To, time.Local); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			// include the whole day
+			filter.To = filter.To.Add(24*time.Hour - time.Nanosecond)
+		}
+		if details.Entries, err = log.Query(filter); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		templates["audit_log"].Execute(w, &details)
+	}
+}
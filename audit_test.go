@@ -0,0 +1,156 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "auditTest")
+	if err != nil {
+		t.Fatal("Unable to generate tempPath")
+	}
+	defer os.RemoveAll(tempPath)
+
+	Convey("Entries written to the audit log can be queried", t, func() {
+		logName := path.Join(tempPath, "audit.jsonl")
+		os.Remove(logName)
+		log, err := newAuditLog(logName, 0, 2)
+		So(err, ShouldBeNil)
+
+		day1 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+		day2 := day1.Add(24 * time.Hour)
+		So(log.Record(AuditEntry{Time: day1, Action: AuditRevision, User: "UserOne", Page: "PageOne"}), ShouldBeNil)
+		So(log.Record(AuditEntry{Time: day2, Action: AuditAttachment, User: "UserTwo", Page: "PageOne"}), ShouldBeNil)
+		So(log.Record(AuditEntry{Time: day2, Action: AuditLogin}), ShouldBeNil)
+
+		all, err := log.Query(AuditFilter{})
+		So(err, ShouldBeNil)
+		So(len(all), ShouldEqual, 3)
+		So(all[2].User, ShouldEqual, AnonymousUser)
+
+		Convey("Entries can be filtered by user, page and date", func() {
+			entries, err := log.Query(AuditFilter{User: "UserOne"})
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].Action, ShouldEqual, AuditRevision)
+
+			entries, err = log.Query(AuditFilter{Page: "PageOne"})
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 2)
+
+			entries, err = log.Query(AuditFilter{From: day2})
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 2)
+
+			entries, err = log.Query(AuditFilter{To: day1})
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+		})
+	})
+
+	Convey("The audit log is rotated when it grows too large", t, func() {
+		logName := path.Join(tempPath, "rotate.jsonl")
+		log, err := newAuditLog(logName, 200, 2)
+		So(err, ShouldBeNil)
+		for i := 0; i < 10; i++ {
+			So(log.Record(AuditEntry{Action: AuditRevision, User: "UserOne", Page: "PageOne"}), ShouldBeNil)
+		}
+		_, err = os.Stat(logName + ".1")
+		So(err, ShouldBeNil)
+		_, err = os.Stat(logName + ".2")
+		So(err, ShouldBeNil)
+		_, err = os.Stat(logName + ".3")
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		info, err := os.Stat(logName)
+		So(err, ShouldBeNil)
+		So(info.Size(), ShouldBeLessThanOrEqualTo, 200)
+
+		entries, err := log.Query(AuditFilter{})
+		So(err, ShouldBeNil)
+		So(len(entries), ShouldBeGreaterThan, 0)
+		So(len(entries), ShouldBeLessThan, 10)
+	})
+
+	Convey("A nil audit log discards everything", t, func() {
+		var log *auditLog
+		So(log.Record(AuditEntry{Action: AuditLogin}), ShouldBeNil)
+		entries, err := log.Query(AuditFilter{})
+		So(err, ShouldBeNil)
+		So(len(entries), ShouldEqual, 0)
+	})
+}
+
+func TestAuditDB(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "auditTest")
+	if err != nil {
+		t.Fatal("Unable to generate tempPath")
+	}
+	defer os.RemoveAll(tempPath)
+
+	Convey("Changes made through an audited DB are logged", t, func() {
+		logName := path.Join(tempPath, "audit.jsonl")
+		os.Remove(logName)
+		log, err := newAuditLog(logName, 0, 0)
+		So(err, ShouldBeNil)
+		mdb, _ := newMemDB()
+		db := newAuditDB(mdb, log, &UserInfo{username: "UserOne"}, "10.0.0.1")
+
+		page, err := db.GetPage("PageOne")
+		So(err, ShouldBeNil)
+		So(page.AddRevision([]byte("hello")), ShouldBeNil)
+		So(page.AddAttachment(strings.NewReader("data"), "data.txt"), ShouldBeNil)
+		So(page.AddAttachment(strings.NewReader("data"), "$bad"), ShouldNotBeNil)
+		So(page.AddRevisionWithMeta([]byte("hello"), RevisionMeta{Format: "plain"}), ShouldBeNil)
+
+		entries, err := log.Query(AuditFilter{})
+		So(err, ShouldBeNil)
+		So(len(entries), ShouldEqual, 3)
+		So(entries[0].Action, ShouldEqual, AuditRevision)
+		So(entries[0].User, ShouldEqual, "UserOne")
+		So(entries[0].RemoteAddr, ShouldEqual, "10.0.0.1")
+		So(entries[0].Page, ShouldEqual, "PageOne")
+		So(entries[1].Action, ShouldEqual, AuditAttachment)
+		So(entries[1].Detail, ShouldEqual, "data.txt")
+		So(entries[2].Action, ShouldEqual, AuditRevision)
+		So(entries[2].Detail, ShouldEqual, "revision 1")
+
+		Convey("Reads are passed straight through", func() {
+			data, err := page.GetData(CURRENT_REVISION)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "hello")
+			meta, err := page.GetMeta(CURRENT_REVISION)
+			So(err, ShouldBeNil)
+			So(meta.Format, ShouldEqual, "plain")
+			count, err := db.CountPages()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+		})
+		Convey("Permission denials are logged", func() {
+			m := NewEditPolicyMiddleware(&EditPolicy{Mode: PolicyReadOnly}, log, http.NotFoundHandler())
+			record := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/edit/PageOne/", nil)
+			req.RemoteAddr = "10.0.0.2:1234"
+			context.Set(req, keyParams, map[string]string{"name": "PageOne"})
+			m.ServeHTTP(record, req)
+			context.Clear(req)
+			So(record.Code, ShouldEqual, http.StatusForbidden)
+
+			entries, err := log.Query(AuditFilter{})
+			So(err, ShouldBeNil)
+			last := entries[len(entries)-1]
+			So(last.Action, ShouldEqual, AuditDenied)
+			So(last.RemoteAddr, ShouldEqual, "10.0.0.2")
+			So(last.Page, ShouldEqual, "PageOne")
+		})
+	})
+}
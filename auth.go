@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"github.com/gorilla/context"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie   = "wiki_session"
+	sessionLifetime = 12 * time.Hour
+)
+
+var (
+	authErr = errors.New("Invalid username or password")
+)
+
+// A source of user accounts
+type UserStore interface {
+	Authenticate(username, password string) (*UserInfo, error) // check the password and return the user, authErr on failure
+	Lookup(username string) (*UserInfo, error)                 // return the user without checking a password
+}
+
+type userRecord struct {
+	hash  []byte
+	roles []string
+}
+
+// A simple user store, read from a text file with one user per line of the
+// form "username:bcrypt hash:role1,role2".  Blank lines and lines starting
+// with # are ignored.
+type fileUserStore struct {
+	users map[string]userRecord
+}
+
+// server side session information
+type sessionStore struct {
+	lock     sync.Mutex
+	lifetime time.Duration
+	sessions map[string]*session
+}
+
+type session struct {
+	user    *UserInfo
+	expires time.Time
+}
+
+func newFileUserStore(fname string) (UserStore, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return newUserStore(f)
+}
+
+func newUserStore(input io.Reader) (UserStore, error) {
+	store := &fileUserStore{users: make(map[string]userRecord)}
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[0] == AnonymousUser {
+			return nil, errors.New("Invalid user entry '" + line + "'")
+		}
+		rec := userRecord{hash: []byte(parts[1]), roles: []string{}}
+		if len(parts) == 3 {
+			for _, role := range strings.Split(parts[2], ",") {
+				if role = strings.TrimSpace(role); role != "" {
+					rec.roles = append(rec.roles, role)
+				}
+			}
+		}
+		store.users[parts[0]] = rec
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (us *fileUserStore) Authenticate(username, password string) (*UserInfo, error) {
+	rec, ok := us.users[username]
+	if !ok {
+		return nil, authErr
+	}
+	if bcrypt.CompareHashAndPassword(rec.hash, []byte(password)) != nil {
+		return nil, authErr
+	}
+	return rec.userInfo(username), nil
+}
+
+func (us *fileUserStore) Lookup(username string) (*UserInfo, error) {
+	rec, ok := us.users[username]
+	if !ok {
+		return nil, authErr
+	}
+	return rec.userInfo(username), nil
+}
+
+func (rec *userRecord) userInfo(username string) *UserInfo {
+	user := &UserInfo{username: username}
+	for _, role := range rec.roles {
+		user.AddRole(role)
+	}
+	return user
+}
+
+func newSessionStore(lifetime time.Duration) *sessionStore {
+	return &sessionStore{lifetime: lifetime, sessions: make(map[string]*session)}
+}
+
+// Create a new session for the user, returning the session id
+func (ss *sessionStore) Create(user *UserInfo) (string, error) {
+	id, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	ss.sessions[id] = &session{user: user, expires: time.Now().Add(ss.lifetime)}
+	return id, nil
+}
+
+// Lookup the user for a session, nil if there is no such session or it has expired
+func (ss *sessionStore) Lookup(id string) *UserInfo {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	s, ok := ss.sessions[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(s.expires) {
+		delete(ss.sessions, id)
+		return nil
+	}
+	return s.user
+}
+
+func (ss *sessionStore) Remove(id string) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	delete(ss.sessions, id)
+}
+
+// The SessionMiddleware resolves the session cookie into the current user
+// and stores it in the context.  Requests without a valid session are anonymous.
+func NewSessionMiddleware(sessions *sessionStore, next http.Handler) http.Handler {
+	var f http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			if user := sessions.Lookup(cookie.Value); user != nil {
+				context.Set(r, keyUser, user)
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+	return f
+}
+
+// only allow redirects back into the wiki
+func safeRedirectTarget(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+func showLogin(reqInfo *RequestInfo, w http.ResponseWriter, next string, failed bool) {
+	var details struct {
+		Next    string
+		Failed  bool
+		ReqInfo *RequestInfo
+	}
+	details.Next = next
+	details.Failed = failed
+	details.ReqInfo = reqInfo
+	if failed {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	templates["login"].Execute(w, &details)
+}
+
+func ShowLoginHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
+	showLogin(reqInfo, w, safeRedirectTarget(r.FormValue("next")), false)
+}
+
+func newLoginHandler(users UserStore, sessions *sessionStore, log *auditLog) func(*RequestInfo, http.ResponseWriter, *http.Request) {
+	return func(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		next := safeRedirectTarget(r.FormValue("next"))
+
+		username := r.FormValue("username")
+		var user *UserInfo
+		err := authErr
+		if users != nil {
+			user, err = users.Authenticate(username, r.FormValue("password"))
+		}
+		if err != nil {
+			log.Record(AuditEntry{Action: AuditLogin, User: username, RemoteAddr: remoteHost(r), Detail: "failed"})
+			showLogin(reqInfo, w, next, true)
+			return
+		}
+		log.Record(AuditEntry{Action: AuditLogin, User: user.Username(), RemoteAddr: remoteHost(r)})
+		id, err := sessions.Create(user)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		http.Redirect(w, r, next, http.StatusFound)
+	}
+}
+
+func newLogoutHandler(sessions *sessionStore) func(*RequestInfo, http.ResponseWriter, *http.Request) {
+	return func(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			sessions.Remove(cookie.Value)
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
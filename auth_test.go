@@ -0,0 +1,153 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testUserStore(t *testing.T) UserStore {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal("Unable to hash password")
+	}
+	users, err := newUserStore(strings.NewReader("# test users\n\nUserOne:" + string(hash) + ":editor,admin\nUserTwo:" + string(hash) + "\n"))
+	if err != nil {
+		t.Fatal("Unable to create user store")
+	}
+	return users
+}
+
+func TestUserStore(t *testing.T) {
+	users := testUserStore(t)
+
+	Convey("Users are authenticated against the user store", t, func() {
+		u, err := users.Authenticate("UserOne", "secret")
+		So(err, ShouldBeNil)
+		So(u.Username(), ShouldEqual, "UserOne")
+		So(u.Roles(), ShouldContain, "editor")
+		So(u.Roles(), ShouldContain, "admin")
+
+		u, err = users.Authenticate("UserTwo", "secret")
+		So(err, ShouldBeNil)
+		So(len(u.Roles()), ShouldBeZeroValue)
+
+		Convey("Bad passwords and unknown users fail", func() {
+			_, err = users.Authenticate("UserOne", "wrong")
+			So(err, ShouldEqual, authErr)
+			_, err = users.Authenticate("Nobody", "secret")
+			So(err, ShouldEqual, authErr)
+		})
+		Convey("Malformed entries are rejected", func() {
+			_, err = newUserStore(strings.NewReader("justaname\n"))
+			So(err, ShouldNotBeNil)
+			_, err = newUserStore(strings.NewReader(AnonymousUser + ":abc\n"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSessionStore(t *testing.T) {
+	Convey("Sessions map ids to users", t, func() {
+		ss := newSessionStore(time.Hour)
+		user := &UserInfo{username: "UserOne"}
+		id, err := ss.Create(user)
+		So(err, ShouldBeNil)
+		So(id, ShouldNotEqual, "")
+		So(ss.Lookup(id), ShouldEqual, user)
+		So(ss.Lookup("bogus"), ShouldBeNil)
+
+		Convey("Removed sessions are gone", func() {
+			ss.Remove(id)
+			So(ss.Lookup(id), ShouldBeNil)
+		})
+		Convey("Expired sessions are gone", func() {
+			ss = newSessionStore(-time.Second)
+			id, _ = ss.Create(user)
+			So(ss.Lookup(id), ShouldBeNil)
+		})
+	})
+}
+
+func TestSessionMiddleware(t *testing.T) {
+	var user *UserInfo
+	var okHandler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		user = CurUser(r)
+	}
+	ss := newSessionStore(time.Hour)
+	id, _ := ss.Create(&UserInfo{username: "UserOne"})
+
+	Convey("The SessionMiddleware puts the session user into the context", t, func() {
+		m := NewSessionMiddleware(ss, okHandler)
+		record := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/", nil)
+		So(err, ShouldBeNil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: id})
+		m.ServeHTTP(record, req)
+		context.Clear(req)
+		So(user.Username(), ShouldEqual, "UserOne")
+
+		Convey("Requests without a session are anonymous", func() {
+			record := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/", nil)
+			So(err, ShouldBeNil)
+			m.ServeHTTP(record, req)
+			So(user.IsAnonymous(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestLoginHandler(t *testing.T) {
+	users := testUserStore(t)
+	ss := newSessionStore(time.Hour)
+	login := newLoginHandler(users, ss, nil)
+
+	post := func(username, password, next string) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Add("username", username)
+		form.Add("password", password)
+		form.Add("next", next)
+		record := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/login/", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("Unable to create test request")
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		login(&RequestInfo{Params: make(map[string]string)}, record, req)
+		return record
+	}
+
+	Convey("Logging in with a valid password creates a session", t, func() {
+		record := post("UserOne", "secret", "/edit/PageOne/")
+		So(record.Code, ShouldEqual, http.StatusFound)
+		So(record.Header().Get("Location"), ShouldEqual, "/edit/PageOne/")
+		cookie := record.Header().Get("Set-Cookie")
+		So(cookie, ShouldStartWith, sessionCookie+"=")
+		id := strings.SplitN(strings.SplitN(cookie, ";", 2)[0], "=", 2)[1]
+		So(ss.Lookup(id).Username(), ShouldEqual, "UserOne")
+
+		Convey("Redirects outside of the wiki are not followed", func() {
+			record := post("UserOne", "secret", "//example.com/")
+			So(record.Header().Get("Location"), ShouldEqual, "/")
+		})
+		Convey("A bad password is refused", func() {
+			record := post("UserOne", "wrong", "/")
+			So(record.Code, ShouldEqual, http.StatusUnauthorized)
+			So(record.Header().Get("Set-Cookie"), ShouldEqual, "")
+		})
+		Convey("Logging out removes the session", func() {
+			record := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/logout/", nil)
+			req.AddCookie(&http.Cookie{Name: sessionCookie, Value: id})
+			newLogoutHandler(ss)(&RequestInfo{Params: make(map[string]string)}, record, req)
+			So(record.Code, ShouldEqual, http.StatusFound)
+			So(ss.Lookup(id), ShouldBeNil)
+		})
+	})
+}
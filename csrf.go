@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/gorilla/context"
+	"net/http"
+	"strings"
+)
+
+const (
+	csrfCookie = "wiki_csrf"
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// Only these methods can change the wiki, everything else is left alone
+func csrfProtectedMethod(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Bearer token requests do not carry cookies from the browser, so they
+// cannot be forged by another site
+func isBearerRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// The CSRFMiddleware issues a random token per browser session in a cookie
+// and puts it in the context so that the templates can add it to their forms.
+// Requests that modify the wiki must send the same token back in the
+// csrf_token form field (or X-CSRF-Token header) or they are rejected.
+func NewCSRFMiddleware(log *auditLog, next http.Handler) http.Handler {
+	var f http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 64 {
+			token = cookie.Value
+		}
+		if csrfProtectedMethod(r.Method) && !isBearerRequest(r) {
+			sent := r.Header.Get(csrfHeader)
+			if sent == "" {
+				sent = r.FormValue(csrfField)
+			}
+			if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(sent)) != 1 {
+				log.RecordRequest(r, AuditDenied, CurParams(r)["name"], "invalid csrf token for "+r.Method+" "+r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		if token == "" {
+			var err error
+			if token, err = randomToken(32); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		}
+		context.Set(r, keyCSRF, token)
+		next.ServeHTTP(w, r)
+	}
+	return f
+}
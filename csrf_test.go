@@ -0,0 +1,100 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	called := false
+	token := ""
+	var okHandler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		token = CurCSRFToken(r)
+	}
+	m := NewCSRFMiddleware(nil, okHandler)
+
+	post := func(cookie, formToken string) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Add("entry", "hello")
+		if formToken != "" {
+			form.Add(csrfField, formToken)
+		}
+		req, _ := http.NewRequest("POST", "/edit/PageOne/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: csrfCookie, Value: cookie})
+		}
+		record := httptest.NewRecorder()
+		m.ServeHTTP(record, req)
+		return record
+	}
+
+	Convey("A GET request is given a token in a cookie and the context", t, func() {
+		called = false
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/edit/PageOne/", nil)
+		m.ServeHTTP(record, req)
+		So(called, ShouldBeTrue)
+		So(len(token), ShouldEqual, 64)
+		So(record.Header().Get("Set-Cookie"), ShouldStartWith, csrfCookie+"="+token)
+		issued := token
+
+		Convey("A POST with the matching token is accepted", func() {
+			called = false
+			record := post(issued, issued)
+			So(called, ShouldBeTrue)
+			So(token, ShouldEqual, issued)
+			So(record.Header().Get("Set-Cookie"), ShouldEqual, "")
+		})
+		Convey("A POST without a token is rejected", func() {
+			called = false
+			record := post(issued, "")
+			So(called, ShouldBeFalse)
+			So(record.Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("A POST with the wrong token is rejected", func() {
+			called = false
+			record := post(issued, strings.Repeat("0", 64))
+			So(called, ShouldBeFalse)
+			So(record.Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("A POST without the cookie is rejected", func() {
+			called = false
+			record := post("", issued)
+			So(called, ShouldBeFalse)
+			So(record.Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("The token may also be sent as a header", func() {
+			called = false
+			req, _ := http.NewRequest("POST", "/edit/PageOne/", nil)
+			req.AddCookie(&http.Cookie{Name: csrfCookie, Value: issued})
+			req.Header.Set(csrfHeader, issued)
+			m.ServeHTTP(httptest.NewRecorder(), req)
+			So(called, ShouldBeTrue)
+		})
+		Convey("Bearer token requests are exempt", func() {
+			called = false
+			req, _ := http.NewRequest("POST", "/edit/PageOne/", nil)
+			req.Header.Set("Authorization", "Bearer abc")
+			m.ServeHTTP(httptest.NewRecorder(), req)
+			So(called, ShouldBeTrue)
+		})
+	})
+}
+
+func TestEditPageIncludesCSRFToken(t *testing.T) {
+	wiki, _ := newMemDB()
+
+	Convey("The edit page forms carry the CSRF token", t, func() {
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/edit/PageOne/", nil)
+		ShowEditPageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki, CSRFToken: "TheToken"}, record, req)
+		So(record.Code, ShouldEqual, http.StatusOK)
+		So(strings.Count(record.Body.String(), `name="csrf_token" value="TheToken"`), ShouldEqual, 2)
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -9,7 +10,10 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -17,6 +21,10 @@ const (
 
 	fdb_attachment_prefix = "a_"
 
+	fdb_sub_page_prefix = "p_"
+
+	fdb_meta_suffix = ".meta"
+
 	fdb_Mode = os.ModeDir | 0750
 
 	CURRENT_REVISION = -1
@@ -28,6 +36,8 @@ var (
 
 	NOT_FOUND = errors.New("Page not found")
 
+	staleRevisionErr = errors.New("The page has a newer revision")
+
 	attachment_re = regexp.MustCompile("^[0-9A-Za-z\\-\\_]+(\\.[0-9A-Za-z\\-\\_]+)?$")
 
 	fdb_Page_re = regexp.MustCompile("^[0-9]{8}$")
@@ -40,9 +50,19 @@ type Attachment interface {
 	Name() string
 }
 
+// Information stored alongside each revision of a page
+type RevisionMeta struct {
+	Format     string     `json:"format,omitempty"`     // the markup language of the revision, "" for the default
+	Properties Properties `json:"properties,omitempty"` // set from the front matter of the revision when it is added
+	Time       time.Time  `json:"time"`                 // when the revision was added
+}
+
 type Page interface {
 	GetData(int) ([]byte, error)
 	AddRevision([]byte) error
+	AddRevisionWithMeta([]byte, RevisionMeta) error      // add a revision along with its metadata
+	AddRevisionIfLatest(int, []byte, RevisionMeta) error // add a revision only while the given one is the latest, staleRevisionErr otherwise
+	GetMeta(int) (RevisionMeta, error)                   // the metadata of a revision, revisions without any return an empty RevisionMeta
 	Revisions() int
 	Name() string
 	AddAttachment(io.Reader, string) error
@@ -53,16 +73,22 @@ type Page interface {
 
 // Generic interface into the database
 type DB interface {
-	PageExists(string) (bool, error) // given a page name query to see if it exists
-	GetPage(string) (Page, error)    // retreive a page given the name, it will return the error NOT_FOUND if the page does not exist
-	ListPages() ([]string, error)    // list the pages in the wiki
-	CountPages() (int, error)        // return the number of pages in the wiki
+	PageExists(string) (bool, error)                       // given a page name query to see if it exists
+	GetPage(string) (Page, error)                          // retreive a page given the name, it will return the error NOT_FOUND if the page does not exist
+	ListPages() ([]string, error)                          // list the pages in the wiki
+	ListSubPages(string) ([]string, error)                 // list the pages below the given page, ie ProjectX/DesignNotes for ProjectX, sorted by name
+	CountPages() (int, error)                              // return the number of pages in the wiki
+	PagesWithProperty(string) (map[string]Property, error) // the value of a property on each page whose current revision sets it
+	PagesTagged(string) ([]string, error)                  // the pages whose current revision has the tag, sorted by name
+	Tags() (map[string]int, error)                         // every tag with the number of pages it is on
 }
 
 // A simple memory based wiki database
 type memDB struct {
 	lock  sync.Mutex
 	pages map[string]*memPage
+	tags  *tagIndex
+	props *propertyIndex
 }
 
 // a page in the memory based wiki
@@ -71,6 +97,7 @@ type memPage struct {
 	db          *memDB
 	name        string
 	revisions   [][]byte
+	metas       []RevisionMeta
 	attachments map[string][]byte
 }
 
@@ -81,12 +108,17 @@ type memAttachment struct {
 
 // A simple file system backed wiki database
 type fileDB struct {
-	lock sync.Mutex
-	root string
+	lock       sync.Mutex
+	root       string
+	tags       *tagIndex
+	props      *propertyIndex
+	writeLocks map[string]*sync.Mutex // revisions of a page are added one at a time
 }
 
 type filePage struct {
+	db   *fileDB
 	path string
+	name string
 }
 
 type fileAttachment struct {
@@ -99,18 +131,64 @@ func newFileDB(root string) (DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &fileDB{root: root}, nil
+	fdb := &fileDB{root: root, tags: newTagIndex(), props: newPropertyIndex(), writeLocks: make(map[string]*sync.Mutex)}
+	if err := fdb.indexPages(); err != nil {
+		return nil, err
+	}
+	return fdb, nil
+}
+
+// Read the tags and properties of the current revision of every page
+func (fdb *fileDB) indexPages() error {
+	names, err := fdb.listPages()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		page := &filePage{db: fdb, path: fdb.pageDirName(name), name: name}
+		src, err := page.GetData(CURRENT_REVISION)
+		if err != nil {
+			return err
+		}
+		meta, err := page.GetMeta(CURRENT_REVISION)
+		if err != nil {
+			return err
+		}
+		fdb.tags.update(name, pageTags(src, meta.Format))
+		fdb.props.update(name, pageProperties(src))
+	}
+	return nil
 }
 
+// Sub pages are stored in the directory of their parent with a p_ prefix so
+// they cannot clash with the revisions and attachments of the parent.
 func (fdb *fileDB) pageDirName(key string) string {
-	return path.Join(fdb.root, fdb_Pages, key)
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = encodePageName(part)
+		if i > 0 {
+			parts[i] = fdb_sub_page_prefix + parts[i]
+		}
+	}
+	return path.Join(fdb.root, fdb_Pages, path.Join(parts...))
+}
+
+// The lock held while a revision is added to a page
+func (fdb *fileDB) writeLock(key string) *sync.Mutex {
+	fdb.lock.Lock()
+	defer fdb.lock.Unlock()
+
+	if fdb.writeLocks[key] == nil {
+		fdb.writeLocks[key] = &sync.Mutex{}
+	}
+	return fdb.writeLocks[key]
 }
 
 func (fdb *fileDB) PageExists(key string) (bool, error) {
 	fdb.lock.Lock()
 	defer fdb.lock.Unlock()
 
-	if !IsWikiWord(key) {
+	if !IsValidPageName(key) {
 		return false, dbErr
 	}
 
@@ -124,35 +202,99 @@ func (fdb *fileDB) PageExists(key string) (bool, error) {
 	if fInfo.IsDir() == false {
 		return false, dbErr
 	}
-	return true, nil
+	// the directory of a parent page exists as soon as a sub page is made
+	fInfos, err := ioutil.ReadDir(fdb.pageDirName(key))
+	if err != nil {
+		return false, err
+	}
+	return getMaxFDBRevision(fInfos) >= 0, nil
 }
 
 func (fdb *fileDB) GetPage(key string) (Page, error) {
 	fdb.lock.Lock()
 	defer fdb.lock.Unlock()
 
-	if !IsWikiWord(key) {
+	if !IsValidPageName(key) {
 		return nil, dbErr
 	}
+	for _, part := range strings.Split(key, "/") {
+		if len(fdb_sub_page_prefix+encodePageName(part)) > 255 {
+			return nil, dbErr
+		}
+	}
+
+	return Page(&filePage{db: fdb, path: fdb.pageDirName(key), name: key}), nil
+}
+
+// Add the pages stored in dir and the directories below it to results,
+// parent is the name of the page that dir holds or "" for the top level
+func (fdb *fileDB) walkPages(dir, parent string, results []string) ([]string, error) {
+	fInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range fInfos {
+		fname := info.Name()
+		if !info.IsDir() {
+			continue
+		}
+		if parent != "" {
+			if !strings.HasPrefix(fname, fdb_sub_page_prefix) {
+				continue
+			}
+			fname = fname[len(fdb_sub_page_prefix):]
+		}
+		name, err := decodePageName(fname)
+		if err != nil {
+			continue
+		}
+		if parent != "" {
+			name = parent + "/" + name
+		}
+		if !IsValidPageName(name) {
+			continue
+		}
+		subDir := path.Join(dir, info.Name())
+		if subInfos, err := ioutil.ReadDir(subDir); err == nil && getMaxFDBRevision(subInfos) >= 0 {
+			results = append(results, name)
+		}
+		if results, err = fdb.walkPages(subDir, name, results); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
 
-	return Page(&filePage{path: fdb.pageDirName(key)}), nil
+func (fdb *fileDB) listPages() ([]string, error) {
+	results, err := fdb.walkPages(path.Join(fdb.root, fdb_Pages), "", make([]string, 0))
+	if err != nil {
+		return nil, dbErr
+	}
+	return results, nil
 }
 
 func (fdb *fileDB) ListPages() ([]string, error) {
 	fdb.lock.Lock()
 	defer fdb.lock.Unlock()
 
-	fInfos, err := ioutil.ReadDir(path.Join(fdb.root, fdb_Pages))
-	if err != nil {
+	return fdb.listPages()
+}
+
+func (fdb *fileDB) ListSubPages(key string) ([]string, error) {
+	fdb.lock.Lock()
+	defer fdb.lock.Unlock()
+
+	if !IsValidPageName(key) {
 		return nil, dbErr
 	}
-	results := make([]string, 0, len(fInfos))
-	for _, info := range fInfos {
-		name := path.Base(info.Name())
-		if IsWikiWord(name) {
-			results = append(results, name)
+	results, err := fdb.walkPages(fdb.pageDirName(key), key, make([]string, 0))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
 		}
+		return nil, dbErr
 	}
+	sort.Strings(results)
 	return results, nil
 }
 
@@ -160,11 +302,23 @@ func (fdb *fileDB) CountPages() (int, error) {
 	fdb.lock.Lock()
 	defer fdb.lock.Unlock()
 
-	fInfos, err := ioutil.ReadDir(path.Join(fdb.root, fdb_Pages))
+	results, err := fdb.listPages()
 	if err != nil {
 		return 0, err
 	}
-	return len(fInfos), nil
+	return len(results), nil
+}
+
+func (fdb *fileDB) PagesWithProperty(key string) (map[string]Property, error) {
+	return fdb.props.withProperty(key), nil
+}
+
+func (fdb *fileDB) PagesTagged(tag string) ([]string, error) {
+	return fdb.tags.pagesTagged(tag), nil
+}
+
+func (fdb *fileDB) Tags() (map[string]int, error) {
+	return fdb.tags.counts(), nil
 }
 
 func (fpg *filePage) GetData(index int) ([]byte, error) {
@@ -185,8 +339,39 @@ func (fpg *filePage) GetData(index int) ([]byte, error) {
 }
 
 func (fpg *filePage) AddRevision(value []byte) error {
+	return fpg.AddRevisionWithMeta(value, RevisionMeta{})
+}
+
+func (fpg *filePage) AddRevisionWithMeta(value []byte, meta RevisionMeta) error {
+	lock := fpg.db.writeLock(fpg.name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return fpg.addRevision(value, meta)
+}
+
+func (fpg *filePage) AddRevisionIfLatest(revision int, value []byte, meta RevisionMeta) error {
+	lock := fpg.db.writeLock(fpg.name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if revision != fpg.Revisions()-1 {
+		return staleRevisionErr
+	}
+	return fpg.addRevision(value, meta)
+}
+
+// The metadata is kept in a %08d.meta file next to the revision, it is
+// written first so a revision never appears without it
+func (fpg *filePage) addRevision(value []byte, meta RevisionMeta) error {
+	meta.Properties = pageProperties(value)
+	meta.Time = time.Now()
+	metaData, err := json.Marshal(&meta)
+	if err != nil {
+		return err
+	}
 	// this is a noop if it already exists
-	err := os.MkdirAll(fpg.path, fdb_Mode)
+	err = os.MkdirAll(fpg.path, fdb_Mode)
 	if err != nil {
 		return err
 	}
@@ -208,8 +393,58 @@ func (fpg *filePage) AddRevision(value []byte) error {
 	maxRevision := getMaxFDBRevision(fInfos)
 
 	newFName := fmt.Sprintf("%08d", maxRevision+1)
-	err = os.Rename(tmpName, path.Join(fpg.path, newFName))
-	return err
+	if err := fpg.writeMeta(newFName+fdb_meta_suffix, metaData); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path.Join(fpg.path, newFName)); err != nil {
+		return err
+	}
+	fpg.db.tags.update(fpg.name, pageTags(value, meta.Format))
+	fpg.db.props.update(fpg.name, meta.Properties)
+	return nil
+}
+
+func (fpg *filePage) writeMeta(fname string, data []byte) error {
+	f, err := ioutil.TempFile(fpg.path, "tm_")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+
+	if err := writeAndClose(f, data); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path.Join(fpg.path, fname))
+}
+
+func (fpg *filePage) GetMeta(index int) (RevisionMeta, error) {
+	var meta RevisionMeta
+	revisions := fpg.Revisions()
+	if revisions == NO_REVISIONS || index >= revisions || (index < 0 && index != CURRENT_REVISION) {
+		return meta, dbErr
+	}
+	if index == CURRENT_REVISION {
+		index = revisions - 1
+	}
+	fname := path.Join(fpg.path, fmt.Sprintf("%08d", index))
+	data, err := ioutil.ReadFile(fname + fdb_meta_suffix)
+	if err == nil {
+		err = json.Unmarshal(data, &meta)
+	} else if os.IsNotExist(err) {
+		// revisions from before metadata was kept have none
+		err = nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	// older metadata has no time, the revision file was written when it was added
+	if meta.Time.IsZero() {
+		if fInfo, err := os.Stat(fname); err == nil {
+			meta.Time = fInfo.ModTime()
+		}
+	}
+	return meta, nil
 }
 
 func (fpg *filePage) Revisions() int {
@@ -220,7 +455,7 @@ func (fpg *filePage) Revisions() int {
 }
 
 func (fpg *filePage) Name() string {
-	return path.Base(fpg.path)
+	return fpg.name
 }
 
 func (fpg *filePage) AddAttachment(data io.Reader, key string) error {
@@ -291,14 +526,14 @@ func (fa *fileAttachment) Open() (io.ReadCloser, error) {
 }
 
 func newMemDB() (DB, error) {
-	return &memDB{pages: make(map[string]*memPage)}, nil
+	return &memDB{pages: make(map[string]*memPage), tags: newTagIndex(), props: newPropertyIndex()}, nil
 }
 
 func (mdb *memDB) PageExists(key string) (bool, error) {
 	mdb.lock.Lock()
 	defer mdb.lock.Unlock()
 
-	if !IsWikiWord(key) {
+	if !IsValidPageName(key) {
 		return false, dbErr
 	}
 	page, ok := mdb.pages[key]
@@ -312,7 +547,7 @@ func (mdb *memDB) GetPage(key string) (Page, error) {
 	mdb.lock.Lock()
 	defer mdb.lock.Unlock()
 
-	if !IsWikiWord(key) {
+	if !IsValidPageName(key) {
 		return nil, dbErr
 	}
 	val, ok := mdb.pages[key]
@@ -338,6 +573,23 @@ func (mdb *memDB) ListPages() ([]string, error) {
 
 }
 
+func (mdb *memDB) ListSubPages(key string) ([]string, error) {
+	mdb.lock.Lock()
+	defer mdb.lock.Unlock()
+
+	if !IsValidPageName(key) {
+		return nil, dbErr
+	}
+	results := make([]string, 0)
+	for name, page := range mdb.pages {
+		if strings.HasPrefix(name, key+"/") && page.Revisions() > 0 {
+			results = append(results, name)
+		}
+	}
+	sort.Strings(results)
+	return results, nil
+}
+
 func (mdb *memDB) CountPages() (int, error) {
 	mdb.lock.Lock()
 	defer mdb.lock.Unlock()
@@ -351,6 +603,18 @@ func (mdb *memDB) CountPages() (int, error) {
 	return count, nil
 }
 
+func (mdb *memDB) PagesWithProperty(key string) (map[string]Property, error) {
+	return mdb.props.withProperty(key), nil
+}
+
+func (mdb *memDB) PagesTagged(tag string) ([]string, error) {
+	return mdb.tags.pagesTagged(tag), nil
+}
+
+func (mdb *memDB) Tags() (map[string]int, error) {
+	return mdb.tags.counts(), nil
+}
+
 func (mp *memPage) GetData(index int) ([]byte, error) {
 	mp.lock.Lock()
 	defer mp.lock.Unlock()
@@ -366,13 +630,51 @@ func (mp *memPage) GetData(index int) ([]byte, error) {
 }
 
 func (mp *memPage) AddRevision(value []byte) error {
+	return mp.AddRevisionWithMeta(value, RevisionMeta{})
+}
+
+func (mp *memPage) AddRevisionWithMeta(value []byte, meta RevisionMeta) error {
 	mp.lock.Lock()
 	defer mp.lock.Unlock()
 
+	return mp.addRevision(value, meta)
+}
+
+func (mp *memPage) AddRevisionIfLatest(revision int, value []byte, meta RevisionMeta) error {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	if revision != len(mp.revisions)-1 {
+		return staleRevisionErr
+	}
+	return mp.addRevision(value, meta)
+}
+
+// add a revision, the page must be locked
+func (mp *memPage) addRevision(value []byte, meta RevisionMeta) error {
+	meta.Properties = pageProperties(value)
+	meta.Time = time.Now()
 	mp.revisions = append(mp.revisions, value)
+	mp.metas = append(mp.metas, meta)
+	mp.db.tags.update(mp.name, pageTags(value, meta.Format))
+	mp.db.props.update(mp.name, meta.Properties)
 	return nil
 }
 
+func (mp *memPage) GetMeta(index int) (RevisionMeta, error) {
+	mp.lock.Lock()
+	defer mp.lock.Unlock()
+
+	max := len(mp.metas)
+	if max == 0 || index >= max || (index < 0 && index != CURRENT_REVISION) {
+		return RevisionMeta{}, dbErr
+	}
+	if index == CURRENT_REVISION {
+		return mp.metas[max-1], nil
+	}
+	return mp.metas[index], nil
+}
+
 func (mp *memPage) Revisions() int {
 	mp.lock.Lock()
 	defer mp.lock.Unlock()
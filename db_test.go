@@ -6,8 +6,11 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMemDB(t *testing.T) {
@@ -46,6 +49,294 @@ func TestFileDBAttachment(t *testing.T) {
 	doTestAttachments(t, db, "file")
 }
 
+func TestMemDBFreeFormNames(t *testing.T) {
+	db, _ := newMemDB()
+	doTestFreeFormNames(t, db, "memory")
+}
+
+func TestFileDBFreeFormNames(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "dbTest")
+	if err != nil {
+		t.Fatal("Unable to generate tempPath")
+	}
+	defer os.RemoveAll(tempPath)
+	db, err := newFileDB(tempPath)
+	if err != nil {
+		t.Fatal("Unable to create file database")
+	}
+	doTestFreeFormNames(t, db, "file")
+
+	Convey("WikiWord pages are stored under their own name so old databases keep working", t, func() {
+		_, err := os.Stat(path.Join(tempPath, fdb_Pages, "WikiWord"))
+		So(err, ShouldBeNil)
+		_, err = os.Stat(path.Join(tempPath, fdb_Pages, "Release%20notes%202026"))
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestMemDBSubPages(t *testing.T) {
+	db, _ := newMemDB()
+	doTestSubPages(t, db, "memory")
+}
+
+func TestFileDBSubPages(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "dbTest")
+	if err != nil {
+		t.Fatal("Unable to generate tempPath")
+	}
+	defer os.RemoveAll(tempPath)
+	db, err := newFileDB(tempPath)
+	if err != nil {
+		t.Fatal("Unable to create file database")
+	}
+	doTestSubPages(t, db, "file")
+
+	Convey("Sub pages are stored in the directory of their parent", t, func() {
+		_, err := os.Stat(path.Join(tempPath, fdb_Pages, "ProjectX", "p_Design%20notes", "p_00000001", "00000000"))
+		So(err, ShouldBeNil)
+	})
+}
+
+func doTestSubPages(t *testing.T, db DB, dbType string) {
+	// 00000001 and a_file would clash with a revision and an attachment if sub pages were not prefixed
+	names := []string{"ProjectX/Design notes", "ProjectX/Design notes/00000001", "ProjectX/a_file", "Other/Child"}
+
+	Convey("A "+dbType+" database stores sub pages", t, func() {
+		for _, name := range names {
+			page, err := db.GetPage(name)
+			So(err, ShouldBeNil)
+			So(page.AddRevision([]byte(name)), ShouldBeNil)
+		}
+		page, err := db.GetPage("ProjectX")
+		So(err, ShouldBeNil)
+		So(page.Revisions(), ShouldEqual, NO_REVISIONS)
+
+		Convey("Parents without revisions do not exist", func() {
+			exists, err := db.PageExists("ProjectX")
+			So(err, ShouldBeNil)
+			So(exists, ShouldBeFalse)
+			exists, err = db.PageExists("ProjectX/Design notes/00000001")
+			So(err, ShouldBeNil)
+			So(exists, ShouldBeTrue)
+
+			lst, err := db.ListPages()
+			So(err, ShouldBeNil)
+			So(len(lst), ShouldEqual, len(names))
+			for _, name := range names {
+				So(lst, ShouldContain, name)
+			}
+		})
+		Convey("Sub pages can be listed by parent", func() {
+			lst, err := db.ListSubPages("ProjectX")
+			So(err, ShouldBeNil)
+			So(lst, ShouldResemble, []string{"ProjectX/Design notes", "ProjectX/Design notes/00000001", "ProjectX/a_file"})
+
+			lst, err = db.ListSubPages("Other/Child")
+			So(err, ShouldBeNil)
+			So(len(lst), ShouldEqual, 0)
+
+			lst, err = db.ListSubPages("Missing")
+			So(err, ShouldBeNil)
+			So(len(lst), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestMemDBRevisionMeta(t *testing.T) {
+	db, _ := newMemDB()
+	doTestRevisionMeta(t, db, "memory")
+}
+
+func TestFileDBRevisionMeta(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "dbTest")
+	if err != nil {
+		t.Fatal("Unable to generate tempPath")
+	}
+	defer os.RemoveAll(tempPath)
+	db, err := newFileDB(tempPath)
+	if err != nil {
+		t.Fatal("Unable to create file database")
+	}
+	doTestRevisionMeta(t, db, "file")
+
+	Convey("The metadata is kept next to the revision", t, func() {
+		_, err := os.Stat(path.Join(tempPath, fdb_Pages, "MetaPage", "00000001.meta"))
+		So(err, ShouldBeNil)
+		Convey("and does not count as a revision", func() {
+			page, _ := db.GetPage("MetaPage")
+			So(page.Revisions(), ShouldEqual, 2)
+		})
+		Convey("revisions without a recorded time use the time of the revision file", func() {
+			page, _ := db.GetPage("MetaPage")
+			when := time.Date(2015, 3, 7, 10, 0, 0, 0, time.UTC)
+			os.Remove(path.Join(tempPath, fdb_Pages, "MetaPage", "00000001.meta"))
+			So(os.Chtimes(path.Join(tempPath, fdb_Pages, "MetaPage", "00000001"), when, when), ShouldBeNil)
+			meta, err := page.GetMeta(CURRENT_REVISION)
+			So(err, ShouldBeNil)
+			So(meta.Time.Equal(when), ShouldBeTrue)
+		})
+	})
+}
+
+func doTestRevisionMeta(t *testing.T, db DB, dbType string) {
+	Convey("A "+dbType+" database keeps metadata for each revision", t, func() {
+		page, err := db.GetPage("MetaPage")
+		So(err, ShouldBeNil)
+		if page.Revisions() == 0 {
+			So(page.AddRevisionWithMeta([]byte("= Heading ="), RevisionMeta{Format: "moin"}), ShouldBeNil)
+			So(page.AddRevision([]byte("# Heading")), ShouldBeNil)
+		}
+
+		meta, err := page.GetMeta(0)
+		So(err, ShouldBeNil)
+		So(meta.Format, ShouldEqual, "moin")
+		So(time.Since(meta.Time), ShouldBeBetween, -time.Minute, time.Minute)
+		meta, err = page.GetMeta(CURRENT_REVISION)
+		So(err, ShouldBeNil)
+		So(meta.Format, ShouldEqual, "")
+		So(meta.Time.IsZero(), ShouldBeFalse)
+		_, err = page.GetMeta(5)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestMemDBLatestRevision(t *testing.T) {
+	db, _ := newMemDB()
+	doTestLatestRevision(t, db, "memory")
+}
+
+func TestFileDBLatestRevision(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "dbTest")
+	if err != nil {
+		t.Fatal("Unable to generate tempPath")
+	}
+	defer os.RemoveAll(tempPath)
+	db, err := newFileDB(tempPath)
+	if err != nil {
+		t.Fatal("Unable to create file database")
+	}
+	doTestLatestRevision(t, db, "file")
+}
+
+func doTestLatestRevision(t *testing.T, db DB, dbType string) {
+	Convey("A "+dbType+" database only adds a revision to the latest one when asked", t, func() {
+		page, _ := db.GetPage("Latest")
+		So(page.AddRevisionIfLatest(0, []byte("no page yet"), RevisionMeta{}), ShouldEqual, staleRevisionErr)
+		So(page.AddRevision([]byte("one")), ShouldBeNil)
+		So(page.AddRevisionIfLatest(0, []byte("two"), RevisionMeta{Format: "moin"}), ShouldBeNil)
+		So(page.AddRevisionIfLatest(0, []byte("stale"), RevisionMeta{}), ShouldEqual, staleRevisionErr)
+		So(page.Revisions(), ShouldEqual, 2)
+		meta, _ := page.GetMeta(CURRENT_REVISION)
+		So(meta.Format, ShouldEqual, "moin")
+
+		Convey("even when other revisions are being added at the same time", func() {
+			var wg sync.WaitGroup
+			added := make(chan bool, 10)
+			for i := 0; i < 10; i++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					added <- page.AddRevisionIfLatest(1, []byte("three"), RevisionMeta{}) == nil
+				}()
+				go func() {
+					defer wg.Done()
+					page.AddRevision([]byte("edit"))
+				}()
+			}
+			wg.Wait()
+			close(added)
+			count := 0
+			for ok := range added {
+				if ok {
+					count++
+				}
+			}
+			So(page.Revisions(), ShouldEqual, 12+count)
+			So(count, ShouldBeLessThanOrEqualTo, 1)
+		})
+	})
+}
+
+func TestMemDBProperties(t *testing.T) {
+	db, _ := newMemDB()
+	doTestProperties(t, db, "memory")
+}
+
+func TestFileDBProperties(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "dbTest")
+	if err != nil {
+		t.Fatal("Unable to generate tempPath")
+	}
+	defer os.RemoveAll(tempPath)
+	db, err := newFileDB(tempPath)
+	if err != nil {
+		t.Fatal("Unable to create file database")
+	}
+	doTestProperties(t, db, "file")
+}
+
+func doTestProperties(t *testing.T, db DB, dbType string) {
+	Convey("A "+dbType+" database keeps the front matter properties of each revision", t, func() {
+		page, _ := db.GetPage("Design")
+		other, _ := db.GetPage("Project/Plan")
+		plain, _ := db.GetPage("Plain")
+		if page.Revisions() == 0 {
+			So(page.AddRevision([]byte("---\nstatus: open\nowner: UserOne\n---\n# Design")), ShouldBeNil)
+			So(page.AddRevision([]byte("---\nstatus: closed\n---\n# Design")), ShouldBeNil)
+			So(other.AddRevisionWithMeta([]byte("+++\nstatus = \"open\"\n+++\n= Plan ="), RevisionMeta{Format: "moin"}), ShouldBeNil)
+			So(plain.AddRevision([]byte("no properties")), ShouldBeNil)
+		}
+
+		meta, err := page.GetMeta(0)
+		So(err, ShouldBeNil)
+		So(meta.Properties, ShouldResemble, Properties{"status": {Type: PropertyText, Value: "open"}, "owner": {Type: PropertyText, Value: "UserOne"}})
+		meta, _ = other.GetMeta(CURRENT_REVISION)
+		So(meta.Format, ShouldEqual, "moin")
+		meta, _ = plain.GetMeta(CURRENT_REVISION)
+		So(meta.Properties, ShouldBeNil)
+
+		Convey("and pages are found by the properties of their current revision", func() {
+			status, err := db.PagesWithProperty("status")
+			So(err, ShouldBeNil)
+			So(status, ShouldResemble, map[string]Property{"Design": {Type: PropertyText, Value: "closed"}, "Project/Plan": {Type: PropertyText, Value: "open"}})
+			owner, err := db.PagesWithProperty("owner")
+			So(err, ShouldBeNil)
+			So(owner, ShouldBeEmpty)
+		})
+	})
+}
+
+func doTestFreeFormNames(t *testing.T, db DB, dbType string) {
+	names := []string{"WikiWord", "Release notes 2026", "API", "lower case", "Ünïcödé 名前", "What? 100% (sure)"}
+
+	Convey("A "+dbType+" database accepts free form page names", t, func() {
+		for _, name := range names {
+			page, err := db.GetPage(name)
+			So(err, ShouldBeNil)
+			So(page.Name(), ShouldEqual, name)
+			So(page.AddRevision([]byte(name)), ShouldBeNil)
+		}
+		Convey("The pages can be found again", func() {
+			lst, err := db.ListPages()
+			So(err, ShouldBeNil)
+			So(len(lst), ShouldEqual, len(names))
+			for _, name := range names {
+				So(lst, ShouldContain, name)
+
+				exists, err := db.PageExists(name)
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeTrue)
+
+				page, err := db.GetPage(name)
+				So(err, ShouldBeNil)
+				data, err := page.GetData(CURRENT_REVISION)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, name)
+			}
+		})
+	})
+}
+
 func doTestAttachments(t *testing.T, db DB, dbType string) {
 	attachment1 := "This is a text attachment"
 	attachment2 := "This is also a text attachment"
@@ -187,6 +478,13 @@ func doTestDB(t *testing.T, db DB, dbType string) {
 			So(err, ShouldBeNil)
 			So(bytes.Compare(ONE_TEXTA, data), ShouldEqual, 0)
 
+			meta, err := page.GetMeta(CURRENT_REVISION)
+			So(err, ShouldBeNil)
+			So(meta.Format, ShouldEqual, "")
+			So(meta.Properties, ShouldBeNil)
+			_, err = page.GetMeta(2)
+			So(err, ShouldNotBeNil)
+
 			Convey("Adding a second entry should increase the count to 2", func() {
 				page, err = db.GetPage("PageTwo")
 				So(err, ShouldBeNil)
@@ -229,13 +527,15 @@ func doTestDB(t *testing.T, db DB, dbType string) {
 								So(err, ShouldBeNil)
 								So(dat, ShouldBeFalse)
 
-								Convey("Page names that are not WikiWords should fail", func() {
-									_, err = db.PageExists("pageOne")
+								Convey("Page names that are not valid should fail", func() {
+									_, err = db.PageExists(".pageOne")
 									So(err, ShouldNotBeNil)
-									_, err = db.GetPage("pageOne")
+									_, err = db.GetPage(".pageOne")
 									So(err, ShouldNotBeNil)
 
-									_, err = db.GetPage("pageOne")
+									_, err = db.GetPage(" Page  One ")
+									So(err, ShouldNotBeNil)
+									_, err = db.GetPage("")
 									So(err, ShouldNotBeNil)
 								})
 							})
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Front matter is an optional block of properties at the very top of a page
+// source, written in YAML between --- lines or in TOML between +++ lines:
+//
+//	---
+//	tags: [design, backend]
+//	owner: UserOne
+//	status: open
+//	review-by: 2024-06-01
+//	---
+//
+// Only simple values are understood, text, numbers, true/false, dates
+// written YYYY-MM-DD and lists of text.  The block is not rendered, the
+// properties are kept with the revision and shown beside the page.
+
+type PropertyType string
+
+const (
+	PropertyText   PropertyType = "text"
+	PropertyNumber PropertyType = "number"
+	PropertyBool   PropertyType = "bool"
+	PropertyDate   PropertyType = "date"
+	PropertyList   PropertyType = "list"
+)
+
+const propertyDateFormat = "2006-01-02"
+
+// The value of a page property.  Everything but lists is kept as text in a
+// standard form, ie numbers as 2.5 and dates as 2006-01-02.
+type Property struct {
+	Type  PropertyType `json:"type"`
+	Value string       `json:"value,omitempty"`
+	List  []string     `json:"list,omitempty"`
+}
+
+// The properties of a page revision by name, names are lower case
+type Properties map[string]Property
+
+var propertyNameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+func (p Property) Number() (float64, bool) {
+	if p.Type != PropertyNumber {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(p.Value, 64)
+	return value, err == nil
+}
+
+func (p Property) Date() (time.Time, bool) {
+	if p.Type != PropertyDate {
+		return time.Time{}, false
+	}
+	date, err := time.Parse(propertyDateFormat, p.Value)
+	return date, err == nil
+}
+
+func (p Property) Bool() bool {
+	return p.Type == PropertyBool && p.Value == "true"
+}
+
+func (p Property) String() string {
+	if p.Type == PropertyList {
+		return strings.Join(p.List, ", ")
+	}
+	return p.Value
+}
+
+// The property names in order
+func (props Properties) Names() []string {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The front matter at the start of src, without its fences, and the number
+// of lines it takes up including them.  ok is false if there is none.
+func frontMatter(src []byte) (block []byte, toml bool, lines int, ok bool) {
+	all := bytes.SplitAfter(src, []byte("\n"))
+	if len(all) < 2 {
+		return nil, false, 0, false
+	}
+	fence := string(bytes.TrimRight(all[0], " \t\r\n"))
+	if fence != "---" && fence != "+++" {
+		return nil, false, 0, false
+	}
+	for i := 1; i < len(all); i++ {
+		line := string(bytes.TrimRight(all[i], " \t\r\n"))
+		if line == fence || (fence == "---" && line == "...") {
+			if !isFrontMatter(all[1:i], fence == "+++") {
+				break
+			}
+			return bytes.Join(all[1:i], nil), fence == "+++", i + 1, true
+		}
+	}
+	return nil, false, 0, false
+}
+
+// A markdown page can start with a --- rule and have another further down,
+// the text between them is only front matter if it starts straight away and
+// every line is a comment, a name: value line or a YAML list item
+func isFrontMatter(lines [][]byte, toml bool) bool {
+	if len(lines) == 0 || len(bytes.TrimSpace(lines[0])) == 0 {
+		return false
+	}
+	separator := ":"
+	if toml {
+		separator = "="
+	}
+	named := false
+	for _, line := range lines {
+		text := strings.TrimSpace(string(line))
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+		case !toml && (text == "-" || strings.HasPrefix(text, "- ")):
+		default:
+			sep := strings.Index(text, separator)
+			if sep <= 0 || strings.ContainsAny(strings.TrimSpace(text[:sep]), " \t") {
+				return false
+			}
+			named = true
+		}
+	}
+	return named
+}
+
+// The number of lines the front matter of src takes up, 0 if it has none
+func frontMatterLines(src []byte) int {
+	_, _, lines, _ := frontMatter(src)
+	return lines
+}
+
+// The page source without its front matter
+func stripFrontMatter(src []byte) []byte {
+	lines := frontMatterLines(src)
+	if lines == 0 {
+		return src
+	}
+	return bytes.Join(bytes.SplitAfter(src, []byte("\n"))[lines:], nil)
+}
+
+// The properties set in the front matter of src, nil if it has none.
+// Lines that cannot be understood are skipped.
+func pageProperties(src []byte) Properties {
+	props, _ := parseFrontMatter(src)
+	return props
+}
+
+// Read the front matter of src, the problems found are returned with the
+// line of the page source they are on
+func parseFrontMatter(src []byte) (Properties, []LexWarning) {
+	block, toml, _, ok := frontMatter(src)
+	if !ok {
+		return nil, nil
+	}
+	props := make(Properties)
+	warnings := make([]LexWarning, 0)
+	warn := func(line int, format string, args ...interface{}) {
+		warnings = append(warnings, LexWarning{Line: line + 2, Column: 1, Message: fmt.Sprintf(format, args...)})
+	}
+	separator := ":"
+	if toml {
+		separator = "="
+	}
+	lines := strings.Split(strings.Replace(string(block), "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.Index(line, separator)
+		if sep < 0 {
+			warn(i, "expected name%s value", separator)
+			continue
+		}
+		name, value := strings.TrimSpace(line[:sep]), strings.TrimSpace(line[sep+1:])
+		if !toml {
+			name = unquoteProperty(name)
+		}
+		if !propertyNameRe.MatchString(name) {
+			warn(i, "%s is not a property name", name)
+			continue
+		}
+		name = strings.ToLower(name)
+		if _, seen := props[name]; seen {
+			warn(i, "%s is set more than once", name)
+			continue
+		}
+		start := i
+		if value == "" && !toml {
+			// a YAML list written one item to a line
+			items := make([]string, 0)
+			for i+1 < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i+1]), "-") {
+				i++
+				items = append(items, unquoteProperty(strings.TrimSpace(strings.TrimSpace(lines[i])[1:])))
+			}
+			props[name] = Property{Type: PropertyList, List: items}
+			continue
+		}
+		if strings.HasPrefix(value, "[") {
+			if !strings.HasSuffix(value, "]") {
+				warn(start, "the list %s is not closed with ]", name)
+				continue
+			}
+			items := make([]string, 0)
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, unquoteProperty(item))
+				}
+			}
+			props[name] = Property{Type: PropertyList, List: items}
+			continue
+		}
+		props[name] = scalarProperty(value, toml)
+	}
+	return props, warnings
+}
+
+// The typed value of a property written as value, quoted values are text
+func scalarProperty(value string, toml bool) Property {
+	if !toml {
+		if i := strings.Index(value, " #"); i >= 0 && !strings.HasPrefix(value, `"`) && !strings.HasPrefix(value, "'") {
+			value = strings.TrimSpace(value[:i])
+		}
+	}
+	if unquoted := unquoteProperty(value); unquoted != value {
+		return Property{Type: PropertyText, Value: unquoted}
+	}
+	switch strings.ToLower(value) {
+	case "true", "false":
+		return Property{Type: PropertyBool, Value: strings.ToLower(value)}
+	}
+	if date, err := time.Parse(propertyDateFormat, value); err == nil {
+		return Property{Type: PropertyDate, Value: date.Format(propertyDateFormat)}
+	}
+	if number, ok := tableNumber(value); ok {
+		return Property{Type: PropertyNumber, Value: strconv.FormatFloat(number, 'f', -1, 64)}
+	}
+	return Property{Type: PropertyText, Value: value}
+}
+
+// Remove the quotes around a value, if it has any
+func unquoteProperty(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		if value[0] == '"' {
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				return unquoted
+			}
+		}
+		return value[1 : len(value)-1]
+	}
+	return value
+}
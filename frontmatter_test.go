@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testFrontMatterPage = `---
+tags: [design, "back end"]
+owner: UserOne   # the person to ask
+status: open
+review-by: 2024-06-01
+estimate: 2.50
+public: true
+reviewers:
+  - UserTwo
+  - 'UserThree'
+---
+# Design
+
+- [ ] write it
+`
+
+func TestFrontMatter(t *testing.T) {
+	Convey("YAML front matter is read into typed properties", t, func() {
+		props, warnings := parseFrontMatter([]byte(testFrontMatterPage))
+		So(warnings, ShouldBeEmpty)
+		So(props, ShouldResemble, Properties{
+			"tags":      {Type: PropertyList, List: []string{"design", "back end"}},
+			"owner":     {Type: PropertyText, Value: "UserOne"},
+			"status":    {Type: PropertyText, Value: "open"},
+			"review-by": {Type: PropertyDate, Value: "2024-06-01"},
+			"estimate":  {Type: PropertyNumber, Value: "2.5"},
+			"public":    {Type: PropertyBool, Value: "true"},
+			"reviewers": {Type: PropertyList, List: []string{"UserTwo", "UserThree"}},
+		})
+		So(props.Names(), ShouldResemble, []string{"estimate", "owner", "public", "review-by", "reviewers", "status", "tags"})
+		date, ok := props["review-by"].Date()
+		So(ok, ShouldBeTrue)
+		So(date.Day(), ShouldEqual, 1)
+		number, ok := props["estimate"].Number()
+		So(ok, ShouldBeTrue)
+		So(number, ShouldEqual, 2.5)
+		So(props["public"].Bool(), ShouldBeTrue)
+		So(props["tags"].String(), ShouldEqual, "design, back end")
+		_, ok = props["owner"].Number()
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("TOML front matter is read too", t, func() {
+		props, warnings := parseFrontMatter([]byte("+++\r\nStatus = \"2024-06-01\"\r\ntags = [\"a\", \"b\"]\r\ncount = 3\r\n+++\r\ntext"))
+		So(warnings, ShouldBeEmpty)
+		So(props, ShouldResemble, Properties{
+			"status": {Type: PropertyText, Value: "2024-06-01"},
+			"tags":   {Type: PropertyList, List: []string{"a", "b"}},
+			"count":  {Type: PropertyNumber, Value: "3"},
+		})
+	})
+
+	Convey("Pages without front matter have no properties", t, func() {
+		So(pageProperties([]byte("# Heading\n---\nstatus: open\n---")), ShouldBeNil)
+		So(pageProperties([]byte("---\nstatus: open\nno end")), ShouldBeNil)
+		So(frontMatterLines([]byte("---")), ShouldEqual, 0)
+	})
+
+	Convey("Text between markdown rules is not front matter", t, func() {
+		for _, src := range []string{"---\n\nsome text\n\n---\n\nmore", "---\nSome text: with a colon\n---\nmore", "---\n# Heading\n---\nmore", "---\n---\nmore"} {
+			props, warnings := parseFrontMatter([]byte(src))
+			So(props, ShouldBeNil)
+			So(warnings, ShouldBeEmpty)
+			So(frontMatterLines([]byte(src)), ShouldEqual, 0)
+		}
+		out := string(RenderPage("markdown", []byte("---\n\nsome text\n\n---\n\nmore"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldEqual, "<hr />\n\n<p>some text</p>\n\n<hr />\n\n<p>more</p>\n")
+	})
+
+	Convey("Problems in the front matter are found", t, func() {
+		props, warnings := parseFrontMatter([]byte("---\nstatus: open\n- stray\n1st: x\nstatus: closed\ntags: [a, b\n---\n"))
+		So(props, ShouldResemble, Properties{"status": {Type: PropertyText, Value: "open"}})
+		So(len(warnings), ShouldEqual, 4)
+		So(warnings[0].String(), ShouldEqual, "line 3, column 1: expected name: value")
+		So(warnings[1].String(), ShouldEqual, "line 4, column 1: 1st is not a property name")
+		So(warnings[2].String(), ShouldEqual, "line 5, column 1: status is set more than once")
+		So(warnings[3].String(), ShouldEqual, "line 6, column 1: the list tags is not closed with ]")
+	})
+}
+
+func TestFrontMatterRendering(t *testing.T) {
+	Convey("The front matter is not rendered", t, func() {
+		out := string(RenderPage("markdown", []byte(testFrontMatterPage), &RenderContext{PageName: "PageOne", Tasks: true}))
+		So(out, ShouldStartWith, `<h1 id="design">Design</h1>`)
+		So(out, ShouldNotContainSubstring, "UserOne")
+
+		Convey("and task lines still count it", func() {
+			So(taskLines([]byte(testFrontMatterPage), "markdown"), ShouldResemble, map[int]bool{13: true})
+			So(out, ShouldContainSubstring, `name="task" value="13"`)
+			out = string(RenderPage("moin", []byte("---\nstatus: open\n---\n * [ ] one"), &RenderContext{PageName: "PageOne"}))
+			So(out, ShouldContainSubstring, `name="task" value="3"`)
+			toggled, ok := toggleTask([]byte("---\nlist:\n - [ ] a\n---\n - [ ] b"), "moin", 4)
+			So(ok, ShouldBeTrue)
+			So(string(toggled), ShouldEqual, "---\nlist:\n - [ ] a\n---\n - [x] b")
+		})
+	})
+
+	Convey("The properties are shown beside the page", t, func() {
+		wiki, _ := newMemDB()
+		page, _ := wiki.GetPage("PageOne")
+		page.AddRevision([]byte(testFrontMatterPage))
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/PageOne/", nil)
+		context.Set(req, keyPage, page)
+		PageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki}, record, req)
+		context.Clear(req)
+		So(record.Body.String(), ShouldContainSubstring, `<div id="properties">`)
+		So(record.Body.String(), ShouldContainSubstring, `<tr><th>review-by</th><td class="property-date">2024-06-01</td></tr>`)
+		So(record.Body.String(), ShouldContainSubstring, `<tr><th>tags</th><td class="property-list">design, back end</td></tr>`)
+
+		Convey("and their problems on the edit page", func() {
+			page.AddRevision([]byte("---\nstatus: open\n- stray\n---\ntext"))
+			record := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/edit/PageOne/", nil)
+			ShowEditPageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki}, record, req)
+			So(record.Body.String(), ShouldContainSubstring, "<li>line 3, column 1: expected name: value</li>")
+		})
+	})
+}
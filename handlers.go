@@ -1,29 +1,60 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	//"github.com/gorilla/context"
 	"github.com/gorilla/mux"
-	"github.com/russross/blackfriday"
 	"html/template"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 var templates map[string]*template.Template = make(map[string]*template.Template)
 
+var templateFuncs = template.FuncMap{
+	"pageURL": PageURL,
+	"editURL": EditURL,
+	"tagURL":  TagURL,
+}
+
 func init() {
-	file_list := []string{"list_pages", "about_page", "not_found", "edit_page", "wiki_page"}
+	file_list := []string{"list_pages", "about_page", "not_found", "edit_page", "wiki_page", "login", "audit_log", "settings", "interwiki", "tag_page"}
 	for _, page_name := range file_list {
-		templates[page_name] = template.Must(template.ParseFiles("./templates/" + page_name + ".tmpl"))
+		templates[page_name] = template.Must(template.New(page_name + ".tmpl").Funcs(templateFuncs).ParseFiles("./templates/" + page_name + ".tmpl"))
+	}
+}
+
+// A link to a page, Label is the text shown for it
+type pageLink struct {
+	Name  string
+	Label string
+}
+
+// Links to the parents of a sub page, outermost first
+func pageBreadcrumbs(name string) []pageLink {
+	results := make([]pageLink, 0)
+	for parent := ParentPageName(name); parent != ""; parent = ParentPageName(parent) {
+		results = append([]pageLink{{Name: parent, Label: BasePageName(parent)}}, results...)
+	}
+	return results
+}
+
+// Links to the sub pages of parent, labeled relative to it
+func subPageLinks(parent string, names []string) []pageLink {
+	results := make([]pageLink, 0, len(names))
+	for _, name := range names {
+		results = append(results, pageLink{Name: name, Label: name[len(parent)+1:]})
 	}
+	return results
 }
 
 func adapt(wikiDb DB, f func(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request)) http.Handler {
 
 	var adapter http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
-		f(&RequestInfo{Params: mux.Vars(r), User: &UserInfo{}, DB: wikiDb}, w, r)
+		user := CurUser(r)
+		f(&RequestInfo{Params: mux.Vars(r), Query: r.URL.Query(), User: user, DB: newAuditDB(wikiDb, audit, user, remoteHost(r)), Policy: editPolicy, Audit: audit, CSRFToken: CurCSRFToken(r)}, w, r)
 	}
 
 	return adapter
@@ -32,10 +63,21 @@ func adapt(wikiDb DB, f func(reqInfo *RequestInfo, w http.ResponseWriter, r *htt
 func ListPagesHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
 	var details struct {
 		Pages   []string
+		Tags    []tagCloudItem
+		Filter  []string // only the pages with all of these tags are listed
 		ReqInfo *RequestInfo
 	}
 	details.Pages, _ = reqInfo.DB.ListPages()
+	details.Tags, _ = tagCloud(reqInfo.DB)
 	details.ReqInfo = reqInfo
+	for _, name := range reqInfo.Query["tag"] {
+		if tag := normalizeTag(name); tag != "" {
+			details.Filter = append(details.Filter, tag)
+		}
+	}
+	if len(details.Filter) > 0 {
+		details.Pages, _ = filterTagged(reqInfo, details.Pages, details.Filter)
+	}
 	templates["list_pages"].Execute(w, &details)
 }
 
@@ -49,8 +91,9 @@ func AboutPageHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Reque
 
 func CreatePageHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
 	var details struct {
-		PageName string
-		ReqInfo  *RequestInfo
+		PageName  string
+		Templates []string // pages the new page can start from
+		ReqInfo   *RequestInfo
 	}
 
 	page := CurPage(r)
@@ -60,6 +103,9 @@ func CreatePageHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Requ
 	}
 	details.ReqInfo = reqInfo
 	details.PageName = page.Name()
+	if reqInfo.CanEdit() {
+		details.Templates, _ = listTemplates(reqInfo)
+	}
 	templates["not_found"].Execute(w, &details)
 }
 
@@ -71,8 +117,13 @@ func PageHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
 	var rawPage []byte
 	var details struct {
 		PageName        string
+		Title           string
+		Breadcrumbs     []pageLink
+		SubPages        []pageLink
 		Content         template.HTML
 		CurrentRevision int
+		ToggleTasks     bool       // the content is in a form that ticks its task list items
+		Properties      Properties // set in the front matter of the revision
 		AttachmentList  []string
 		RevisionList    <-chan int
 		ReqInfo         *RequestInfo
@@ -85,10 +136,19 @@ func PageHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
 	revision := CurRev(r)
 
 	details.PageName = PageName
+	details.Title = BasePageName(PageName)
+	details.Breadcrumbs = pageBreadcrumbs(PageName)
 
 	page := CurPage(r)
 	revisionCount := page.Revisions()
 
+	subPages, err := reqInfo.DB.ListSubPages(PageName)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	details.SubPages = subPageLinks(PageName, subPages)
+
 	details.AttachmentList, err = page.ListAttachments()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -102,17 +162,16 @@ func PageHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rawPage = ExpandWikiWords(rawPage)
-
-	// inject attachment information here
-	buf := &bytes.Buffer{}
-
-	for _, attachment := range details.AttachmentList {
-		buf.WriteString("[" + attachment + "]: " + r.URL.String() + attachment + "\n")
+	meta, err := page.GetMeta(revision)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
-	buf.Write(rawPage)
-
-	details.Content = template.HTML(string(blackfriday.MarkdownCommon(buf.Bytes())))
+	details.Properties = meta.Properties
+	// tasks are ticked by logged in users, on the latest revision only
+	details.ToggleTasks = !reqInfo.User.IsAnonymous() && reqInfo.CanEdit() && details.CurrentRevision == revisionCount-1 && len(taskLines(rawPage, meta.Format)) > 0
+	rendered := RenderPage(meta.Format, rawPage, &RenderContext{PageName: PageName, Page: page, ReqInfo: reqInfo, Tasks: details.ToggleTasks})
+	details.Content = template.HTML(string(SanitizeHTML(rendered)))
 	templates["wiki_page"].Execute(w, &details)
 }
 
@@ -162,7 +221,7 @@ func AddAttachmentHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.R
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, "/edit/"+PageName+"/", http.StatusFound)
+	http.Redirect(w, r, EditURL(PageName), http.StatusFound)
 }
 
 func ShowEditPageHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
@@ -173,10 +232,18 @@ func ShowEditPageHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Re
 	var details struct {
 		PageName       string
 		PageSrc        string
+		Format         string
+		Formats        []Renderer
+		Warnings       []LexWarning
 		AttachmentList []string
+		NewAttachment  string // the name of a missing attachment a link was followed from
+		Template       string // the template a new page starts from
 		ReqInfo        *RequestInfo
 	}
 	details.PageName = PageName
+	details.NewAttachment = r.FormValue("attachment")
+	details.Format = DefaultFormat
+	details.Formats = Renderers()
 	details.ReqInfo = reqInfo
 
 	page, err := reqInfo.DB.GetPage(PageName)
@@ -191,12 +258,49 @@ func ShowEditPageHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Re
 				return
 			} else {
 				details.PageSrc = string(rawPage)
+				if meta, err := page.GetMeta(CURRENT_REVISION); err == nil && meta.Format != "" {
+					details.Format = meta.Format
+				}
+				_, details.Warnings = parseFrontMatter(rawPage)
+				if renderer, err := GetRenderer(details.Format); err == nil {
+					if checker, ok := renderer.(SourceChecker); ok {
+						details.Warnings = append(details.Warnings, checker.Check(rawPage)...)
+					}
+				}
 			}
 			details.AttachmentList, err = page.ListAttachments()
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+		} else if templateName := r.FormValue("template"); templateName != "" {
+			if !isTemplatePage(templateName) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !reqInfo.CanRead() {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if exists, _ := reqInfo.DB.PageExists(templateName); !exists {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			templatePage, err := reqInfo.DB.GetPage(templateName)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			rawPage, err := templatePage.GetData(CURRENT_REVISION)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			details.Template = templateName
+			details.PageSrc = string(expandTemplate(rawPage, PageName, reqInfo.User, time.Now()))
+			if meta, err := templatePage.GetMeta(CURRENT_REVISION); err == nil && meta.Format != "" {
+				details.Format = meta.Format
+			}
 		}
 	}
 	templates["edit_page"].Execute(w, &details)
@@ -210,12 +314,73 @@ func EditPageHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Reques
 		return
 	}
 	src := r.FormValue("entry")
+	format := r.FormValue("format")
+	if _, err := GetRenderer(format); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
 	page, err := reqInfo.DB.GetPage(PageName)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	page.AddRevision([]byte(src))
-	http.Redirect(w, r, "/"+PageName+"/", 302)
+	page.AddRevisionWithMeta([]byte(src), RevisionMeta{Format: format})
+	http.Redirect(w, r, PageURL(PageName), 302)
+}
+
+// Tick or untick a task list item from the page view.  The task field is
+// the line of the page source the item is on and rev the revision the page
+// was shown at, the toggle is refused if the page has changed since.
+func ToggleTaskHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
+	PageName := reqInfo.Params["name"]
+
+	if reqInfo.User.IsAnonymous() {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	line, err := strconv.Atoi(r.FormValue("task"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rev, err := strconv.Atoi(r.FormValue("rev"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	page, err := reqInfo.DB.GetPage(PageName)
+	if err != nil || page.Revisions() == NO_REVISIONS {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if rev != page.Revisions()-1 {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	src, err := page.GetData(rev)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	meta, err := page.GetMeta(rev)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	toggled, ok := toggleTask(src, meta.Format, line)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// the page may have been saved since it was read
+	if err := page.AddRevisionIfLatest(rev, toggled, meta); err == staleRevisionErr {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, PageURL(PageName), http.StatusFound)
 }
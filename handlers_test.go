@@ -150,6 +150,42 @@ func TestPageHandler(t *testing.T) {
 				}
 			})
 
+			Convey("Raw HTML in a page is cleaned before it is served", func() {
+				evil, _ := wiki.GetPage("EvilPage")
+				evil.AddRevision([]byte("Hello <script>alert(1)</script><img src=x onerror=alert(1)>"))
+				record := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/EvilPage/", nil)
+				context.Set(req, keyPage, evil)
+				PageHandler(&RequestInfo{Params: map[string]string{"name": "EvilPage"}, DB: wiki}, record, req)
+				context.Clear(req)
+				So(record.Code, ShouldEqual, http.StatusOK)
+				So(record.Body.String(), ShouldNotContainSubstring, "<script>alert")
+				So(record.Body.String(), ShouldNotContainSubstring, "onerror")
+			})
+
+			Convey("Sub pages are listed on their parent and link back to it", func() {
+				child, _ := wiki.GetPage("PageOne/Child Page")
+				child.AddRevision([]byte("See [[../Sibling]] and [[/Grand]]"))
+
+				record := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/PageOne/", nil)
+				context.Set(req, keyPage, page)
+				PageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki}, record, req)
+				context.Clear(req)
+				So(record.Code, ShouldEqual, http.StatusOK)
+				So(record.Body.String(), ShouldContainSubstring, `<a href="/PageOne/Child%20Page/">Child Page</a>`)
+
+				record = httptest.NewRecorder()
+				req, _ = http.NewRequest("GET", "/PageOne/Child%20Page/", nil)
+				context.Set(req, keyPage, child)
+				PageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne/Child Page"}, DB: wiki}, record, req)
+				context.Clear(req)
+				So(record.Code, ShouldEqual, http.StatusOK)
+				So(record.Body.String(), ShouldContainSubstring, `<a href="/PageOne/">PageOne</a> / Child Page`)
+				So(record.Body.String(), ShouldContainSubstring, `href="/PageOne/Sibling/"`)
+				So(record.Body.String(), ShouldContainSubstring, `href="/PageOne/Child%20Page/Grand/"`)
+			})
+
 			// should never happen
 			// Convey("Testing for a page with an invalid page name should give an error", func() {
 			// 	record := httptest.NewRecorder()
@@ -236,13 +272,30 @@ func TestShowEditPageHandler(t *testing.T) {
 			ShowEditPageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki}, record, req)
 			So(record.Code, ShouldEqual, http.StatusOK)
 
+			Convey("Problems in the page source are shown", func() {
+				broken, _ := wiki.GetPage("BrokenPage")
+				broken.AddRevision([]byte("text\n[a](unclosed"))
+				record := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/edit/BrokenPage/", nil)
+				ShowEditPageHandler(&RequestInfo{Params: map[string]string{"name": "BrokenPage"}, DB: wiki}, record, req)
+				So(record.Code, ShouldEqual, http.StatusOK)
+				So(record.Body.String(), ShouldContainSubstring, "line 2, column 4: &#39;(&#39; is never closed with &#39;)&#39;")
+			})
+
+			Convey("Links to missing attachments fill in the attachment name", func() {
+				record := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/edit/PageOne/?attachment=notes.txt", nil)
+				ShowEditPageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki}, record, req)
+				So(record.Body.String(), ShouldContainSubstring, `<input type="text" name="name" value="notes.txt"/>`)
+			})
+
 			Convey("Testing for a page with an invalid page name should give an error", func() {
 				record := httptest.NewRecorder()
-				req, err := http.NewRequest("GET", "/edit/Invalid/", nil)
+				req, err := http.NewRequest("GET", "/edit/.Invalid/", nil)
 				if err != nil {
 					t.Fatalf("Unable to create test request")
 				}
-				ShowEditPageHandler(&RequestInfo{Params: map[string]string{"name": "Invalid"}, DB: wiki}, record, req)
+				ShowEditPageHandler(&RequestInfo{Params: map[string]string{"name": ".Invalid"}, DB: wiki}, record, req)
 				So(record.Code, ShouldEqual, http.StatusNotFound)
 
 				Convey("Editing a non-existant page (with a valid name) should work fine", func() {
@@ -281,5 +334,44 @@ func TestEditPageHandler(t *testing.T) {
 			So(err, ShouldBeNil)
 			So(count, ShouldEqual, 1)
 		})
+
+		Convey("The format of the page is stored with the revision", func() {
+			form := url.Values{}
+			form.Add("entry", "= Moin heading =")
+			form.Add("format", "moin")
+			record := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/edit/PageOne/", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			EditPageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki}, record, req)
+			So(record.Code, ShouldEqual, http.StatusFound)
+
+			page, _ := wiki.GetPage("PageOne")
+			meta, err := page.GetMeta(CURRENT_REVISION)
+			So(err, ShouldBeNil)
+			So(meta.Format, ShouldEqual, "moin")
+
+			record = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/PageOne/", nil)
+			context.Set(req, keyPage, page)
+			PageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki}, record, req)
+			context.Clear(req)
+			So(record.Body.String(), ShouldContainSubstring, "<h1 id=\"moin-heading\">Moin heading</h1>")
+
+			record = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/edit/PageOne/", nil)
+			ShowEditPageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki}, record, req)
+			So(record.Body.String(), ShouldContainSubstring, `<option value="moin" selected>`)
+		})
+
+		Convey("Unknown formats are refused", func() {
+			form := url.Values{}
+			form.Add("entry", "text")
+			form.Add("format", "nosuchformat")
+			record := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/edit/PageOne/", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			EditPageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki}, record, req)
+			So(record.Code, ShouldEqual, http.StatusBadRequest)
+		})
 	})
 }
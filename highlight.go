@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/russross/blackfriday"
+	"html"
+	"strings"
+)
+
+// The flags and extensions of blackfriday.MarkdownCommon
+const (
+	markdownHTMLFlags = blackfriday.HTML_USE_XHTML |
+		blackfriday.HTML_USE_SMARTYPANTS |
+		blackfriday.HTML_SMARTYPANTS_FRACTIONS |
+		blackfriday.HTML_SMARTYPANTS_DASHES |
+		blackfriday.HTML_SMARTYPANTS_LATEX_DASHES
+
+	markdownExtensions = blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+		blackfriday.EXTENSION_TABLES |
+		blackfriday.EXTENSION_FENCED_CODE |
+		blackfriday.EXTENSION_AUTOLINK |
+		blackfriday.EXTENSION_STRIKETHROUGH |
+		blackfriday.EXTENSION_SPACE_HEADERS |
+		blackfriday.EXTENSION_HEADER_IDS |
+		blackfriday.EXTENSION_BACKSLASH_LINE_BREAK |
+		blackfriday.EXTENSION_DEFINITION_LISTS
+)
+
+// Code is highlighted with CSS classes, the colours are in main.css
+var codeFormatter = chromahtml.New(chromahtml.WithClasses(true), chromahtml.PreventSurroundingPre(true))
+
+// Render markdown as blackfriday.MarkdownCommon does, with fenced code
+// blocks highlighted
+func renderMarkdown(input []byte) []byte {
+	renderer := highlightRenderer{blackfriday.HtmlRenderer(markdownHTMLFlags, "", "")}
+	return blackfriday.MarkdownOptions(input, renderer, blackfriday.Options{Extensions: markdownExtensions})
+}
+
+// A blackfriday renderer that highlights code blocks in the language they
+// are tagged with
+type highlightRenderer struct {
+	blackfriday.Renderer
+}
+
+func (hr highlightRenderer) BlockCode(out *bytes.Buffer, text []byte, info string) {
+	lang := ""
+	if fields := strings.Fields(info); len(fields) > 0 {
+		lang = fields[0]
+	}
+	highlighted, ok := highlightCode(text, lang)
+	if !ok {
+		// languages the highlighter does not know are shown as they are
+		hr.Renderer.BlockCode(out, text, info)
+		return
+	}
+	if out.Len() > 0 {
+		out.WriteByte('\n')
+	}
+	out.Write(highlighted)
+}
+
+// Highlight code written in lang as a <pre> block, false is returned if the
+// language is not known
+func highlightCode(code []byte, lang string) ([]byte, bool) {
+	if lang == "" {
+		return nil, false
+	}
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		return nil, false
+	}
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, string(code))
+	if err != nil {
+		return nil, false
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(`<pre class="chroma"><code class="language-` + html.EscapeString(lang) + `">`)
+	if err := codeFormatter.Format(buf, styles.Fallback, iterator); err != nil {
+		return nil, false
+	}
+	buf.WriteString("</code></pre>\n")
+	return buf.Bytes(), true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestHighlighting(t *testing.T) {
+	Convey("Fenced code blocks are highlighted", t, func() {
+		out := string(RenderPage("markdown", []byte("Intro\n\n```go\nfunc main() {}\n```\n"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldStartWith, "<p>Intro</p>\n\n"+`<pre class="chroma"><code class="language-go">`)
+		So(out, ShouldContainSubstring, `<span class="kd">func</span>`)
+		So(out, ShouldContainSubstring, `<span class="nf">main</span>`)
+		So(out, ShouldEndWith, "</code></pre>\n")
+
+		Convey("and keep their classes when sanitized", func() {
+			clean := string(SanitizeHTML([]byte(out)))
+			So(clean, ShouldContainSubstring, `<pre class="chroma"><code class="language-go">`)
+			So(clean, ShouldContainSubstring, `<span class="kd">func</span>`)
+		})
+	})
+
+	Convey("Unknown languages and untagged blocks are shown as they are", t, func() {
+		out := string(RenderPage("markdown", []byte("```nosuchlanguage\na < b\n```\n"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldEqual, `<pre><code class="language-nosuchlanguage">a &lt; b`+"\n</code></pre>\n")
+		out = string(RenderPage("markdown", []byte("```\nplain\n```\n"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldEqual, "<pre><code>plain\n</code></pre>\n")
+	})
+
+	Convey("WikiWords in highlighted code are not linked", t, func() {
+		out := string(RenderPage("markdown", []byte("```python\nWikiWord = [[Free Link]]\n```\nSee WikiWord\n"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldContainSubstring, `<span class="n">WikiWord</span>`)
+		So(out, ShouldNotContainSubstring, `href="/WikiWord/">WikiWord</a></span>`)
+		So(out, ShouldContainSubstring, `See <a href="/WikiWord/">WikiWord</a>`)
+		So(out, ShouldNotContainSubstring, `/Free Link/`)
+	})
+
+	Convey("Moin #!highlight blocks are highlighted", t, func() {
+		out := string(RenderPage("moin", []byte("{{{#!highlight go\nvar x = 1\n}}}"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldStartWith, `<pre class="chroma"><code class="language-go">`)
+		So(out, ShouldContainSubstring, `<span class="kd">var</span>`)
+		out = string(RenderPage("moin", []byte("{{{#!python\nx = 1\n}}}"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldEqual, "<pre>x = 1</pre>\n")
+	})
+}
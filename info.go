@@ -1,21 +1,48 @@
 package main
 
+import (
+	"net/url"
+)
+
 const (
 	AnonymousUser = "Anonymous"
+
+	ScopeRead   = "read"   // view pages and attachments
+	ScopeWrite  = "write"  // add page revisions
+	ScopeAttach = "attach" // upload attachments
 )
 
 // Hold basic user information
 type UserInfo struct {
 	username string   // The username
 	roles    []string // Basic roles/groups that user has
+	scopes   []string // Set for users authenticated by an API token, limits what they may do
 }
 
 // This is a request context of sorts, bring it all to one place so that
 // it bacn be accessed in each handler
 type RequestInfo struct {
-	Params map[string]string
-	User   *UserInfo
-	DB     DB
+	Params    map[string]string
+	Query     url.Values // the query string of the request, ie how tables are sorted
+	User      *UserInfo
+	DB        DB
+	Policy    *EditPolicy
+	Audit     *auditLog // nil when no audit log is kept
+	CSRFToken string    // must be included in any form that POSTs back to the wiki
+}
+
+// Can the user making the request modify the wiki
+func (ri *RequestInfo) CanEdit() bool {
+	return ri.Policy.CanEdit(ri.User)
+}
+
+// Can the user making the request see pages, API tokens need the read
+// scope.  Only the scope is checked, the wiki has no per page read
+// permissions so a reader who may read one page may read them all.
+// Routes that are not read routes, ie the edit page, and pages shown
+// inside other pages check this.
+func (ri *RequestInfo) CanRead() bool {
+	return ri.User.HasScope(ScopeRead)
 }
 
 func (u *UserInfo) Username() string {
@@ -55,3 +82,22 @@ func (u *UserInfo) AddRole(role string) {
 	}
 	u.roles = append(u.roles, role)
 }
+
+// Is this user authenticated by an API token instead of a login session
+func (u *UserInfo) IsToken() bool {
+	return u != nil && u.scopes != nil
+}
+
+// Is the user allowed to do the actions covered by scope.  Users with a
+// login session may do everything, API token users only what the token allows.
+func (u *UserInfo) HasScope(scope string) bool {
+	if !u.IsToken() {
+		return true
+	}
+	for _, s := range u.scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
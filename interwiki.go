@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// An interwiki site, links such as Jira:PROJ-123 go to the URL made from
+// its Template.  $PAGE in the template is replaced by the part after the
+// ':', templates without it have it added to the end.
+type InterWikiSite struct {
+	Name     string
+	Template string
+}
+
+// The interwiki sites pages may link to, by name
+type interWikiMap struct {
+	sites map[string]string
+}
+
+// The sites links are resolved against, there are none unless configured
+var interWiki = &interWikiMap{sites: make(map[string]string)}
+
+func newFileInterWikiMap(fname string) (*interWikiMap, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return newInterWikiMap(f)
+}
+
+// Read an interwiki map, each line is a name followed by its URL template,
+// ie "Jira https://jira.example.com/browse/$PAGE".  Blank lines and lines
+// starting with # are ignored.
+func newInterWikiMap(input io.Reader) (*interWikiMap, error) {
+	iw := &interWikiMap{sites: make(map[string]string)}
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("Interwiki lines are a name and a URL: " + line)
+		}
+		name, template := fields[0], fields[1]
+		if interWikiNameLength([]byte(name)) != len(name) {
+			return nil, errors.New("Invalid interwiki name " + name)
+		}
+		if urlLength([]byte(template)) == 0 {
+			return nil, errors.New("Invalid interwiki URL " + template)
+		}
+		iw.sites[name] = template
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return iw, nil
+}
+
+// Is name a configured site
+func (iw *interWikiMap) Has(name string) bool {
+	_, ok := iw.sites[name]
+	return ok
+}
+
+// All of the sites sorted by name
+func (iw *interWikiMap) Sites() []InterWikiSite {
+	results := make([]InterWikiSite, 0, len(iw.sites))
+	for name, template := range iw.sites {
+		results = append(results, InterWikiSite{Name: name, Template: template})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
+}
+
+// Resolve a Name:target link, false is returned if Name is not a site
+func (iw *interWikiMap) URL(link string) (string, bool) {
+	i := strings.IndexByte(link, ':')
+	if i < 0 || !iw.Has(link[:i]) || link[i+1:] == "" {
+		return "", false
+	}
+	template := iw.sites[link[:i]]
+	// '/' is kept so GoDoc:net/http works
+	parts := strings.Split(link[i+1:], "/")
+	for j, part := range parts {
+		parts[j] = url.PathEscape(part)
+	}
+	target := strings.Join(parts, "/")
+	if strings.Contains(template, "$PAGE") {
+		return strings.Replace(template, "$PAGE", target, -1), true
+	}
+	return template + target, true
+}
+
+// A Name:target link as HTML, the class names the site so each can be styled
+func (iw *interWikiMap) LinkHTML(link, label string) (string, bool) {
+	href, ok := iw.URL(link)
+	if !ok {
+		return "", false
+	}
+	class := "interwiki interwiki-" + strings.ToLower(link[:strings.IndexByte(link, ':')])
+	return `<a class="` + class + `" href="` + html.EscapeString(href) + `">` + html.EscapeString(label) + "</a>", true
+}
+
+// The length of the site name at the start of input, letters and digits
+// starting with a letter
+func interWikiNameLength(input []byte) int {
+	n := 0
+	for n < len(input) && (isASCIILetter(input[n]) || (n > 0 && input[n] >= '0' && input[n] <= '9')) {
+		n++
+	}
+	return n
+}
+
+func newInterWikiHandler(iw *interWikiMap) func(*RequestInfo, http.ResponseWriter, *http.Request) {
+	return func(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
+		var details struct {
+			Sites   []InterWikiSite
+			ReqInfo *RequestInfo
+		}
+		details.ReqInfo = reqInfo
+		details.Sites = iw.Sites()
+		templates["interwiki"].Execute(w, &details)
+	}
+}
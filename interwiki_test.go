@@ -0,0 +1,86 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testInterWikiMap = `# sites pages may link to
+Jira https://jira.example.com/browse/$PAGE
+GoDoc https://pkg.go.dev/
+`
+
+func TestInterWikiMap(t *testing.T) {
+	Convey("An interwiki map is read from a file of names and URLs", t, func() {
+		iw, err := newInterWikiMap(strings.NewReader(testInterWikiMap))
+		So(err, ShouldBeNil)
+		So(iw.Sites(), ShouldResemble, []InterWikiSite{{"GoDoc", "https://pkg.go.dev/"}, {"Jira", "https://jira.example.com/browse/$PAGE"}})
+		So(iw.Has("Jira"), ShouldBeTrue)
+		So(iw.Has("jira"), ShouldBeFalse)
+
+		Convey("Links fill in the URL template", func() {
+			href, ok := iw.URL("Jira:PROJ-123")
+			So(ok, ShouldBeTrue)
+			So(href, ShouldEqual, "https://jira.example.com/browse/PROJ-123")
+			href, _ = iw.URL("GoDoc:net/http#Handler")
+			So(href, ShouldEqual, "https://pkg.go.dev/net/http%23Handler")
+			href, _ = iw.URL("GoDoc:a b")
+			So(href, ShouldEqual, "https://pkg.go.dev/a%20b")
+			_, ok = iw.URL("Other:x")
+			So(ok, ShouldBeFalse)
+			_, ok = iw.URL("Jira:")
+			So(ok, ShouldBeFalse)
+
+			link, _ := iw.LinkHTML("Jira:PROJ-1", "the <bug>")
+			So(link, ShouldEqual, `<a class="interwiki interwiki-jira" href="https://jira.example.com/browse/PROJ-1">the &lt;bug&gt;</a>`)
+		})
+
+		Convey("Bad lines are refused", func() {
+			_, err = newInterWikiMap(strings.NewReader("Jira\n"))
+			So(err, ShouldNotBeNil)
+			_, err = newInterWikiMap(strings.NewReader("Ji-ra https://example.com/\n"))
+			So(err, ShouldNotBeNil)
+			_, err = newInterWikiMap(strings.NewReader("Jira javascript:alert(1)\n"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestInterWikiLinks(t *testing.T) {
+	iw, err := newInterWikiMap(strings.NewReader(testInterWikiMap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := interWiki
+	interWiki = iw
+	defer func() { interWiki = saved }()
+
+	Convey("Interwiki links are found by the lexer", t, func() {
+		So(lexSummary("See GoDoc:net/http, and Jira:PROJ-12."), ShouldResemble, []string{"Lexed text: See ", "Lexed interwiki link: GoDoc:net/http", "Lexed text: , and ", "Lexed interwiki link: Jira:PROJ-12", "Lexed text: ."})
+		So(lexSummary("Unknown:thing and Jira: alone"), ShouldResemble, []string{"Lexed text: Unknown:thing and Jira: alone"})
+		So(lexSummary("xJira:proj-1"), ShouldResemble, []string{"Lexed text: xJira:proj-1"})
+	})
+
+	Convey("Interwiki links are rendered with a class for their site", t, func() {
+		out := string(RenderPage("markdown", []byte("Fixed in Jira:PROJ-123 see [[GoDoc:net/http|the docs]]"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldEqual, `<p>Fixed in <a class="interwiki interwiki-jira" href="https://jira.example.com/browse/PROJ-123">Jira:PROJ-123</a> see <a class="interwiki interwiki-godoc" href="https://pkg.go.dev/net/http">the docs</a></p>`+"\n")
+		So(string(SanitizeHTML([]byte(out))), ShouldContainSubstring, `<a class="interwiki interwiki-jira" href="https://jira.example.com/browse/PROJ-123"`)
+
+		out = string(RenderPage("moin", []byte("Jira:PROJ-1 [[GoDoc:fmt]]"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldEqual, `<p><a class="interwiki interwiki-jira" href="https://jira.example.com/browse/PROJ-1">Jira:PROJ-1</a> <a class="interwiki interwiki-godoc" href="https://pkg.go.dev/fmt">GoDoc:fmt</a></p>`+"\n")
+	})
+
+	Convey("The configured sites are listed", t, func() {
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/Special/InterWiki/", nil)
+		newInterWikiHandler(iw)(&RequestInfo{}, record, req)
+		So(record.Body.String(), ShouldContainSubstring, "<tr><td>Jira</td><td>https://jira.example.com/browse/$PAGE</td></tr>")
+
+		record = httptest.NewRecorder()
+		newInterWikiHandler(&interWikiMap{sites: map[string]string{}})(&RequestInfo{}, record, req)
+		So(record.Body.String(), ShouldContainSubstring, "No interwiki sites are configured")
+	})
+}
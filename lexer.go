@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"unicode"
 	"unicode/utf8"
@@ -16,17 +18,36 @@ Though it must be admited that the Go team's version had better names and
 makes a little more sense.
 */
 type Lexer struct {
-	input []byte
-	start int
-	cur   int
-	ch    chan LexedItem
+	input    []byte
+	start    int
+	cur      int
+	ch       chan LexedItem
+	warnings []LexWarning
+
+	state stageFunc   // the next state to run, nil once the input is done
+	items []LexedItem // tokens emitted by the last state but not yet returned
+	head  int         // the next token in items to return
+	last  LexedItem   // the EOF (or error) token that ended the input
 }
 
+// A token, Value shares its memory with the input to the lexer
 type LexedItem struct {
 	Type  LexToken
 	Value []byte
 }
 
+// A problem found in the input, such as a link that is never closed.  The
+// lexer passes the text through as it is and carries on.
+type LexWarning struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (lw LexWarning) String() string {
+	return fmt.Sprintf("line %d, column %d: %s", lw.Line, lw.Column, lw.Message)
+}
+
 type stageFunc func(*Lexer) stageFunc
 
 const (
@@ -35,9 +56,20 @@ const (
 	TokenLink
 	TokenImage
 	TokenWikiWord
+	TokenFreeLink
+	TokenCode       // a code span or block, WikiWords are not linked in it
+	TokenURL        // a bare URL
+	TokenEscape     // a WikiWord escaped with a leading !, ie !WikiWord
+	TokenMacro      // a macro such as {{Include(OtherPage)}} or <<PageCount>>
+	TokenInterWiki  // a link to another site, ie Jira:PROJ-123
+	TokenAttachment // a link to an attachment, ie attachment:report.pdf
+	TokenMath       // a formula, ie $x^2$ or $$\sum_i x_i$$
+	TokenTag        // a tag, ie #design
 	TokenEOF
 )
 
+var urlSchemes = [][]byte{[]byte("http://"), []byte("https://"), []byte("ftp://"), []byte("mailto:")}
+
 func (lt LexToken) String() string {
 	switch lt {
 	case TokenErr:
@@ -50,27 +82,79 @@ func (lt LexToken) String() string {
 		return "Lexed image"
 	case TokenWikiWord:
 		return "Lexed WikiWord"
+	case TokenFreeLink:
+		return "Lexed free link"
+	case TokenCode:
+		return "Lexed code"
+	case TokenURL:
+		return "Lexed URL"
+	case TokenEscape:
+		return "Lexed escaped WikiWord"
+	case TokenMacro:
+		return "Lexed macro"
+	case TokenInterWiki:
+		return "Lexed interwiki link"
+	case TokenAttachment:
+		return "Lexed attachment link"
+	case TokenMath:
+		return "Lexed math"
+	case TokenTag:
+		return "Lexed tag"
 	case TokenEOF:
 		return "Lexed EOF"
 	}
 	return "lexed token"
 }
 
+// NewPullLexer creates a lexer whose tokens are read with NextToken
+func NewPullLexer(input []byte) *Lexer {
+	return &Lexer{input: input, state: textLexer, items: make([]LexedItem, 0, 4), last: LexedItem{Type: TokenEOF}}
+}
+
+// NewLexer creates a lexer and the channel that Run sends its tokens to
 func NewLexer(input []byte) (*Lexer, chan LexedItem) {
-	// we buffer 3 deep to allow tests to run
-	l := &Lexer{input: input, ch: make(chan LexedItem, 4)}
+	l := NewPullLexer(input)
+	l.ch = make(chan LexedItem, 4)
 	return l, l.ch
 }
 
-func (l *Lexer) Next() (rune, error) {
-	if l.cur < len(l.input) {
-		if result, len := utf8.DecodeRune(l.input[l.cur:]); result != utf8.RuneError {
-			l.cur += len
-			return result, nil
+// NextToken returns the next token in the input.  Once the input is done it
+// returns the token that ended it, TokenEOF or TokenErr, on every call.
+func (l *Lexer) NextToken() LexedItem {
+	for l.head == len(l.items) {
+		if l.state == nil {
+			return l.last
 		}
+		l.items, l.head = l.items[:0], 0
+		l.state = l.state(l)
+	}
+	item := l.shift()
+	if item.Type == TokenEOF || item.Type == TokenErr {
+		l.last = item
+		l.state = nil
+	}
+	return item
+}
+
+// take the next emitted token off the queue
+func (l *Lexer) shift() LexedItem {
+	item := l.items[l.head]
+	l.head++
+	return item
+}
+
+// Read the next rune.  A byte that is not valid UTF-8 is read as
+// utf8.RuneError on its own, it is passed through as text with a warning.
+func (l *Lexer) Next() (rune, error) {
+	if l.cur >= len(l.input) {
+		return ' ', io.EOF
 	}
-	//fmt.Println("Returning io.EOF!!!!!!!!!!")
-	return ' ', io.EOF
+	result, size := utf8.DecodeRune(l.input[l.cur:])
+	if result == utf8.RuneError && size == 1 {
+		l.warn(l.cur, fmt.Sprintf("the byte 0x%02x is not valid UTF-8", l.input[l.cur]))
+	}
+	l.cur += size
+	return result, nil
 }
 
 func (l *Lexer) IsEOF(err error) bool {
@@ -80,9 +164,11 @@ func (l *Lexer) IsEOF(err error) bool {
 	return false
 }
 
+// Step back over r, the last rune read by Next.  The width read is used
+// as an invalid byte is one byte long but read as utf8.RuneError.
 func (l *Lexer) Reverse(r rune) error {
-	rLen := utf8.RuneLen(r)
-	if l.cur >= rLen {
+	_, rLen := utf8.DecodeLastRune(l.input[:l.cur])
+	if l.cur >= rLen && rLen > 0 {
 		l.cur -= rLen
 		return nil
 	}
@@ -97,12 +183,12 @@ func (l *Lexer) emit(Type LexToken) {
 	//fmt.Println(Type)
 	//fmt.Printf("segLen %d = %d - %d\n", segLen, l.cur, l.start)
 	////fmt.Printf("'%s'\n", string(l.input))
-	item := LexedItem{Type: Type, Value: make([]byte, segLen)}
-	copy(item.Value, l.input[l.start:l.cur])
+	// the capacity is clipped so appending to a value cannot overwrite the input
+	item := LexedItem{Type: Type, Value: l.input[l.start : l.start+segLen : l.start+segLen]}
 	//fmt.Printf("Index values %d %d\nEmitting (%s) '%s'\n", l.start, l.cur, Type, string(item.Value))
 	l.start = l.cur
 	//fmt.Println("Start advanced to", l.start)
-	l.ch <- item
+	l.items = append(l.items, item)
 }
 
 func (l *Lexer) saveLocation() int {
@@ -117,10 +203,43 @@ func (l *Lexer) jumpToLocation(pos int) error {
 	return nil
 }
 
+// Record a warning for the given position in the input
+func (l *Lexer) warn(pos int, msg string) {
+	line := bytes.Count(l.input[:pos], []byte("\n")) + 1
+	lineStart := bytes.LastIndexByte(l.input[:pos], '\n') + 1
+	column := utf8.RuneCount(l.input[lineStart:pos]) + 1
+	warning := LexWarning{Line: line, Column: column, Message: msg}
+	// the same span can be retried after giving up on an enclosing one
+	for _, existing := range l.warnings {
+		if existing == warning {
+			return
+		}
+	}
+	l.warnings = append(l.warnings, warning)
+}
+
+// The warnings found in the input, only complete once the lexer is done
+func (l *Lexer) Warnings() []LexWarning {
+	return l.warnings
+}
+
+// Give up on a malformed span, the rune that started it is passed through
+// as text and lexing carries on after it
+func (l *Lexer) giveUp() stageFunc {
+	_, size := utf8.DecodeRune(l.input[l.start:])
+	l.cur = l.start + size
+	l.emit(TokenText)
+	return textLexer
+}
+
+// Run sends every token to the channel from NewLexer and then closes it
 func (l *Lexer) Run() {
-	for state := textLexer; state != nil; {
-		state = state(l)
-		//fmt.Println("Next lexer state is", state)
+	for {
+		item := l.NextToken()
+		l.ch <- item
+		if item.Type == TokenEOF || item.Type == TokenErr {
+			break
+		}
 	}
 	close(l.ch)
 }
@@ -171,10 +290,26 @@ func textLexer(l *Lexer) stageFunc {
 	var err error
 
 	for {
+		if !InWikiWord {
+			if Type, end := l.matchOpaque(CanStartWikiWord); end > l.cur {
+				if l.cur > l.start {
+					l.emit(TokenText)
+				}
+				l.cur = end
+				l.emit(Type)
+				BeforeWikiWordStart = l.saveLocation()
+				resetWikiWord()
+				continue
+			}
+		}
 		r, err = l.Next()
 		if err != nil {
 			if l.IsEOF(err) {
 				//fmt.Println("EOF")
+				if UpperCount < 2 {
+					// a single capital is not a WikiWord
+					InWikiWord = false
+				}
 				emitCurrent()
 				l.emit(TokenEOF)
 				return nil
@@ -193,18 +328,25 @@ func textLexer(l *Lexer) stageFunc {
 				//fmt.Printf("'%s' let:%v dig:%v\n", string(r), unicode.IsLetter(r), unicode.IsDigit(r))
 				// just left wiki word
 				if UpperCount >= 2 {
-					// This is a WikiWord
+					// This is a WikiWord, it may link to a heading, ie OtherPage#Heading
 					//if BeforeWikiWordStart >= 0 {
-					l.Reverse(r)
+					if n := anchorLength(l.input[l.cur:]); r == '#' && n > 0 {
+						l.cur += n
+					} else {
+						l.Reverse(r)
+					}
 					emitCurrent()
 					// do not advance, we need to re-evaluate the rune, outside of the context of a wiki word
 					//l.Next()
 					//}
 				} else {
 					//fmt.Println("Not a WikiWord")
+					l.Reverse(r)
 				}
-				// reset wiki word variables
+				// reset wiki word variables and look at r again, it may start a code span
 				resetWikiWord()
+				CanStartWikiWord = false
+				continue
 			}
 		} else {
 			// not in wiki word
@@ -222,6 +364,9 @@ func textLexer(l *Lexer) stageFunc {
 		if r == '[' {
 			l.Reverse(r)
 			l.emit(TokenText)
+			if bytes.HasPrefix(l.input[l.cur:], []byte("[[")) {
+				return freeLinkLexer
+			}
 			return linkLexer
 		} else if r == '!' {
 			// this is overly complex, fix it
@@ -239,7 +384,7 @@ func textLexer(l *Lexer) stageFunc {
 				return nil
 			}
 			// we always put this one back
-			l.Reverse('[')
+			l.Reverse(r)
 			if r == '[' {
 				l.Reverse('!')
 				l.emit(TokenText)
@@ -249,6 +394,257 @@ func textLexer(l *Lexer) stageFunc {
 	}
 }
 
+// Look for text at the current position that must be passed through
+// untouched, code spans and blocks so identifiers in code are not linked,
+// URLs, interwiki and attachment links so the words in them are not,
+// macros, math, #tags and !WikiWord escapes.  atBoundary is
+// set when the current position starts a word.  The end of the text is
+// returned, or the current position if there is nothing to pass through.
+func (l *Lexer) matchOpaque(atBoundary bool) (LexToken, int) {
+	rest := l.input[l.cur:]
+	if len(rest) == 0 {
+		return TokenText, l.cur
+	}
+	lineStart := l.cur == 0 || l.input[l.cur-1] == '\n'
+	switch {
+	case lineStart && (bytes.HasPrefix(rest, []byte("```")) || bytes.HasPrefix(rest, []byte("~~~"))):
+		return TokenCode, l.cur + fencedCodeLength(rest)
+	case lineStart && isIndentedCode(rest) && l.afterBlankOrCode():
+		return TokenCode, l.cur + lineLength(rest)
+	case rest[0] == '`':
+		// an unmatched run of backticks is plain text
+		run := runLength(rest, '`')
+		if end := closingRun(rest[run:], '`', run); end >= 0 {
+			return TokenCode, l.cur + run + end + run
+		}
+		return TokenText, l.cur + run
+	case rest[0] == '{' || rest[0] == '<':
+		if n := macroLength(rest); n > 0 {
+			return TokenMacro, l.cur + n
+		}
+	case rest[0] == '$' && (l.cur == 0 || l.input[l.cur-1] != '\\'):
+		// \$ does not start a formula
+		if n := mathLength(rest); n > 0 {
+			return TokenMath, l.cur + n
+		}
+	case rest[0] == '#':
+		if n := tagLength(rest); n > 0 && (l.cur == 0 || isTagBoundary(lastRune(l.input[:l.cur]))) {
+			return TokenTag, l.cur + n
+		}
+	case atBoundary && rest[0] == '!':
+		if n := wikiWordLength(rest[1:]); n > 0 {
+			return TokenEscape, l.cur + 1 + n
+		}
+	case atBoundary:
+		if n := urlLength(rest); n > 0 {
+			return TokenURL, l.cur + n
+		}
+		if n := attachmentLength(rest); n > 0 {
+			return TokenAttachment, l.cur + n
+		}
+		if n := interWikiLength(rest); n > 0 {
+			return TokenInterWiki, l.cur + n
+		}
+	}
+	return TokenText, l.cur
+}
+
+func lastRune(input []byte) rune {
+	r, _ := utf8.DecodeLastRune(input)
+	return r
+}
+
+// Markdown only treats indented lines as code after a blank line or more code
+func (l *Lexer) afterBlankOrCode() bool {
+	if l.cur == 0 {
+		return true
+	}
+	prevStart := bytes.LastIndexByte(l.input[:l.cur-1], '\n') + 1
+	prev := l.input[prevStart : l.cur-1]
+	return len(bytes.TrimSpace(prev)) == 0 || isIndentedCode(prev)
+}
+
+func isIndentedCode(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("    ")) || bytes.HasPrefix(line, []byte("\t"))
+}
+
+// the length of the line including its newline
+func lineLength(input []byte) int {
+	if i := bytes.IndexByte(input, '\n'); i >= 0 {
+		return i + 1
+	}
+	return len(input)
+}
+
+func runLength(input []byte, c byte) int {
+	n := 0
+	for n < len(input) && input[n] == c {
+		n++
+	}
+	return n
+}
+
+// Find a run of exactly count c's, returning its offset or -1
+func closingRun(input []byte, c byte, count int) int {
+	for i := 0; i < len(input); {
+		if input[i] != c {
+			i++
+			continue
+		}
+		n := runLength(input[i:], c)
+		if n == count {
+			return i
+		}
+		i += n
+	}
+	return -1
+}
+
+// A fenced code block runs to a closing fence at least as long as the
+// opening one, or to the end of the input if it is never closed
+func fencedCodeLength(input []byte) int {
+	fence := runLength(input, input[0])
+	pos := lineLength(input)
+	for pos < len(input) {
+		line := input[pos:]
+		n := lineLength(line)
+		if runLength(line, input[0]) >= fence && len(bytes.TrimSpace(line[:n])) == runLength(line, input[0]) {
+			return pos + n
+		}
+		pos += n
+	}
+	return len(input)
+}
+
+// The length of the WikiWord at the start of input, 0 if there is not one
+func wikiWordLength(input []byte) int {
+	upper, n := 0, 0
+	for n < len(input) {
+		r, size := utf8.DecodeRune(input[n:])
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			break
+		}
+		if n == 0 && !unicode.IsUpper(r) {
+			return 0
+		}
+		if unicode.IsUpper(r) {
+			upper++
+		}
+		n += size
+	}
+	if upper < 2 {
+		return 0
+	}
+	return n
+}
+
+// The length of the {{Name(args)}} or <<Name(args)>> macro at the start of
+// input, 0 if there is not one.  The arguments are optional and macros do
+// not span lines.
+func macroLength(input []byte) int {
+	var closing []byte
+	switch {
+	case bytes.HasPrefix(input, []byte("{{")):
+		closing = []byte("}}")
+	case bytes.HasPrefix(input, []byte("<<")):
+		closing = []byte(">>")
+	default:
+		return 0
+	}
+	n := 2
+	for n < len(input) && (isASCIILetter(input[n]) || (n > 2 && input[n] >= '0' && input[n] <= '9')) {
+		n++
+	}
+	if n == 2 {
+		return 0
+	}
+	if n < len(input) && input[n] == '(' {
+		end := bytes.Index(input[n:], append([]byte(")"), closing...))
+		if end < 0 || bytes.IndexByte(input[n:n+end], '\n') >= 0 {
+			return 0
+		}
+		return n + end + 3
+	}
+	if !bytes.HasPrefix(input[n:], closing) {
+		return 0
+	}
+	return n + 2
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// The length of the heading name at the start of input, the part after the
+// # in a link such as OtherPage#Heading
+func anchorLength(input []byte) int {
+	n := 0
+	for n < len(input) {
+		r, size := utf8.DecodeRune(input[n:])
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-') {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+// The length of the URL at the start of input, 0 if there is not one
+func urlLength(input []byte) int {
+	scheme := 0
+	for _, prefix := range urlSchemes {
+		if bytes.HasPrefix(input, prefix) {
+			scheme = len(prefix)
+			break
+		}
+	}
+	if scheme == 0 {
+		return 0
+	}
+	if n := linkTargetEnd(input, scheme); n > scheme {
+		return n
+	}
+	return 0
+}
+
+// The length of the Name:target interwiki link at the start of input, 0 if
+// there is not one.  Only the configured site names start links.
+func interWikiLength(input []byte) int {
+	n := interWikiNameLength(input)
+	if n == 0 || n >= len(input) || input[n] != ':' || !interWiki.Has(string(input[:n])) {
+		return 0
+	}
+	if end := linkTargetEnd(input, n+1); end > n+1 {
+		return end
+	}
+	return 0
+}
+
+// The length of the attachment:name link at the start of input, 0 if there
+// is not one
+func attachmentLength(input []byte) int {
+	if !bytes.HasPrefix(input, []byte(attachmentPrefix)) {
+		return 0
+	}
+	if end := linkTargetEnd(input, len(attachmentPrefix)); end > len(attachmentPrefix) {
+		return end
+	}
+	return 0
+}
+
+// The end of a link target that starts at start and runs to white space.
+// Trailing punctuation is taken to belong to the surrounding sentence.
+func linkTargetEnd(input []byte, start int) int {
+	n := start
+	for n < len(input) && !bytes.ContainsRune([]byte(" \t\r\n<>\"`"), rune(input[n])) {
+		n++
+	}
+	for n > start && bytes.IndexByte([]byte(".,;:!?)'*_"), input[n-1]) >= 0 {
+		n--
+	}
+	return n
+}
+
 // Match link type objects (images, links, and references)
 // []() or [][] or []:
 func linkMatcher(l *Lexer, Type LexToken) stageFunc {
@@ -256,17 +652,16 @@ func linkMatcher(l *Lexer, Type LexToken) stageFunc {
 	var err error
 
 	matcher := func(startRune, endRune rune) bool {
+		open := l.cur
 		if r, err = l.Next(); err != nil || r != startRune {
-			l.start = l.cur
 			//fmt.Printf("Did not find matching '%s' for link type got '%s'.\n", string(startRune), string(r))
-			l.emit(TokenErr)
 			return false
 		}
 		for {
 			r, err = l.Next()
-			if err != nil {
-				l.start = l.cur
-				l.emit(TokenErr)
+			// links may wrap lines but do not run past the end of a paragraph
+			if err != nil || (r == '\n' && bytes.HasPrefix(l.input[l.cur:], []byte("\n"))) {
+				l.warn(open, fmt.Sprintf("'%c' is never closed with '%c'", startRune, endRune))
 				return false
 			}
 			if r == endRune {
@@ -281,7 +676,7 @@ func linkMatcher(l *Lexer, Type LexToken) stageFunc {
 
 	//always look [] first
 	if !matcher(rune('['), rune(']')) {
-		return nil
+		return l.giveUp()
 	}
 	// peek to see if we have '[' or '('
 	r, err = l.Next()
@@ -306,28 +701,38 @@ func linkMatcher(l *Lexer, Type LexToken) stageFunc {
 		l.emit(TokenText)
 		return textLexer(l)
 	default:
-		//fmt.Println("Did not find link/image body")
-		l.emit(TokenErr)
-		return nil
+		// just some text in brackets
+		return l.giveUp()
 	}
 	l.Reverse(r)
 	if !matcher(start, end) {
-		return nil
+		return l.giveUp()
 	}
 	l.emit(Type)
 	return textLexer
 }
 
+// Match free links of the form [[Page Name]] or [[Page Name|label]], they
+// may not span lines.  Anything else is left for the regular link matching.
+func freeLinkLexer(l *Lexer) stageFunc {
+	rest := l.input[l.cur:]
+	end := bytes.Index(rest, []byte("]]"))
+	if end < 0 || bytes.IndexByte(rest[:end], '\n') >= 0 {
+		return linkLexer
+	}
+	l.cur += end + 2
+	l.emit(TokenFreeLink)
+	return textLexer
+}
+
 func linkLexer(l *Lexer) stageFunc {
 	return linkMatcher(l, TokenLink)
 }
 
 func imageLexer(l *Lexer) stageFunc {
 	if r, err := l.Next(); err != nil || r != '!' {
-		l.start = l.cur
 		//fmt.Println("No ! found for image")
-		l.emit(TokenErr)
-		return nil
+		return l.giveUp()
 	}
 	return linkMatcher(l, TokenImage)
 }
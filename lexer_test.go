@@ -3,6 +3,9 @@ package main
 import (
 	"bytes"
 	. "github.com/smartystreets/goconvey/convey"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -60,110 +63,110 @@ func TestLexerTextState(t *testing.T) {
 	input8 := []byte("abc WikiWord def")
 
 	Convey("Create a lexer to test the text state", t, func() {
-		l, ch := NewLexer(input1)
+		l := NewPullLexer(input1)
 		nextState := textLexer(l)
-		item := <-ch
+		item := l.shift()
 		So(nextState, ShouldEqual, nil)
 		So(item.Type, ShouldEqual, TokenText)
 		So(bytes.Compare(item.Value, input1), ShouldEqual, 0)
 
 		Convey("leading into a link", func() {
-			l, ch = NewLexer(input2)
+			l = NewPullLexer(input2)
 			nextState := textLexer(l)
-			item := <-ch
+			item := l.shift()
 			So(nextState, ShouldEqual, linkLexer)
 			So(item.Type, ShouldEqual, TokenText)
 			So(len(item.Value), ShouldEqual, 0)
 
 			nextState = nextState(l)
-			item = <-ch
+			item = l.shift()
 			So(item.Type, ShouldEqual, TokenLink)
 		})
 		Convey("Using a regular (non-wiki link) should work as well", func() {
-			l, ch = NewLexer(input2a)
+			l = NewPullLexer(input2a)
 			nextState := textLexer(l)
-			item := <-ch
+			item := l.shift()
 			So(nextState, ShouldEqual, linkLexer)
 			So(item.Type, ShouldEqual, TokenText)
 			So(len(item.Value), ShouldEqual, 0)
 
 			nextState = nextState(l)
-			item = <-ch
+			item = l.shift()
 			So(item.Type, ShouldEqual, TokenLink)
 		})
 		Convey("Manually registering a link/reference should work too (as text)", func() {
-			l, ch = NewLexer(input2b)
+			l = NewPullLexer(input2b)
 			nextState := textLexer(l)
-			item := <-ch
+			item := l.shift()
 			So(nextState, ShouldEqual, linkLexer)
 			So(item.Type, ShouldEqual, TokenText)
 			So(len(item.Value), ShouldEqual, 0)
 
 			nextState = nextState(l)
-			item = <-ch
+			item = l.shift()
 			So(item.Type, ShouldEqual, TokenText)
 		})
 		Convey("leading into a image", func() {
-			l, ch = NewLexer(input3)
+			l = NewPullLexer(input3)
 			nextState := textLexer(l)
-			item := <-ch
+			item := l.shift()
 			So(nextState, ShouldEqual, imageLexer)
 			So(item.Type, ShouldEqual, TokenText)
 			So(len(item.Value), ShouldEqual, 0)
 
 			nextState = nextState(l)
-			item = <-ch
+			item = l.shift()
 			So(item.Type, ShouldEqual, TokenImage)
 		})
 		Convey("leading into a image (referenced)", func() {
-			l, ch = NewLexer(input3a)
+			l = NewPullLexer(input3a)
 			nextState := textLexer(l)
-			item := <-ch
+			item := l.shift()
 			So(nextState, ShouldEqual, imageLexer)
 			So(item.Type, ShouldEqual, TokenText)
 			So(len(item.Value), ShouldEqual, 0)
 
 			nextState = nextState(l)
-			item = <-ch
+			item = l.shift()
 			So(item.Type, ShouldEqual, TokenImage)
 		})
 		Convey("testing text ending with an !", func() {
-			l, ch = NewLexer(input4)
+			l = NewPullLexer(input4)
 			nextState = textLexer(l)
-			item = <-ch
+			item = l.shift()
 			So(nextState, ShouldEqual, nil)
 			So(item.Type, ShouldEqual, TokenText)
 			So(bytes.Compare(item.Value, input4), ShouldEqual, 0)
 		})
 		Convey("testing text ending with an !", func() {
-			l, ch = NewLexer(input5)
+			l = NewPullLexer(input5)
 			nextState = textLexer(l)
-			item = <-ch
+			item = l.shift()
 			So(nextState, ShouldEqual, nil)
 			So(item.Type, ShouldEqual, TokenText)
 			So(bytes.Compare(item.Value, input5), ShouldEqual, 0)
 		})
 		Convey("testing text that is only a wiki word", func() {
 			//fmt.Println("666666666666666")
-			l, ch = NewLexer(input6)
+			l = NewPullLexer(input6)
 			nextState = textLexer(l)
-			item = <-ch
+			item = l.shift()
 			So(nextState, ShouldEqual, nil)
 			So(item.Type, ShouldEqual, TokenWikiWord)
 			So(bytes.Compare(item.Value, input6), ShouldEqual, 0)
 		})
 		Convey("testing text with a wiki word at the end", func() {
 			//fmt.Println("777777777777777")
-			l, ch = NewLexer(input7)
+			l = NewPullLexer(input7)
 			nextState = textLexer(l)
 			So(nextState, ShouldEqual, nil)
 
-			item = <-ch
+			item = l.shift()
 			So(item.Type, ShouldEqual, TokenText)
 			So(bytes.Compare(item.Value, []byte("abc ")), ShouldEqual, 0)
 			//fmt.Printf("Expecting 'abc' %s - %s\n", string(input7), string(item.Value))
 
-			item = <-ch
+			item = l.shift()
 			So(item.Type, ShouldEqual, TokenWikiWord)
 			So(bytes.Compare(item.Value, []byte("WikiWord")), ShouldEqual, 0)
 			//fmt.Printf("Expecting 'WikiWord' %s - %s\n", string(input7), string(item.Value))
@@ -171,17 +174,17 @@ func TestLexerTextState(t *testing.T) {
 		})
 		Convey("testing text with a wiki word in the middle", func() {
 			//fmt.Println("888888888888888")
-			l, ch = NewLexer(input8)
+			l = NewPullLexer(input8)
 			nextState = textLexer(l)
 			So(nextState, ShouldEqual, nil)
 
-			item = <-ch
+			item = l.shift()
 			So(item.Type, ShouldEqual, TokenText)
 			So(bytes.Compare(item.Value, []byte("abc ")), ShouldEqual, 0)
-			item = <-ch
+			item = l.shift()
 			So(item.Type, ShouldEqual, TokenWikiWord)
 			So(bytes.Compare(item.Value, []byte("WikiWord")), ShouldEqual, 0)
-			item = <-ch
+			item = l.shift()
 			So(item.Type, ShouldEqual, TokenText)
 			So(bytes.Compare(item.Value, []byte(" def")), ShouldEqual, 0)
 			//fmt.Println("----------------")
@@ -193,15 +196,152 @@ func TestLexerLinkState(t *testing.T) {
 	input1 := []byte("[][abcd]")
 
 	Convey("Create a lexer to test the text state", t, func() {
-		l, ch := NewLexer(input1)
+		l := NewPullLexer(input1)
 		nextState := linkLexer(l)
-		item := <-ch
+		item := l.shift()
 		So(nextState, ShouldEqual, textLexer)
 		So(item.Type, ShouldEqual, TokenLink)
 		So(bytes.Compare(item.Value, input1), ShouldEqual, 0)
 	})
 }
 
+func TestLexerFreeLinkState(t *testing.T) {
+	input1 := []byte("[[Release notes 2026]] after")
+	input2 := []byte("[[Not closed\n]]")
+
+	Convey("Create a lexer to test the free link state", t, func() {
+		l := NewPullLexer(input1)
+		nextState := textLexer(l)
+		item := l.shift()
+		So(sameState(nextState, freeLinkLexer), ShouldBeTrue)
+		So(item.Type, ShouldEqual, TokenText)
+		So(len(item.Value), ShouldEqual, 0)
+
+		nextState = nextState(l)
+		item = l.shift()
+		So(sameState(nextState, textLexer), ShouldBeTrue)
+		So(item.Type, ShouldEqual, TokenFreeLink)
+		So(string(item.Value), ShouldEqual, "[[Release notes 2026]]")
+		So(lexSummary(string(input1)), ShouldResemble, []string{"Lexed free link: [[Release notes 2026]]", "Lexed text:  after"})
+
+		Convey("Free links may not span lines", func() {
+			l = NewPullLexer(input2)
+			So(sameState(freeLinkLexer(l), linkLexer), ShouldBeTrue)
+			So(lexSummary(string(input2)), ShouldResemble, []string{"Lexed text: [", "Lexed text: [", "Lexed text: Not closed\n]]"})
+		})
+	})
+}
+
+// Are two lexer states the same function, func values cannot be compared
+func sameState(a, b stageFunc) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// run the lexer over input and collect every token but the EOF
+func lexAll(input string) []LexedItem {
+	l, ch := NewLexer([]byte(input))
+	go l.Run()
+	items := make([]LexedItem, 0)
+	for item := range ch {
+		if item.Type != TokenEOF {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// the types and values of the tokens, with the empty text tokens removed
+func lexSummary(input string) []string {
+	results := make([]string, 0)
+	for _, item := range lexAll(input) {
+		if item.Type == TokenText && len(item.Value) == 0 {
+			continue
+		}
+		results = append(results, item.Type.String()+": "+string(item.Value))
+	}
+	return results
+}
+
+func TestLexerCodeSpans(t *testing.T) {
+	Convey("WikiWords in backtick code spans are not linked", t, func() {
+		So(lexSummary("Use `HandlerFunc` here"), ShouldResemble, []string{"Lexed text: Use ", "Lexed code: `HandlerFunc`", "Lexed text:  here"})
+		So(lexSummary("``a `WikiWord` b``"), ShouldResemble, []string{"Lexed code: ``a `WikiWord` b``"})
+		So(lexSummary("WikiWord`x`"), ShouldResemble, []string{"Lexed WikiWord: WikiWord", "Lexed code: `x`"})
+
+		Convey("Unmatched backticks are plain text", func() {
+			So(lexSummary("a ` WikiWord"), ShouldResemble, []string{"Lexed text: a ", "Lexed text: `", "Lexed text:  ", "Lexed WikiWord: WikiWord"})
+		})
+	})
+}
+
+func TestLexerCodeBlocks(t *testing.T) {
+	Convey("Fenced code blocks are passed through whole", t, func() {
+		So(lexSummary("```go\nvar f HandlerFunc\n```\nAfter"), ShouldResemble, []string{"Lexed code: ```go\nvar f HandlerFunc\n```\n", "Lexed text: After"})
+		So(lexSummary("~~~~\nWikiWord\n~~~\nStillCode\n~~~~"), ShouldResemble, []string{"Lexed code: ~~~~\nWikiWord\n~~~\nStillCode\n~~~~"})
+
+		Convey("An unclosed fence runs to the end", func() {
+			So(lexSummary("```\nWikiWord"), ShouldResemble, []string{"Lexed code: ```\nWikiWord"})
+		})
+	})
+	Convey("Indented code blocks are passed through", t, func() {
+		So(lexSummary("Intro\n\n    WikiWord()\n\tOtherWord\n"), ShouldResemble, []string{"Lexed text: Intro\n\n", "Lexed code:     WikiWord()\n", "Lexed code: \tOtherWord\n"})
+
+		Convey("but not when they continue a paragraph", func() {
+			So(lexSummary("Intro\n    WikiWord"), ShouldResemble, []string{"Lexed text: Intro\n    ", "Lexed WikiWord: WikiWord"})
+		})
+	})
+}
+
+func TestLexerURLs(t *testing.T) {
+	Convey("URLs are passed through whole", t, func() {
+		So(lexSummary("See http://example.com/WikiWord/Page."), ShouldResemble, []string{"Lexed text: See ", "Lexed URL: http://example.com/WikiWord/Page", "Lexed text: ."})
+		So(lexSummary("(mailto:Some.Body@example.com)"), ShouldResemble, []string{"Lexed text: (", "Lexed URL: mailto:Some.Body@example.com", "Lexed text: )"})
+
+		Convey("A scheme alone is not a URL", func() {
+			So(lexSummary("http:// "), ShouldResemble, []string{"Lexed text: http:// "})
+		})
+	})
+}
+
+func TestLexerEscape(t *testing.T) {
+	Convey("A leading ! stops a WikiWord being linked", t, func() {
+		So(lexSummary("Not !WikiWord but WikiWord"), ShouldResemble, []string{"Lexed text: Not ", "Lexed escaped WikiWord: !WikiWord", "Lexed text:  but ", "Lexed WikiWord: WikiWord"})
+		So(string(ExpandWikiWords([]byte("!WikiWord"))), ShouldEqual, "WikiWord")
+
+		Convey("Other uses of ! are left alone", func() {
+			So(lexSummary("Hi!WikiWord"), ShouldNotContain, "Lexed escaped WikiWord: !WikiWord")
+			So(lexSummary("!notword"), ShouldResemble, []string{"Lexed text: !notword"})
+			So(lexAll("![alt](img.png)")[1].Type, ShouldEqual, TokenImage)
+		})
+	})
+}
+
+func TestLexerHeadingLinks(t *testing.T) {
+	Convey("A WikiWord can link to a heading on the page", t, func() {
+		So(lexSummary("See OtherPage#Usage_notes-2."), ShouldResemble, []string{"Lexed text: See ", "Lexed WikiWord: OtherPage#Usage_notes-2", "Lexed text: ."})
+		So(lexSummary("OtherPage# and OtherPage#"), ShouldResemble, []string{"Lexed WikiWord: OtherPage", "Lexed text: # and ", "Lexed WikiWord: OtherPage", "Lexed text: #"})
+	})
+}
+
+func TestLexerMacros(t *testing.T) {
+	Convey("Macros are lexed as a single token", t, func() {
+		So(lexSummary("See {{Include(OtherPage#Intro)}} here"), ShouldResemble, []string{"Lexed text: See ", "Lexed macro: {{Include(OtherPage#Intro)}}", "Lexed text:  here"})
+		So(lexSummary("{{PageCount}}"), ShouldResemble, []string{"Lexed macro: {{PageCount}}"})
+		So(lexSummary("There are <<PageCount>> pages"), ShouldResemble, []string{"Lexed text: There are ", "Lexed macro: <<PageCount>>", "Lexed text:  pages"})
+		So(lexSummary("<<PageList(Project/)>>"), ShouldResemble, []string{"Lexed macro: <<PageList(Project/)>>"})
+		So(lexSummary("WikiWord{{Include(x)}}"), ShouldResemble, []string{"Lexed WikiWord: WikiWord", "Lexed macro: {{Include(x)}}"})
+
+		Convey("Anything else in braces is text", func() {
+			So(lexSummary("{{ not a macro }}"), ShouldNotContain, "Lexed macro: {{ not a macro }}")
+			So(lexSummary("{{Include(x\n)}}"), ShouldResemble, []string{"Lexed text: {{Include(x\n)}}"})
+			So(lexSummary("{{Include(x)"), ShouldResemble, []string{"Lexed text: {{Include(x)"})
+			So(lexSummary("<<PageCount}}"), ShouldResemble, []string{"Lexed text: <<PageCount}}"})
+			So(lexSummary("a << b >> c"), ShouldResemble, []string{"Lexed text: a << b >> c"})
+			So(lexSummary("`{{Include(x)}}`"), ShouldResemble, []string{"Lexed code: `{{Include(x)}}`"})
+		})
+	})
+}
+
 func TestLexerImageState(t *testing.T) {
 	input1 := []byte("![](abcd)")
 	input2 := []byte("[](abcd)")
@@ -210,40 +350,46 @@ func TestLexerImageState(t *testing.T) {
 	input5 := []byte("![][abcd")
 
 	Convey("Create a lexer to test the image state", t, func() {
-		l, ch := NewLexer(input1)
+		l := NewPullLexer(input1)
 		nextState := imageLexer(l)
-		item := <-ch
+		item := l.shift()
 		So(nextState, ShouldEqual, textLexer)
 		So(item.Type, ShouldEqual, TokenImage)
 		So(bytes.Compare(item.Value, input1), ShouldEqual, 0)
 
-		Convey("Test without the leading !", func() {
-			l, ch = NewLexer(input2)
+		Convey("Test without the leading !, the text is passed through", func() {
+			l = NewPullLexer(input2)
 			nextState := imageLexer(l)
-			item := <-ch
-			So(nextState, ShouldEqual, nil)
-			So(item.Type, ShouldEqual, TokenErr)
+			item := l.shift()
+			So(nextState, ShouldEqual, textLexer)
+			So(item.Type, ShouldEqual, TokenText)
+			So(string(item.Value), ShouldEqual, "[")
 
 			Convey("Test with a regular link", func() {
-				l, ch = NewLexer(input3)
+				l = NewPullLexer(input3)
 				nextState := imageLexer(l)
-				item := <-ch
-				So(nextState, ShouldEqual, nil)
-				So(item.Type, ShouldEqual, TokenErr)
+				item := l.shift()
+				So(nextState, ShouldEqual, textLexer)
+				So(item.Type, ShouldEqual, TokenText)
+				So(len(l.Warnings()), ShouldEqual, 0)
 
 				Convey("Test with missing braces", func() {
-					l, ch = NewLexer(input4)
+					l = NewPullLexer(input4)
 					nextState := imageLexer(l)
-					item := <-ch
-					So(nextState, ShouldEqual, nil)
-					So(item.Type, ShouldEqual, TokenErr)
+					item := l.shift()
+					So(nextState, ShouldEqual, textLexer)
+					So(item.Type, ShouldEqual, TokenText)
+					So(string(item.Value), ShouldEqual, "!")
+					So(l.Warnings(), ShouldResemble, []LexWarning{{Line: 1, Column: 2, Message: "'[' is never closed with ']'"}})
 
 					Convey("Test with missing closing brace", func() {
-						l, ch = NewLexer(input5)
+						l = NewPullLexer(input5)
 						nextState := imageLexer(l)
-						item := <-ch
-						So(nextState, ShouldEqual, nil)
-						So(item.Type, ShouldEqual, TokenErr)
+						item := l.shift()
+						So(nextState, ShouldEqual, textLexer)
+						So(item.Type, ShouldEqual, TokenText)
+						So(string(item.Value), ShouldEqual, "!")
+						So(l.Warnings(), ShouldResemble, []LexWarning{{Line: 1, Column: 4, Message: "'[' is never closed with ']'"}})
 					})
 				})
 			})
@@ -252,6 +398,54 @@ func TestLexerImageState(t *testing.T) {
 	})
 }
 
+func TestLexerRecovery(t *testing.T) {
+	Convey("Malformed links are passed through as text", t, func() {
+		input := "Start [broken link\n\nWikiWord (x) and ![img](nope\nEnd [a](b"
+		l, ch := NewLexer([]byte(input))
+		go l.Run()
+		buf := &bytes.Buffer{}
+		words := 0
+		for item := range ch {
+			So(item.Type, ShouldNotEqual, TokenErr)
+			if item.Type == TokenWikiWord {
+				words++
+			}
+			buf.Write(item.Value)
+		}
+		So(buf.String(), ShouldEqual, input)
+		So(words, ShouldEqual, 1)
+		So(l.Warnings(), ShouldResemble, []LexWarning{
+			{Line: 1, Column: 7, Message: "'[' is never closed with ']'"},
+			{Line: 3, Column: 24, Message: "'(' is never closed with ')'"},
+			{Line: 4, Column: 8, Message: "'(' is never closed with ')'"},
+		})
+		So(l.Warnings()[0].String(), ShouldEqual, "line 1, column 7: '[' is never closed with ']'")
+
+		Convey("Text in brackets that is not a link is not a problem", func() {
+			So(string(ExpandWikiWords([]byte("[note] after"))), ShouldEqual, "[note] after")
+			So(CheckPageSource([]byte("[note] after")), ShouldBeEmpty)
+			So(CheckPageSource([]byte("a\nb [c")), ShouldResemble, []LexWarning{{Line: 2, Column: 3, Message: "'[' is never closed with ']'"}})
+		})
+
+		Convey("Text after a ! and a multibyte rune is kept", func() {
+			So(string(expandPageSource([]byte("Hi !é more text"), &RenderContext{}, nil)), ShouldEqual, "Hi !é more text")
+			So(string(ExpandWikiWords([]byte("¡Hola! ¿WikiWord?"))), ShouldEqual, "¡Hola! ¿[WikiWord](/WikiWord/)?")
+		})
+
+		Convey("Bytes that are not UTF-8 are passed through with a warning", func() {
+			input := "bad \xff byte then\n\xc3 more text"
+			So(string(expandPageSource([]byte(input), &RenderContext{}, nil)), ShouldEqual, input)
+			So(CheckPageSource([]byte(input)), ShouldResemble, []LexWarning{
+				{Line: 1, Column: 5, Message: "the byte 0xff is not valid UTF-8"},
+				{Line: 2, Column: 1, Message: "the byte 0xc3 is not valid UTF-8"},
+			})
+			out := string(RenderPage("markdown", []byte(input), &RenderContext{PageName: "PageOne"}))
+			So(out, ShouldContainSubstring, "byte then")
+			So(out, ShouldContainSubstring, "more text")
+		})
+	})
+}
+
 func TestLexerRunLoop(t *testing.T) {
 	Convey("Create a lexer to test the run loop", t, func() {
 		l, ch := NewLexer([]byte("This is text with a WikiWord in it."))
@@ -269,3 +463,79 @@ func TestLexerRunLoop(t *testing.T) {
 		})
 	})
 }
+
+func TestLexerNextToken(t *testing.T) {
+	input := []byte("Some WikiWord text with [a link](/x/), `CodeSpan` and [[Free Link]].\n")
+
+	Convey("The pull API returns the same tokens as the channel", t, func() {
+		l := NewPullLexer(input)
+		for _, expected := range lexAll(string(input)) {
+			item := l.NextToken()
+			So(item.Type, ShouldEqual, expected.Type)
+			So(string(item.Value), ShouldEqual, string(expected.Value))
+		}
+		Convey("and keeps returning EOF at the end", func() {
+			So(l.NextToken().Type, ShouldEqual, TokenEOF)
+			So(l.NextToken().Type, ShouldEqual, TokenEOF)
+		})
+		Convey("Token values share the input but cannot write past their end", func() {
+			l := NewPullLexer(input)
+			item := l.NextToken()
+			So(string(item.Value), ShouldEqual, "Some ")
+			_ = append(item.Value, 'X')
+			So(string(input), ShouldStartWith, "Some WikiWord")
+		})
+	})
+
+	Convey("Expanding a page does not leave goroutines behind", t, func() {
+		before := runtime.NumGoroutine()
+		for i := 0; i < 50; i++ {
+			ExpandWikiWords([]byte("WikiWord [unclosed ![x](y"))
+			CheckPageSource([]byte("WikiWord [unclosed"))
+		}
+		So(runtime.NumGoroutine(), ShouldBeLessThanOrEqualTo, before)
+	})
+}
+
+// a large page with a mix of everything the lexer knows about
+func benchmarkPage() []byte {
+	paragraph := "Some text about WikiWord and OtherPage, see [the docs](http://example.com/Docs) or [[Free Link|here]].\n" +
+		"Use `HandlerFunc` or !NotLinked, ![logo](/static/logo.png) and https://example.com/SomePath.\n\n" +
+		"```go\nvar f http.HandlerFunc\n```\n\n"
+	return []byte(strings.Repeat(paragraph, 1000))
+}
+
+func BenchmarkLexerNextToken(b *testing.B) {
+	input := benchmarkPage()
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l := NewPullLexer(input)
+		for item := l.NextToken(); item.Type != TokenEOF; item = l.NextToken() {
+		}
+	}
+}
+
+func BenchmarkLexerChannel(b *testing.B) {
+	input := benchmarkPage()
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l, ch := NewLexer(input)
+		go l.Run()
+		for _ = range ch {
+		}
+	}
+}
+
+func BenchmarkExpandWikiWords(b *testing.B) {
+	input := benchmarkPage()
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ExpandWikiWords(input)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How deeply pages may include pages that include other pages
+const maxIncludeDepth = 5
+
+// The name and arguments of a macro, {{Include(OtherPage, 3)}} is "Include"
+// with the arguments "OtherPage" and "3"
+func parseMacro(value []byte) (string, []string) {
+	inner := string(value[2 : len(value)-2])
+	i := strings.IndexByte(inner, '(')
+	if i < 0 {
+		return inner, []string{}
+	}
+	name, argList := inner[:i], strings.TrimSpace(inner[i+1:len(inner)-1])
+	args := make([]string, 0)
+	if argList == "" {
+		return name, args
+	}
+	for _, arg := range strings.Split(argList, ",") {
+		args = append(args, strings.TrimSpace(arg))
+	}
+	return name, args
+}
+
+// Split the arguments of a macro into positional ones and name=value
+// options.  An argument without a = after an option continues its value, so
+// columns=owner,due is the option columns with the value "owner,due".
+func macroOptions(args []string) ([]string, map[string]string) {
+	positional := make([]string, 0)
+	options := make(map[string]string)
+	last := ""
+	for _, arg := range args {
+		if i := strings.IndexByte(arg, '='); i > 0 {
+			last = strings.TrimSpace(arg[:i])
+			options[last] = strings.TrimSpace(arg[i+1:])
+		} else if last != "" {
+			options[last] += "," + arg
+		} else {
+			positional = append(positional, arg)
+		}
+	}
+	return positional, options
+}
+
+// A MacroFunc renders a <<Macro(args)>> on a page as HTML.  page is the
+// page being shown and may be nil, as may reqInfo outside of a request.
+type MacroFunc func(reqInfo *RequestInfo, page Page, args []string) ([]byte, error)
+
+var unknownMacroErr = errors.New("unknown macro")
+var noWikiErr = errors.New("the wiki cannot be used here")
+
+var macroFuncsLock sync.Mutex
+var macroFuncs = make(map[string]MacroFunc)
+
+func init() {
+	RegisterMacro("TableOfContents", tableOfContentsMacro)
+	RegisterMacro("PageList", pageListMacro)
+	RegisterMacro("RecentChanges", recentChangesMacro)
+	RegisterMacro("AttachmentList", attachmentListMacro)
+	RegisterMacro("PageCount", pageCountMacro)
+	RegisterMacro("Date", dateMacro)
+	RegisterMacro("Table", tableMacro)
+	RegisterMacro("Query", queryMacro)
+}
+
+// Make a macro available to pages, it replaces any macro of the same name
+func RegisterMacro(name string, f MacroFunc) {
+	macroFuncsLock.Lock()
+	defer macroFuncsLock.Unlock()
+
+	macroFuncs[name] = f
+}
+
+func GetMacro(name string) (MacroFunc, bool) {
+	macroFuncsLock.Lock()
+	defer macroFuncsLock.Unlock()
+
+	f, ok := macroFuncs[name]
+	return f, ok
+}
+
+// Render the macro in value as HTML.  A {{Name}} the wiki does not know is
+// not taken to be a macro, false is returned and it is shown as written.
+func renderMacro(value []byte, ctx *RenderContext) ([]byte, bool) {
+	name, args := parseMacro(value)
+	var content []byte
+	var err error
+	if bytes.HasPrefix(value, []byte("{{")) {
+		if name != "Include" {
+			return nil, false
+		}
+		content, err = includeMacro(ctx, args)
+	} else if f, ok := GetMacro(name); ok {
+		content, err = f(ctx.ReqInfo, ctx.Page, args)
+	} else {
+		err = unknownMacroErr
+	}
+	if err != nil {
+		return macroError(name, err), true
+	}
+	return content, true
+}
+
+// A problem with a macro is shown where the macro was
+func macroError(name string, err error) []byte {
+	return []byte(`<span class="macro-error">` + html.EscapeString(name+": "+err.Error()) + `</span>`)
+}
+
+// {{Include(Page)}}, {{Include(Page#Section)}} and {{Include(Page, revision)}}
+// show another page, rendered in its own format, inside the current one.
+// Readers without the read scope cannot include pages, there are no per
+// page read permissions to check.
+func includeMacro(ctx *RenderContext, args []string) ([]byte, error) {
+	if len(args) < 1 || len(args) > 2 || args[0] == "" {
+		return nil, fmt.Errorf("use Include(Page), Include(Page#Section) or Include(Page, revision)")
+	}
+	target, section := args[0], ""
+	if i := strings.IndexByte(target, '#'); i >= 0 {
+		target, section = target[:i], strings.TrimSpace(target[i+1:])
+	}
+	name, err := ResolvePageName(ctx.PageName, strings.TrimSpace(target))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid page name", target)
+	}
+	if ctx.ReqInfo == nil || ctx.ReqInfo.DB == nil {
+		return nil, noWikiErr
+	}
+	if len(ctx.Including) >= maxIncludeDepth {
+		return nil, fmt.Errorf("pages are included more than %d deep", maxIncludeDepth)
+	}
+	for _, including := range append(ctx.Including, ctx.PageName) {
+		if including == name {
+			return nil, fmt.Errorf("%s includes itself", name)
+		}
+	}
+	if !ctx.ReqInfo.CanRead() {
+		return nil, errors.New("you may not read pages")
+	}
+	if exists, err := ctx.ReqInfo.DB.PageExists(name); err != nil || !exists {
+		return nil, fmt.Errorf("%s does not exist", name)
+	}
+	page, err := ctx.ReqInfo.DB.GetPage(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s does not exist", name)
+	}
+	revision := CURRENT_REVISION
+	if len(args) == 2 {
+		if revision, err = strconv.Atoi(args[1]); err != nil || revision < 0 {
+			return nil, fmt.Errorf("%s is not a revision", args[1])
+		}
+	}
+	src, err := page.GetData(revision)
+	if err != nil {
+		return nil, fmt.Errorf("%s has no revision %s", name, args[1])
+	}
+	meta, err := page.GetMeta(revision)
+	if err != nil {
+		return nil, err
+	}
+	if section != "" {
+		renderer, err := GetRenderer(meta.Format)
+		finder, ok := renderer.(SectionFinder)
+		if err != nil || !ok {
+			return nil, fmt.Errorf("sections of %s cannot be included", name)
+		}
+		if src, ok = finder.Section(src, section); !ok {
+			return nil, fmt.Errorf("%s has no section %s", name, section)
+		}
+	}
+	including := make([]string, 0, len(ctx.Including)+1)
+	including = append(append(including, ctx.Including...), ctx.PageName)
+	content := RenderPage(meta.Format, src, &RenderContext{PageName: name, Page: page, ReqInfo: ctx.ReqInfo, Including: including})
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(`<div class="include">` + "\n")
+	buf.Write(content)
+	buf.WriteString("</div>\n")
+	return buf.Bytes(), nil
+}
+
+// A link to a page as HTML
+func pageLinkHTML(name, label string) string {
+	return `<a href="` + html.EscapeString(PageURL(name)) + `">` + html.EscapeString(label) + "</a>"
+}
+
+// <<PageList>> and <<PageList(prefix)>> list the pages whose names start with prefix.
+// Readers without the read scope get an empty list, pages have no read
+// permissions of their own.
+func pageListMacro(reqInfo *RequestInfo, page Page, args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return nil, errors.New("use PageList or PageList(prefix)")
+	}
+	if reqInfo == nil || reqInfo.DB == nil {
+		return nil, noWikiErr
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	pages, err := reqInfo.DB.ListPages()
+	if err != nil {
+		return nil, err
+	}
+	if !reqInfo.CanRead() {
+		pages = nil
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("<ul>\n")
+	for _, name := range pages {
+		if strings.HasPrefix(name, prefix) {
+			buf.WriteString("<li>" + pageLinkHTML(name, name) + "</li>\n")
+		}
+	}
+	buf.WriteString("</ul>\n")
+	return buf.Bytes(), nil
+}
+
+// <<RecentChanges>> and <<RecentChanges(n)>> list the last n pages to be
+// changed, 10 by default.  Changes are found in the audit log, without one
+// the time of the latest revision of each page is used.
+func recentChangesMacro(reqInfo *RequestInfo, page Page, args []string) ([]byte, error) {
+	count := 10
+	if len(args) > 1 {
+		return nil, errors.New("use RecentChanges or RecentChanges(count)")
+	}
+	if len(args) == 1 {
+		var err error
+		if count, err = strconv.Atoi(args[0]); err != nil || count < 1 {
+			return nil, fmt.Errorf("%s is not a count", args[0])
+		}
+	}
+	if reqInfo == nil || reqInfo.DB == nil {
+		return nil, noWikiErr
+	}
+	var changes []AuditEntry
+	var err error
+	if reqInfo.Audit != nil {
+		changes, err = auditedChanges(reqInfo.Audit, count)
+	} else {
+		changes, err = revisionChanges(reqInfo.DB, count)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !reqInfo.CanRead() {
+		changes = nil
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("<ul>\n")
+	for _, change := range changes {
+		buf.WriteString("<li>" + pageLinkHTML(change.Page, change.Page) + " " + html.EscapeString(change.Time.Format("2006-01-02 15:04")))
+		if change.User != "" {
+			buf.WriteString(" by " + html.EscapeString(change.User))
+		}
+		buf.WriteString("</li>\n")
+	}
+	buf.WriteString("</ul>\n")
+	return buf.Bytes(), nil
+}
+
+// The latest revision of the last count pages changed, from the audit log
+func auditedChanges(log *auditLog, count int) ([]AuditEntry, error) {
+	entries, err := log.Query(AuditFilter{})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	changes := make([]AuditEntry, 0, count)
+	for i := len(entries) - 1; i >= 0 && len(changes) < count; i-- {
+		if entries[i].Action == AuditRevision && !seen[entries[i].Page] {
+			seen[entries[i].Page] = true
+			changes = append(changes, entries[i])
+		}
+	}
+	return changes, nil
+}
+
+// The latest revision of the last count pages changed, from the time each
+// revision was added.  Who made the change is not known.
+func revisionChanges(db DB, count int) ([]AuditEntry, error) {
+	names, err := db.ListPages()
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]AuditEntry, 0, len(names))
+	for _, name := range names {
+		page, err := db.GetPage(name)
+		if err != nil {
+			return nil, err
+		}
+		meta, err := page.GetMeta(CURRENT_REVISION)
+		if err != nil {
+			continue
+		}
+		changes = append(changes, AuditEntry{Time: meta.Time, Action: AuditRevision, Page: name})
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Time.After(changes[j].Time)
+	})
+	if len(changes) > count {
+		changes = changes[:count]
+	}
+	return changes, nil
+}
+
+// <<AttachmentList>> lists the attachments of the page
+func attachmentListMacro(reqInfo *RequestInfo, page Page, args []string) ([]byte, error) {
+	if len(args) > 0 {
+		return nil, errors.New("AttachmentList takes no arguments")
+	}
+	if page == nil {
+		return nil, errors.New("there is no page")
+	}
+	attachments, err := page.ListAttachments()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("<ul>\n")
+	for _, attachment := range attachments {
+		buf.WriteString(`<li><a href="` + html.EscapeString(PageURL(page.Name())+attachment) + `">` + html.EscapeString(attachment) + "</a></li>\n")
+	}
+	buf.WriteString("</ul>\n")
+	return buf.Bytes(), nil
+}
+
+// <<PageCount>> is the number of pages in the wiki
+func pageCountMacro(reqInfo *RequestInfo, page Page, args []string) ([]byte, error) {
+	if len(args) > 0 {
+		return nil, errors.New("PageCount takes no arguments")
+	}
+	if reqInfo == nil || reqInfo.DB == nil {
+		return nil, noWikiErr
+	}
+	count, err := reqInfo.DB.CountPages()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strconv.Itoa(count)), nil
+}
+
+// <<Date>> is today's date, <<Date(2006-01-02)>> shows the given date
+func dateMacro(reqInfo *RequestInfo, page Page, args []string) ([]byte, error) {
+	date := time.Now()
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		if date, err = time.Parse("2006-01-02", args[0]); err != nil {
+			if date, err = time.Parse(time.RFC3339, args[0]); err != nil {
+				return nil, fmt.Errorf("%s is not a date, use YYYY-MM-DD", args[0])
+			}
+		}
+	default:
+		return nil, errors.New("use Date or Date(YYYY-MM-DD)")
+	}
+	return []byte(date.Format("2 January 2006")), nil
+}
+
+// HTML starting with a block element
+var blockHTMLRe = regexp.MustCompile(`^<(div|ul|ol|dl|table|pre|blockquote|hr|p|h[1-6])[\s/>]`)
+
+// Macros produce HTML that must not be touched by the markup processor, so a
+// placeholder is left in the markup and replaced once it has been rendered
+type macroOutput struct {
+	prefix string
+	html   [][]byte
+}
+
+func newMacroOutput() *macroOutput {
+	// the placeholders cannot be guessed, so the page source cannot use them,
+	// and are plain text so the markup processor leaves them alone
+	token, _ := randomToken(8)
+	return &macroOutput{prefix: "wikimacro" + token}
+}
+
+// Keep content and return the placeholder for it
+func (m *macroOutput) placeholder(content []byte) string {
+	m.html = append(m.html, content)
+	return fmt.Sprintf("%s%dx", m.prefix, len(m.html)-1)
+}
+
+// Replace the placeholders in rendered with the content they stand for
+func (m *macroOutput) substitute(rendered []byte) []byte {
+	for i, content := range m.html {
+		placeholder := []byte(fmt.Sprintf("%s%dx", m.prefix, i))
+		// a block macro alone in a paragraph is not put in the paragraph
+		if blockHTMLRe.Match(content) {
+			paragraph := append(append([]byte("<p>"), placeholder...), "</p>"...)
+			rendered = bytes.Replace(rendered, paragraph, content, -1)
+		}
+		rendered = bytes.Replace(rendered, placeholder, content, -1)
+	}
+	return rendered
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMacro(t *testing.T) {
+	Convey("Macros are split into a name and arguments", t, func() {
+		name, args := parseMacro([]byte("{{Include(OtherPage#Intro, 3)}}"))
+		So(name, ShouldEqual, "Include")
+		So(args, ShouldResemble, []string{"OtherPage#Intro", "3"})
+
+		name, args = parseMacro([]byte("{{PageCount}}"))
+		So(name, ShouldEqual, "PageCount")
+		So(args, ShouldResemble, []string{})
+
+		_, args = parseMacro([]byte("{{Date( )}}"))
+		So(args, ShouldResemble, []string{})
+	})
+}
+
+func TestIncludeMacro(t *testing.T) {
+	Convey("Given a wiki with pages to include", t, func() {
+		db, _ := newMemDB()
+		other, _ := db.GetPage("OtherPage")
+		other.AddRevision([]byte("First version"))
+		other.AddRevision([]byte("Intro text\n\n# Details\n\nDetail text\n\n## More\n\nMore text\n\n# Later\n\nLater text\n"))
+		moin, _ := db.GetPage("MoinPage")
+		moin.AddRevisionWithMeta([]byte("= Start =\nStart text\n= Usage =\nUsage text\n"), RevisionMeta{Format: "moin"})
+		reqInfo := &RequestInfo{DB: db}
+		render := func(name, src string) string {
+			page, _ := db.GetPage(name)
+			page.AddRevision([]byte(src))
+			return string(RenderPage("markdown", []byte(src), &RenderContext{PageName: name, Page: page, ReqInfo: reqInfo}))
+		}
+
+		Convey("The whole page is included in place of the macro", func() {
+			out := render("MainPage", "Before\n\n{{Include(OtherPage)}}\n\nAfter")
+			So(out, ShouldContainSubstring, "<p>Before</p>")
+			So(out, ShouldContainSubstring, "<div class=\"include\">\n<p>Intro text</p>")
+			So(out, ShouldContainSubstring, "<p>Later text</p>\n</div>")
+			So(out, ShouldNotContainSubstring, "wikimacro")
+		})
+
+		Convey("A section runs to the next heading at its level", func() {
+			out := render("MainPage", "{{Include(OtherPage#details)}}")
+			So(out, ShouldContainSubstring, "Detail text")
+			So(out, ShouldContainSubstring, "More text")
+			So(out, ShouldNotContainSubstring, "Intro text")
+			So(out, ShouldNotContainSubstring, "Later text")
+
+			out = render("MainPage", "{{Include(MoinPage#Usage)}}")
+			So(out, ShouldContainSubstring, "<h1 id=\"usage\">Usage</h1>\n<p>Usage text</p>")
+			So(out, ShouldNotContainSubstring, "Start text")
+
+			So(render("MainPage", "{{Include(OtherPage#Missing)}}"), ShouldContainSubstring, "OtherPage has no section Missing")
+		})
+
+		Convey("An older revision can be included", func() {
+			So(render("MainPage", "{{Include(OtherPage, 0)}}"), ShouldContainSubstring, "First version")
+			So(render("MainPage", "{{Include(OtherPage, 7)}}"), ShouldContainSubstring, "OtherPage has no revision 7")
+		})
+
+		Convey("Problems are shown in place of the macro", func() {
+			So(render("MainPage", "{{Include(NoSuchPage)}}"), ShouldContainSubstring, `<span class="macro-error">Include: NoSuchPage does not exist</span>`)
+			So(render("MainPage", "{{Include()}}"), ShouldContainSubstring, `<span class="macro-error">Include: use Include(Page)`)
+			So(render("MainPage", "{{Include(.hidden)}}"), ShouldContainSubstring, "is not a valid page name")
+			So(string(RenderPage("markdown", []byte("{{Include(OtherPage)}}"), &RenderContext{PageName: "MainPage"})), ShouldContainSubstring, "the wiki cannot be used here")
+		})
+
+		Convey("Pages that include themselves are caught", func() {
+			So(render("MainPage", "{{Include(MainPage)}}"), ShouldContainSubstring, "MainPage includes itself")
+
+			loopA, _ := db.GetPage("LoopA")
+			loopA.AddRevision([]byte("A {{Include(LoopB)}}"))
+			out := render("LoopB", "B {{Include(LoopA)}}")
+			So(out, ShouldContainSubstring, "LoopB includes itself")
+		})
+
+		Convey("Includes can only nest so deep", func() {
+			names := []string{"DeepA", "DeepB", "DeepC", "DeepD", "DeepE", "DeepF", "DeepG"}
+			for i := 0; i < len(names)-1; i++ {
+				page, _ := db.GetPage(names[i])
+				page.AddRevision([]byte(names[i] + " text {{Include(" + names[i+1] + ")}}"))
+			}
+			last, _ := db.GetPage(names[len(names)-1])
+			last.AddRevision([]byte("Bottom"))
+			out := render("MainPage", "{{Include(DeepA)}}")
+			So(out, ShouldContainSubstring, "DeepE</a> text")
+			So(out, ShouldContainSubstring, "pages are included more than 5 deep")
+			So(out, ShouldNotContainSubstring, "Bottom")
+		})
+
+		Convey("Readers need the read scope to include pages", func() {
+			reqInfo.User = &UserInfo{username: "UserOne", scopes: []string{ScopeWrite}}
+			So(render("MainPage", "{{Include(OtherPage)}}"), ShouldContainSubstring, "you may not read pages")
+		})
+
+		Convey("Macros the wiki does not know and macros in code are left alone", func() {
+			So(render("MainPage", "{{NoSuchMacro}}"), ShouldContainSubstring, "{{NoSuchMacro}}")
+			So(render("MainPage", "`{{Include(OtherPage)}}`"), ShouldContainSubstring, "<code>{{Include(OtherPage)}}</code>")
+		})
+	})
+}
+
+func TestMacros(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "macroTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempPath)
+
+	Convey("Given a wiki with some pages", t, func() {
+		db, _ := newMemDB()
+		for _, name := range []string{"ProjectX", "ProjectX/Notes", "ProjectY", "HomePage"} {
+			page, _ := db.GetPage(name)
+			page.AddRevision([]byte("text"))
+		}
+		page, _ := db.GetPage("HomePage")
+		page.AddAttachment(strings.NewReader("data"), "diagram.png")
+		reqInfo := &RequestInfo{DB: db}
+		render := func(format, src string) string {
+			return string(RenderPage(format, []byte(src), &RenderContext{PageName: "HomePage", Page: page, ReqInfo: reqInfo}))
+		}
+
+		Convey("PageList lists pages by prefix", func() {
+			out := render("markdown", "<<PageList(ProjectX)>>")
+			So(out, ShouldContainSubstring, `<li><a href="/ProjectX/">ProjectX</a></li>`)
+			So(out, ShouldContainSubstring, `<li><a href="/ProjectX/Notes/">ProjectX/Notes</a></li>`)
+			So(out, ShouldNotContainSubstring, "ProjectY")
+			So(render("markdown", "<<PageList>>"), ShouldContainSubstring, "ProjectY")
+		})
+
+		Convey("PageCount and AttachmentList describe the wiki and page", func() {
+			So(render("markdown", "There are <<PageCount>> pages"), ShouldEqual, "<p>There are 4 pages</p>\n")
+			So(render("markdown", "<<AttachmentList>>"), ShouldContainSubstring, `<li><a href="/HomePage/diagram.png">diagram.png</a></li>`)
+		})
+
+		Convey("Date shows today or a given date", func() {
+			So(render("markdown", "<<Date(2015-03-07)>>"), ShouldEqual, "<p>7 March 2015</p>\n")
+			So(render("markdown", "<<Date>>"), ShouldContainSubstring, time.Now().Format("2 January 2006"))
+			So(render("markdown", "<<Date(soon)>>"), ShouldContainSubstring, "Date: soon is not a date")
+		})
+
+		Convey("RecentChanges lists the pages last changed by their revision times", func() {
+			time.Sleep(2 * time.Millisecond)
+			project, _ := db.GetPage("ProjectY")
+			project.AddRevision([]byte("new text"))
+			out := render("markdown", "<<RecentChanges(1)>>")
+			So(out, ShouldContainSubstring, `<li><a href="/ProjectY/">ProjectY</a> `)
+			So(out, ShouldNotContainSubstring, "HomePage")
+			So(out, ShouldNotContainSubstring, " by ")
+			So(render("markdown", "<<RecentChanges>>"), ShouldContainSubstring, "ProjectX/Notes")
+		})
+
+		Convey("RecentChanges lists the pages last changed in the audit log when there is one", func() {
+			log, err := newAuditLog(filepath.Join(tempPath, "audit.log"), 0, 0)
+			So(err, ShouldBeNil)
+			reqInfo.Audit = log
+			for _, name := range []string{"ProjectX", "ProjectY", "ProjectX", "HomePage"} {
+				log.Record(AuditEntry{Action: AuditRevision, User: "UserOne", Page: name})
+			}
+			log.Record(AuditEntry{Action: AuditLogin, User: "UserOne"})
+			out := render("markdown", "<<RecentChanges(2)>>")
+			So(out, ShouldContainSubstring, `<a href="/HomePage/">HomePage</a>`)
+			So(out, ShouldContainSubstring, `<a href="/ProjectX/">ProjectX</a>`)
+			So(out, ShouldContainSubstring, "by UserOne")
+			So(out, ShouldNotContainSubstring, "ProjectY")
+			So(render("markdown", "<<RecentChanges(none)>>"), ShouldContainSubstring, "none is not a count")
+		})
+
+		Convey("TableOfContents lists the headings of the page", func() {
+			out := render("markdown", "<<TableOfContents>>\n\n# One\n\n## Two {#two}\n\n# Three *now*\n")
+			So(out, ShouldStartWith, "<div class=\"toc\">\n<ul>\n<li><a href=\"#one\">One</a><ul>\n<li><a href=\"#two\">Two</a></li>\n</ul>\n</li>\n<li><a href=\"#three-now\">Three now</a></li>\n</ul>\n</div>\n")
+
+			out = render("moin", "<<TableOfContents>>\n= First =\n== Second ==\n")
+			So(out, ShouldStartWith, "<div class=\"toc\">\n<ul>\n<li><a href=\"#first\">First</a><ul>\n<li><a href=\"#second\">Second</a></li>")
+		})
+
+		Convey("Macros work in the MoinMoin and Creole formats", func() {
+			So(render("moin", "There are <<PageCount>> pages"), ShouldEqual, "<p>There are 4 pages</p>\n")
+			So(render("creole", "<<PageList(ProjectY)>>"), ShouldEqual, "<ul>\n<li><a href=\"/ProjectY/\">ProjectY</a></li>\n</ul>\n\n")
+			So(render("plain", "<<PageCount>>"), ShouldEqual, "<pre>&lt;&lt;PageCount&gt;&gt;</pre>\n")
+		})
+
+		Convey("Unknown macros and bad arguments are shown as errors", func() {
+			So(render("markdown", "<<NoSuchMacro(1)>>"), ShouldContainSubstring, `<span class="macro-error">NoSuchMacro: unknown macro</span>`)
+			So(render("markdown", "<<PageCount(1)>>"), ShouldContainSubstring, "PageCount takes no arguments")
+			So(string(RenderPage("markdown", []byte("<<PageCount>>"), &RenderContext{PageName: "HomePage"})), ShouldContainSubstring, "the wiki cannot be used here")
+		})
+
+		Convey("New macros can be registered", func() {
+			RegisterMacro("TestShout", func(reqInfo *RequestInfo, page Page, args []string) ([]byte, error) {
+				if len(args) == 0 {
+					return nil, errors.New("nothing to shout")
+				}
+				return []byte(strings.ToUpper(args[0]) + " on " + page.Name()), nil
+			})
+			So(render("markdown", "<<TestShout(hello)>>"), ShouldEqual, "<p>HELLO on HomePage</p>\n")
+			So(render("markdown", "<<TestShout>>"), ShouldContainSubstring, "TestShout: nothing to shout")
+		})
+	})
+}
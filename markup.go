@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The MoinMoin and Creole markups share most of their syntax, headings
+// with '=', {{{ }}} for preformatted text, [[links]], tables and lists.
+// A wikiDialect describes where they differ.
+type wikiDialect struct {
+	name           string
+	label          string
+	styles         []inlineStyle // inline formatting, longer delimiters before their prefixes
+	codeTicks      bool          // `text` is code
+	wikiWords      bool          // CamelCase words link to pages
+	escape         string        // '!' stops a WikiWord being linked in Moin, '~' escapes the next character in Creole
+	lineBreak      string        // forces a line break inside a paragraph
+	tableSep       string        // separates table cells
+	headerCell     string        // starts a table header cell
+	closedHeadings bool          // headings must end with as many '=' as they start with
+	instructions   bool          // leading lines starting with # are processing instructions to skip
+	listItem       func(line string, inList bool) (level int, ordered bool, text string, ok bool)
+	tasks          *regexp.Regexp // matches a list item that is a task
+}
+
+type inlineStyle struct {
+	delim string
+	tag   string
+}
+
+// Renders one of the wiki markups
+type wikiRenderer struct {
+	dialect wikiDialect
+}
+
+var moinRenderer = &wikiRenderer{wikiDialect{
+	name:  "moin",
+	label: "MoinMoin",
+	styles: []inlineStyle{
+		{"'''", "strong"},
+		{"''", "em"},
+		{"__", "u"},
+		{",,", "sub"},
+		{"^", "sup"},
+		{"--(", "del"},
+		{")--", "del"},
+	},
+	codeTicks:      true,
+	wikiWords:      true,
+	escape:         "!",
+	lineBreak:      "<<BR>>",
+	tableSep:       "||",
+	closedHeadings: true,
+	instructions:   true,
+	listItem:       moinListItem,
+	tasks:          taskRe,
+}}
+
+var creoleRenderer = &wikiRenderer{wikiDialect{
+	name:  "creole",
+	label: "Creole",
+	styles: []inlineStyle{
+		{"**", "strong"},
+		{"//", "em"},
+	},
+	escape:     "~",
+	lineBreak:  "\\\\",
+	tableSep:   "|",
+	headerCell: "=",
+	listItem:   creoleListItem,
+	tasks:      creoleTaskRe,
+}}
+
+// Moin lists are indented, "  * item" or "  1. item", deeper indents nest
+func moinListItem(line string, inList bool) (int, bool, string, bool) {
+	text := strings.TrimLeft(line, " ")
+	indent := len(line) - len(text)
+	if indent == 0 {
+		return 0, false, "", false
+	}
+	if strings.HasPrefix(text, "* ") {
+		return indent, false, strings.TrimSpace(text[2:]), true
+	}
+	digits := 0
+	for digits < len(text) && '0' <= text[digits] && text[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 && strings.HasPrefix(text[digits:], ". ") {
+		return indent, true, strings.TrimSpace(text[digits+2:]), true
+	}
+	return 0, false, "", false
+}
+
+// Creole lists repeat the bullet to nest, "* item", "** sub item" or "# item".
+// Outside of a list "**" starts bold text instead.
+func creoleListItem(line string, inList bool) (int, bool, string, bool) {
+	text := strings.TrimSpace(line)
+	level := 0
+	for level < len(text) && (text[level] == '*' || text[level] == '#') {
+		level++
+	}
+	if level == 0 || (level > 1 && text[0] == '*' && !inList) {
+		return 0, false, "", false
+	}
+	return level, text[level-1] == '#', strings.TrimSpace(text[level:]), true
+}
+
+func (wr *wikiRenderer) Name() string { return wr.dialect.name }
+
+func (wr *wikiRenderer) TaskPattern() *regexp.Regexp { return wr.dialect.tasks }
+func (wr *wikiRenderer) Label() string               { return wr.dialect.label }
+
+func (wr *wikiRenderer) Render(src []byte, ctx *RenderContext) []byte {
+	w := &wikiWriter{d: &wr.dialect, ctx: ctx, buf: &bytes.Buffer{}}
+	w.render(string(src))
+	return w.buf.Bytes()
+}
+
+// The section starts at its heading and runs to the next heading of the
+// same or a higher level, headings in {{{ }}} blocks do not count
+func (wr *wikiRenderer) Section(src []byte, heading string) ([]byte, bool) {
+	lines := strings.SplitAfter(string(src), "\n")
+	start, startLevel := -1, 0
+	inPre := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "{{{") && !strings.Contains(trimmed[3:], "}}}"):
+			inPre = true
+		case inPre && trimmed == "}}}":
+			inPre = false
+		}
+		if inPre {
+			continue
+		}
+		level, text := wr.dialect.parseHeading(trimmed)
+		if level == 0 {
+			continue
+		}
+		if start >= 0 && level <= startLevel {
+			return []byte(strings.Join(lines[start:i], "")), true
+		}
+		if start < 0 && headingSlug(text) == headingSlug(heading) {
+			start, startLevel = i, level
+		}
+	}
+	if start < 0 {
+		return nil, false
+	}
+	return []byte(strings.Join(lines[start:], "")), true
+}
+
+// The state of rendering one page
+type wikiWriter struct {
+	d      *wikiDialect
+	ctx    *RenderContext
+	buf    *bytes.Buffer
+	tasks  map[int]bool // the lines that are task list items
+	para   []string     // lines of the paragraph being collected
+	lists  []string     // the open lists, "ul" or "ol"
+	levels []int        // the list level each open list was opened at
+	table  bool         // is a table open
+}
+
+func (w *wikiWriter) render(src string) {
+	lines := strings.Split(strings.Replace(src, "\r\n", "\n", -1), "\n")
+	w.tasks = taskLines([]byte(src), w.d.name)
+	i := 0
+	if w.d.instructions {
+		for i < len(lines) && strings.HasPrefix(lines[i], "#") {
+			i++
+		}
+	}
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "{{{") && !strings.Contains(trimmed[3:], "}}}"):
+			w.closeBlocks()
+			i = w.preformatted(lines, i)
+		case trimmed == "":
+			w.closeBlocks()
+		case len(trimmed) >= 4 && strings.Trim(trimmed, "-") == "":
+			w.closeBlocks()
+			w.buf.WriteString("<hr/>\n")
+		case w.heading(trimmed):
+		case strings.HasPrefix(trimmed, "<<") && macroLength([]byte(trimmed)) == len(trimmed):
+			// a macro on a line of its own is a block
+			w.closeBlocks()
+			content, _ := renderMacro([]byte(trimmed), w.ctx)
+			w.buf.Write(content)
+			w.buf.WriteString("\n")
+		case strings.HasPrefix(trimmed, w.d.tableSep):
+			w.closeParagraph()
+			w.closeLists()
+			w.tableRow(trimmed)
+		default:
+			if level, ordered, text, ok := w.d.listItem(line, len(w.lists) > 0); ok {
+				w.closeParagraph()
+				w.closeTable()
+				w.listItem(level, ordered, text, i)
+			} else {
+				w.closeLists()
+				w.closeTable()
+				w.para = append(w.para, trimmed)
+			}
+		}
+	}
+	w.closeBlocks()
+}
+
+func (w *wikiWriter) closeBlocks() {
+	w.closeParagraph()
+	w.closeLists()
+	w.closeTable()
+}
+
+func (w *wikiWriter) closeParagraph() {
+	if len(w.para) == 0 {
+		return
+	}
+	w.buf.WriteString("<p>" + w.inline(strings.Join(w.para, "\n")) + "</p>\n")
+	w.para = w.para[:0]
+}
+
+func (w *wikiWriter) closeLists() {
+	for len(w.lists) > 0 {
+		w.popList()
+	}
+}
+
+func (w *wikiWriter) closeTable() {
+	if w.table {
+		w.buf.WriteString("</table>\n")
+		w.table = false
+	}
+}
+
+// A {{{ }}} block is shown as it is, the index of its last line is returned.
+// A Moin #!highlight lang line at the start highlights the block, any other
+// #!format line is dropped.
+func (w *wikiWriter) preformatted(lines []string, start int) int {
+	body := make([]string, 0)
+	lang := ""
+	if first := strings.TrimSpace(lines[start])[3:]; strings.HasPrefix(first, "#!") {
+		if fields := strings.Fields(first[2:]); len(fields) > 1 && fields[0] == "highlight" {
+			lang = fields[1]
+		}
+	} else if first != "" {
+		body = append(body, first)
+	}
+	i := start + 1
+	for ; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "}}}" {
+			break
+		}
+		body = append(body, lines[i])
+	}
+	if highlighted, ok := highlightCode([]byte(strings.Join(body, "\n")+"\n"), lang); ok {
+		w.buf.Write(highlighted)
+		return i
+	}
+	w.buf.WriteString("<pre>" + html.EscapeString(strings.Join(body, "\n")) + "</pre>\n")
+	return i
+}
+
+// The level and text of a heading line, level is 0 if it is not one
+func (d *wikiDialect) parseHeading(line string) (int, string) {
+	level := 0
+	for level < len(line) && line[level] == '=' {
+		level++
+	}
+	if level == 0 || level > 6 || (d.closedHeadings && !strings.HasPrefix(line[level:], " ")) {
+		return 0, ""
+	}
+	text := strings.TrimSpace(line[level:])
+	closing := len(text) - len(strings.TrimRight(text, "="))
+	text = strings.TrimSpace(strings.TrimRight(text, "="))
+	if text == "" || (d.closedHeadings && closing != level) {
+		return 0, ""
+	}
+	return level, text
+}
+
+// Write the line as a heading if it is one
+func (w *wikiWriter) heading(line string) bool {
+	level, text := w.d.parseHeading(line)
+	if level == 0 {
+		return false
+	}
+	w.closeBlocks()
+	fmt.Fprintf(w.buf, "<h%d>%s</h%d>\n", level, w.inline(text), level)
+	return true
+}
+
+func (w *wikiWriter) tableRow(line string) {
+	if !w.table {
+		w.buf.WriteString("<table>\n")
+		w.table = true
+	}
+	cells := splitCells(line[len(w.d.tableSep):], w.d.tableSep)
+	if len(cells) > 1 && strings.TrimSpace(cells[len(cells)-1]) == "" {
+		cells = cells[:len(cells)-1]
+	}
+	w.buf.WriteString("<tr>")
+	for _, cell := range cells {
+		tag := "td"
+		if w.d.headerCell != "" && strings.HasPrefix(cell, w.d.headerCell) {
+			tag = "th"
+			cell = cell[len(w.d.headerCell):]
+		}
+		w.buf.WriteString("<" + tag + ">" + w.inline(strings.TrimSpace(cell)) + "</" + tag + ">")
+	}
+	w.buf.WriteString("</tr>\n")
+}
+
+// Split a table row into cells, separators inside [[links]] and {{{code}}} do not count
+func splitCells(row, sep string) []string {
+	cells := make([]string, 0)
+	start := 0
+	for i := 0; i < len(row); {
+		switch {
+		case strings.HasPrefix(row[i:], "[["):
+			i = skipPast(row, i, "]]")
+		case strings.HasPrefix(row[i:], "{{{"):
+			i = skipPast(row, i, "}}}")
+		case strings.HasPrefix(row[i:], sep):
+			cells = append(cells, row[start:i])
+			i += len(sep)
+			start = i
+		default:
+			i++
+		}
+	}
+	return append(cells, row[start:])
+}
+
+// The position just after the next end found after i, or just after i if there is none
+func skipPast(s string, i int, end string) int {
+	if j := strings.Index(s[i+1:], end); j >= 0 {
+		return i + 1 + j + len(end)
+	}
+	return i + 1
+}
+
+// Write an item of a list, line is where it is in the page source
+func (w *wikiWriter) listItem(level int, ordered bool, text string, line int) {
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	for len(w.levels) > 0 && w.levels[len(w.levels)-1] > level {
+		w.popList()
+	}
+	if len(w.levels) > 0 && w.levels[len(w.levels)-1] == level {
+		if w.lists[len(w.lists)-1] == tag {
+			w.buf.WriteString("</li>\n")
+		} else {
+			w.popList()
+		}
+	}
+	// a deeper list stays inside the item before it
+	if len(w.levels) == 0 || w.levels[len(w.levels)-1] < level {
+		w.buf.WriteString("<" + tag + ">\n")
+		w.lists = append(w.lists, tag)
+		w.levels = append(w.levels, level)
+	}
+	if w.tasks[line] {
+		done := text[1] != ' '
+		w.buf.WriteString("<li>" + taskCheckbox(w.ctx, line, done) + w.inline(text[3:]))
+		return
+	}
+	w.buf.WriteString("<li>" + w.inline(text))
+}
+
+func (w *wikiWriter) popList() {
+	last := len(w.lists) - 1
+	w.buf.WriteString("</li>\n</" + w.lists[last] + ">\n")
+	w.lists = w.lists[:last]
+	w.levels = w.levels[:last]
+}
+
+// Render the inline markup of some text, all of the text is escaped
+func (w *wikiWriter) inline(text string) string {
+	out := &bytes.Buffer{}
+	open := make([]inlineStyle, 0)
+	boundary := true
+	for i := 0; i < len(text); {
+		if n := tagLength([]byte(text[i:])); n > 0 && (i == 0 || isTagBoundary(lastRune([]byte(text[:i])))) {
+			out.WriteString(tagLinkHTML(text[i+1 : i+n]))
+			boundary = false
+			i += n
+			continue
+		}
+		n := w.inlineSpecial(out, text[i:], boundary, &open)
+		if n == 0 {
+			_, n = utf8.DecodeRuneInString(text[i:])
+			out.WriteString(html.EscapeString(text[i : i+n]))
+		}
+		last, _ := utf8.DecodeLastRuneInString(text[i : i+n])
+		boundary = !(unicode.IsLetter(last) || unicode.IsDigit(last))
+		i += n
+	}
+	for j := len(open) - 1; j >= 0; j-- {
+		out.WriteString("</" + open[j].tag + ">")
+	}
+	return out.String()
+}
+
+// Write any markup at the start of text, returning how much of it was used
+func (w *wikiWriter) inlineSpecial(out *bytes.Buffer, text string, boundary bool, open *[]inlineStyle) int {
+	switch {
+	case strings.HasPrefix(text, "{{{"):
+		if end := strings.Index(text[3:], "}}}"); end >= 0 {
+			out.WriteString("<code>" + html.EscapeString(text[3:3+end]) + "</code>")
+			return 3 + end + 3
+		}
+	case w.d.codeTicks && text[0] == '`':
+		if end := strings.IndexByte(text[1:], '`'); end >= 0 {
+			out.WriteString("<code>" + html.EscapeString(text[1:1+end]) + "</code>")
+			return 1 + end + 1
+		}
+	case strings.HasPrefix(text, "[["):
+		if end := strings.Index(text[2:], "]]"); end >= 0 {
+			out.WriteString(w.link(text[:2+end+2]))
+			return 2 + end + 2
+		}
+	case strings.HasPrefix(text, w.d.lineBreak):
+		out.WriteString("<br/>")
+		return len(w.d.lineBreak)
+	case strings.HasPrefix(text, "<<"):
+		if n := macroLength([]byte(text)); n > 0 {
+			content, _ := renderMacro([]byte(text[:n]), w.ctx)
+			out.Write(content)
+			return n
+		}
+	case text[0] == '$':
+		if n := mathLength([]byte(text)); n > 0 {
+			out.Write(mathHTML([]byte(text[:n])))
+			return n
+		}
+	case strings.HasPrefix(text, w.d.escape):
+		rest := text[len(w.d.escape):]
+		n := urlLength([]byte(rest))
+		if n == 0 {
+			n = wikiWordLength([]byte(rest))
+		}
+		if n == 0 && w.d.escape == "~" && rest != "" {
+			_, n = utf8.DecodeRuneInString(rest)
+		}
+		if n > 0 {
+			out.WriteString(html.EscapeString(rest[:n]))
+			return len(w.d.escape) + n
+		}
+	}
+	if boundary {
+		if n := urlLength([]byte(text)); n > 0 {
+			out.WriteString(`<a href="` + html.EscapeString(text[:n]) + `">` + html.EscapeString(text[:n]) + "</a>")
+			return n
+		}
+		if n := attachmentLength([]byte(text)); n > 0 {
+			if link, ok := attachmentLinkHTML(w.ctx, text[:n], text[:n]); ok {
+				out.WriteString(link)
+				return n
+			}
+		}
+		if n := interWikiLength([]byte(text)); n > 0 {
+			link, _ := interWiki.LinkHTML(text[:n], text[:n])
+			out.WriteString(link)
+			return n
+		}
+		if n := wikiWordLength([]byte(text)); n > 0 && w.d.wikiWords {
+			if anchor := anchorLength([]byte(strings.TrimPrefix(text[n:], "#"))); strings.HasPrefix(text[n:], "#") && anchor > 0 {
+				n += 1 + anchor
+			}
+			if href, err := ResolveLinkURL("", text[:n]); err == nil {
+				out.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(text[:n]) + "</a>")
+				return n
+			}
+		}
+	}
+	for _, style := range w.d.styles {
+		if strings.HasPrefix(text, style.delim) {
+			// the delimiter can close an outer style while the innermost style's
+			// delimiter also starts here, ie ''''' after '''bold ''italic, so
+			// close the innermost style first
+			if n := len(*open); n > 0 && isOpen(*open, style) && (*open)[n-1].tag != style.tag && strings.HasPrefix(text, (*open)[n-1].delim) {
+				style = (*open)[n-1]
+			}
+			w.toggleStyle(out, style, open)
+			return len(style.delim)
+		}
+	}
+	return 0
+}
+
+func isOpen(open []inlineStyle, style inlineStyle) bool {
+	for _, s := range open {
+		if s.tag == style.tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Open a style, or close it if it is open.  Styles opened inside it are
+// closed along with it and opened again after it.
+func (w *wikiWriter) toggleStyle(out *bytes.Buffer, style inlineStyle, open *[]inlineStyle) {
+	for i := len(*open) - 1; i >= 0; i-- {
+		if (*open)[i].tag != style.tag {
+			continue
+		}
+		inner := (*open)[i+1:]
+		for j := len(*open) - 1; j >= i; j-- {
+			out.WriteString("</" + (*open)[j].tag + ">")
+		}
+		for _, s := range inner {
+			out.WriteString("<" + s.tag + ">")
+		}
+		*open = append((*open)[:i], inner...)
+		return
+	}
+	out.WriteString("<" + style.tag + ">")
+	*open = append(*open, style)
+}
+
+// A [[target]] or [[target|label]] link, target is a URL, an interwiki or
+// attachment link or a page name relative to the page being rendered
+func (w *wikiWriter) link(value string) string {
+	inner := value[2 : len(value)-2]
+	target, label := inner, ""
+	if i := strings.Index(inner, "|"); i >= 0 {
+		target, label = inner[:i], inner[i+1:]
+	}
+	target = strings.TrimSpace(target)
+	if label = strings.TrimSpace(label); label == "" {
+		label = target
+	}
+	if link, ok := interWiki.LinkHTML(target, label); ok {
+		return link
+	}
+	if strings.HasPrefix(target, attachmentPrefix) {
+		if link, ok := attachmentLinkHTML(w.ctx, target, label); ok {
+			return link
+		}
+		return html.EscapeString(value)
+	}
+	href := target
+	if urlLength([]byte(target)) == 0 {
+		var err error
+		if href, err = ResolveLinkURL(w.ctx.PageName, target); err != nil {
+			return html.EscapeString(value)
+		}
+	}
+	return `<a href="` + html.EscapeString(href) + `">` + html.EscapeString(label) + "</a>"
+}
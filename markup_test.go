@@ -0,0 +1,62 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func renderMarkup(format, src string) string {
+	return string(RenderPage(format, []byte(src), &RenderContext{PageName: "ProjectX/Notes"}))
+}
+
+func TestMoinRenderer(t *testing.T) {
+	Convey("MoinMoin markup is rendered", t, func() {
+		So(renderMarkup("moin", "#format wiki\n#language en\n= Title =\n== Sub ==\n"), ShouldEqual, "<h1 id=\"title\">Title</h1>\n<h2 id=\"sub\">Sub</h2>\n")
+		So(renderMarkup("moin", "'''bold''' ''italic'' __under__ x^2^ `code`"), ShouldEqual, "<p><strong>bold</strong> <em>italic</em> <u>under</u> x<sup>2</sup> <code>code</code></p>\n")
+		So(renderMarkup("moin", "'''bold ''both'''''"), ShouldEqual, "<p><strong>bold <em>both</em></strong></p>\n")
+		So(renderMarkup("moin", "line one<<BR>>line two"), ShouldEqual, "<p>line one<br/>line two</p>\n")
+		So(renderMarkup("moin", "----"), ShouldEqual, "<hr/>\n")
+
+		Convey("WikiWords and links", func() {
+			So(renderMarkup("moin", "See WikiWord, !NotLinked and http://example.com/Page."), ShouldEqual,
+				`<p>See <a href="/WikiWord/">WikiWord</a>, NotLinked and <a href="http://example.com/Page">http://example.com/Page</a>.</p>`+"\n")
+			So(renderMarkup("moin", "[[Free Page|label]] [[../Plan]] [[/Child]] [[http://example.com|site]]"), ShouldEqual,
+				`<p><a href="/Free%20Page/">label</a> <a href="/ProjectX/Plan/">../Plan</a> <a href="/ProjectX/Notes/Child/">/Child</a> <a href="http://example.com">site</a></p>`+"\n")
+			So(renderMarkup("moin", "[[.bad]]"), ShouldEqual, "<p>[[.bad]]</p>\n")
+			So(renderMarkup("moin", "OtherPage#Usage and [[Other Page#Set up|setup]] [[#Intro]]"), ShouldEqual,
+				`<p><a href="/OtherPage/#usage">OtherPage#Usage</a> and <a href="/Other%20Page/#set-up">setup</a> <a href="#intro">#Intro</a></p>`+"\n")
+		})
+		Convey("Lists", func() {
+			So(renderMarkup("moin", " * one\n   * nested\n * two\n 1. first"), ShouldEqual,
+				"<ul>\n<li>one<ul>\n<li>nested</li>\n</ul>\n</li>\n<li>two</li>\n</ul>\n<ol>\n<li>first</li>\n</ol>\n")
+		})
+		Convey("Tables and preformatted text", func() {
+			So(renderMarkup("moin", "||a||[[Page|b]]||\n||c||d||"), ShouldEqual,
+				"<table>\n<tr><td>a</td><td><a href=\"/Page/\">b</a></td></tr>\n<tr><td>c</td><td>d</td></tr>\n</table>\n")
+			So(renderMarkup("moin", "{{{#!python\nx = WikiWord < 1\n}}}\nafter"), ShouldEqual, "<pre>x = WikiWord &lt; 1</pre>\n<p>after</p>\n")
+			So(renderMarkup("moin", "inline {{{WikiWord}}} code"), ShouldEqual, "<p>inline <code>WikiWord</code> code</p>\n")
+		})
+		Convey("Everything is escaped", func() {
+			So(renderMarkup("moin", "<script>alert(1)</script> [[javascript:alert(1)|x]]"), ShouldEqual,
+				`<p>&lt;script&gt;alert(1)&lt;/script&gt; <a href="/javascript:alert%281%29/">x</a></p>`+"\n")
+		})
+	})
+}
+
+func TestCreoleRenderer(t *testing.T) {
+	Convey("Creole markup is rendered", t, func() {
+		So(renderMarkup("creole", "= Title\n== Sub =="), ShouldEqual, "<h1 id=\"title\">Title</h1>\n<h2 id=\"sub\">Sub</h2>\n")
+		So(renderMarkup("creole", "**bold** //italic// and WikiWord\\\\next"), ShouldEqual, "<p><strong>bold</strong> <em>italic</em> and WikiWord<br/>next</p>\n")
+		So(renderMarkup("creole", "http://example.com/a ~http://not.linked ~**"), ShouldEqual, `<p><a href="http://example.com/a">http://example.com/a</a> http://not.linked **</p>`+"\n")
+
+		Convey("Lists", func() {
+			So(renderMarkup("creole", "* one\n** nested\n# first"), ShouldEqual,
+				"<ul>\n<li>one<ul>\n<li>nested</li>\n</ul>\n</li>\n</ul>\n<ol>\n<li>first</li>\n</ol>\n")
+			So(renderMarkup("creole", "**bold** at the start"), ShouldEqual, "<p><strong>bold</strong> at the start</p>\n")
+		})
+		Convey("Tables", func() {
+			So(renderMarkup("creole", "|=Name|=Link|\n|a|[[Page|b]]|"), ShouldEqual,
+				"<table>\n<tr><th>Name</th><th>Link</th></tr>\n<tr><td>a</td><td><a href=\"/Page/\">b</a></td></tr>\n</table>\n")
+		})
+	})
+}
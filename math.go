@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The length of the $inline$ or $$display$$ math at the start of input, 0
+// if there is not one.  Inline math stays on one line and, so amounts such
+// as $5 and $10 are left alone, ends at the next $ which cannot follow a
+// space or be followed by a digit.  Display math runs to the next $$ in the
+// paragraph.
+func mathLength(input []byte) int {
+	if bytes.HasPrefix(input, []byte("$$")) {
+		end := bytes.Index(input[2:], []byte("$$"))
+		if end < 0 || len(bytes.TrimSpace(input[2:2+end])) == 0 || bytes.Contains(input[2:2+end], []byte("\n\n")) {
+			return 0
+		}
+		return 2 + end + 2
+	}
+	if len(input) < 3 || input[0] != '$' || isSpaceByte(input[1]) {
+		return 0
+	}
+	for i := 2; i < len(input); i++ {
+		switch input[i] {
+		case '\n':
+			return 0
+		case '\\':
+			// an escaped \$ does not end the math
+			i++
+		case '$':
+			if isSpaceByte(input[i-1]) || (i+1 < len(input) && input[i+1] >= '0' && input[i+1] <= '9') {
+				return 0
+			}
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// The MathML for $inline$ or $$display$$ math, LaTeX the converter does not
+// know is shown as an error in the formula
+func mathHTML(value []byte) []byte {
+	src, open := string(value), "<math"
+	if strings.HasPrefix(src, "$$") {
+		src = src[2 : len(src)-2]
+		open += ` display="block"`
+	} else {
+		src = src[1 : len(src)-1]
+	}
+	p := &mathParser{tokens: tokenizeMath(src)}
+	nodes := p.parseRow(nil)
+	return []byte(open + ` alttext="` + html.EscapeString(strings.TrimSpace(src)) + `">` + strings.Join(nodes, "") + "</math>")
+}
+
+type mathTokenKind int
+
+const (
+	mathCommand mathTokenKind = iota // \name or \ followed by a symbol
+	mathNumber
+	mathLetter
+	mathSymbol // anything else, ie + ( { ^
+)
+
+type mathToken struct {
+	kind  mathTokenKind
+	value string
+	arg   string // the raw argument of \text{...} and \begin{...}
+}
+
+// commands whose argument is text rather than math
+var rawArgCommands = map[string]bool{
+	`\text`: true, `\textrm`: true, `\mbox`: true, `\operatorname`: true, `\begin`: true, `\end`: true,
+}
+
+// Split LaTeX into tokens, white space only separates them
+func tokenizeMath(src string) []mathToken {
+	tokens := make([]mathToken, 0)
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '\\':
+			n := 1
+			for i+n < len(src) && isASCIILetter(src[i+n]) {
+				n++
+			}
+			if n == 1 && i+1 < len(src) {
+				_, size = utf8.DecodeRuneInString(src[i+1:])
+				n += size
+			}
+			token := mathToken{kind: mathCommand, value: src[i : i+n]}
+			i += n
+			if rawArgCommands[token.value] {
+				token.arg, i = rawMathArg(src, i)
+			}
+			tokens = append(tokens, token)
+		case r >= '0' && r <= '9':
+			n := 0
+			for i+n < len(src) && (src[i+n] >= '0' && src[i+n] <= '9' || src[i+n] == '.' && i+n+1 < len(src) && src[i+n+1] >= '0' && src[i+n+1] <= '9') {
+				n++
+			}
+			tokens = append(tokens, mathToken{kind: mathNumber, value: src[i : i+n]})
+			i += n
+		case unicode.IsLetter(r):
+			tokens = append(tokens, mathToken{kind: mathLetter, value: src[i : i+size]})
+			i += size
+		default:
+			tokens = append(tokens, mathToken{kind: mathSymbol, value: src[i : i+size]})
+			i += size
+		}
+	}
+	return tokens
+}
+
+// Read a {braced} argument as it is written, returning it and where it ends
+func rawMathArg(src string, i int) (string, int) {
+	start := i
+	for start < len(src) && isSpaceByte(src[start]) {
+		start++
+	}
+	if start == len(src) || src[start] != '{' {
+		return "", i
+	}
+	depth := 0
+	for end := start; end < len(src); end++ {
+		switch src[end] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return src[start+1 : end], end + 1
+			}
+		}
+	}
+	return src[start+1:], len(src)
+}
+
+var mathGreek = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ", "varepsilon": "ε",
+	"zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ", "iota": "ι", "kappa": "κ",
+	"lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ", "pi": "π", "varpi": "ϖ", "rho": "ρ",
+	"varrho": "ϱ", "sigma": "σ", "varsigma": "ς", "tau": "τ", "upsilon": "υ", "phi": "ϕ",
+	"varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"infty": "∞", "partial": "∂", "nabla": "∇", "ell": "ℓ", "hbar": "ℏ", "emptyset": "∅",
+	"aleph": "ℵ", "Re": "ℜ", "Im": "ℑ",
+}
+
+// capital Greek letters are upright
+var mathUprightGreek = map[string]string{
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π",
+	"Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+}
+
+var mathOperators = map[string]string{
+	"times": "×", "cdot": "⋅", "div": "÷", "pm": "±", "mp": "∓", "ast": "∗", "star": "⋆",
+	"circ": "∘", "bullet": "∙", "le": "≤", "leq": "≤", "ge": "≥", "geq": "≥", "ne": "≠",
+	"neq": "≠", "ll": "≪", "gg": "≫", "approx": "≈", "sim": "∼", "simeq": "≃", "cong": "≅",
+	"equiv": "≡", "propto": "∝", "to": "→", "rightarrow": "→", "leftarrow": "←", "gets": "←",
+	"Rightarrow": "⇒", "Leftarrow": "⇐", "leftrightarrow": "↔", "Leftrightarrow": "⇔",
+	"implies": "⟹", "iff": "⟺", "mapsto": "↦", "in": "∈", "notin": "∉", "ni": "∋",
+	"subset": "⊂", "subseteq": "⊆", "supset": "⊃", "supseteq": "⊇", "cup": "∪", "cap": "∩",
+	"setminus": "∖", "forall": "∀", "exists": "∃", "neg": "¬", "lnot": "¬", "land": "∧",
+	"wedge": "∧", "lor": "∨", "vee": "∨", "oplus": "⊕", "otimes": "⊗", "perp": "⊥",
+	"parallel": "∥", "mid": "∣", "ldots": "…", "dots": "…", "cdots": "⋯", "vdots": "⋮",
+	"ddots": "⋱", "langle": "⟨", "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈",
+	"rceil": "⌉", "vert": "|", "lvert": "|", "rvert": "|", "Vert": "‖", "colon": ":", "prime": "′",
+	"{": "{", "}": "}", "|": "‖", "%": "%", "$": "$", "#": "#", "&": "&", "_": "_",
+}
+
+// operators whose limits go above and below them in display math
+var mathBigOperators = map[string]string{
+	"sum": "∑", "prod": "∏", "coprod": "∐", "bigcup": "⋃", "bigcap": "⋂", "bigoplus": "⨁",
+	"lim": "lim", "max": "max", "min": "min", "sup": "sup", "inf": "inf", "det": "det",
+	"gcd": "gcd", "Pr": "Pr", "liminf": "lim inf", "limsup": "lim sup",
+}
+
+// integrals take their limits as scripts
+var mathIntegrals = map[string]string{
+	"int": "∫", "iint": "∬", "iiint": "∭", "oint": "∮",
+}
+
+var mathFunctions = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "cot": true, "sec": true, "csc": true,
+	"arcsin": true, "arccos": true, "arctan": true, "sinh": true, "cosh": true, "tanh": true,
+	"log": true, "ln": true, "lg": true, "exp": true, "dim": true, "ker": true, "arg": true,
+	"deg": true, "hom": true,
+}
+
+var mathAccents = map[string]string{
+	"hat": "^", "widehat": "^", "bar": "¯", "overline": "¯", "vec": "→", "dot": "˙",
+	"ddot": "¨", "tilde": "~", "widetilde": "~",
+}
+
+var mathFonts = map[string]string{
+	"mathbf": "bold", "mathit": "italic", "mathrm": "normal", "mathsf": "sans-serif",
+	"mathtt": "monospace", "mathbb": "double-struck", "mathcal": "script",
+	"mathfrak": "fraktur", "boldsymbol": "bold-italic",
+}
+
+var mathSpaces = map[string]string{
+	`\,`: "0.167em", `\:`: "0.222em", `\>`: "0.222em", `\;`: "0.278em", `\ `: "0.333em",
+	`\!`: "-0.167em", `\quad`: "1em", `\qquad`: "2em", "~": "0.333em",
+}
+
+// the delimiters around matrix environments
+var mathEnvironments = map[string][2]string{
+	"matrix": {"", ""}, "pmatrix": {"(", ")"}, "bmatrix": {"[", "]"}, "Bmatrix": {"{", "}"},
+	"vmatrix": {"|", "|"}, "Vmatrix": {"‖", "‖"}, "cases": {"{", ""}, "aligned": {"", ""},
+	"align": {"", ""}, "align*": {"", ""}, "array": {"", ""},
+}
+
+// A recursive descent parser turning LaTeX tokens into MathML elements
+type mathParser struct {
+	tokens  []mathToken
+	pos     int
+	variant string // the mathvariant set by \mathbf and friends
+}
+
+func (p *mathParser) peek() (mathToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return mathToken{}, false
+}
+
+func (p *mathParser) isNext(value string) bool {
+	tok, ok := p.peek()
+	return ok && tok.kind != mathNumber && tok.value == value
+}
+
+// Parse elements up to the end of the input or a token stop accepts, which
+// is left for the caller
+func (p *mathParser) parseRow(stop func(mathToken) bool) []string {
+	nodes := make([]string, 0)
+	for {
+		tok, ok := p.peek()
+		if !ok || (stop != nil && stop(tok)) {
+			return nodes
+		}
+		if node := p.parseScripted(); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+}
+
+// Parse an element with any sub and superscripts
+func (p *mathParser) parseScripted() string {
+	base, limits := p.parseAtom()
+	var sub, sup string
+	primes := ""
+	for {
+		switch {
+		case p.isNext("^"):
+			p.pos++
+			sup = p.parseArg()
+		case p.isNext("_"):
+			p.pos++
+			sub = p.parseArg()
+		case p.isNext("'"):
+			p.pos++
+			primes += "′"
+		default:
+			if primes != "" && sup != "" {
+				sup = "<mrow>" + mathElement("mo", primes) + sup + "</mrow>"
+			} else if primes != "" {
+				sup = mathElement("mo", primes)
+			}
+			if base == "" && (sub != "" || sup != "") {
+				base = "<mrow></mrow>"
+			}
+			switch {
+			case sub != "" && sup != "" && limits:
+				return "<munderover>" + base + sub + sup + "</munderover>"
+			case sub != "" && sup != "":
+				return "<msubsup>" + base + sub + sup + "</msubsup>"
+			case sub != "" && limits:
+				return "<munder>" + base + sub + "</munder>"
+			case sub != "":
+				return "<msub>" + base + sub + "</msub>"
+			case sup != "" && limits:
+				return "<mover>" + base + sup + "</mover>"
+			case sup != "":
+				return "<msup>" + base + sup + "</msup>"
+			}
+			return base
+		}
+	}
+}
+
+// Parse a {group} or a single element, the argument to a command or script
+func (p *mathParser) parseArg() string {
+	tok, ok := p.peek()
+	if !ok || (tok.kind == mathSymbol && tok.value == "}") {
+		return "<mrow></mrow>"
+	}
+	if tok.kind == mathNumber && len(tok.value) > 1 {
+		// \frac12 is a half
+		p.tokens[p.pos].value = tok.value[1:]
+		return mathElement("mn", tok.value[:1])
+	}
+	if tok.kind == mathSymbol && tok.value == "{" {
+		return mathRow(p.parseGroup())
+	}
+	node, _ := p.parseAtom()
+	return node
+}
+
+// Parse the elements in a {group}
+func (p *mathParser) parseGroup() []string {
+	p.pos++
+	nodes := p.parseRow(func(tok mathToken) bool { return tok.kind == mathSymbol && tok.value == "}" })
+	p.pos++
+	return nodes
+}
+
+// Parse a single element, limits is set for big operators such as \sum
+func (p *mathParser) parseAtom() (node string, limits bool) {
+	tok, _ := p.peek()
+	p.pos++
+	switch tok.kind {
+	case mathNumber:
+		return mathElement("mn", tok.value), false
+	case mathLetter:
+		return p.identifier(tok.value), false
+	case mathCommand:
+		return p.parseCommand(tok)
+	}
+	switch tok.value {
+	case "{":
+		p.pos--
+		return mathRow(p.parseGroup()), false
+	case "}", "&":
+		// out of place, the group or table they belong to is missing
+		return "", false
+	case "~":
+		return `<mspace width="` + mathSpaces["~"] + `"/>`, false
+	case "-":
+		return mathElement("mo", "−"), false
+	case "*":
+		return mathElement("mo", "∗"), false
+	case "'":
+		return mathElement("mo", "′"), false
+	}
+	return mathElement("mo", tok.value), false
+}
+
+func (p *mathParser) identifier(name string) string {
+	if p.variant != "" {
+		return `<mi mathvariant="` + p.variant + `">` + html.EscapeString(name) + "</mi>"
+	}
+	return mathElement("mi", name)
+}
+
+func (p *mathParser) parseCommand(tok mathToken) (string, bool) {
+	name := tok.value[1:]
+	if width, ok := mathSpaces[tok.value]; ok {
+		return `<mspace width="` + width + `"/>`, false
+	}
+	if symbol, ok := mathGreek[name]; ok {
+		return p.identifier(symbol), false
+	}
+	if symbol, ok := mathUprightGreek[name]; ok {
+		return `<mi mathvariant="normal">` + symbol + "</mi>", false
+	}
+	if symbol, ok := mathOperators[name]; ok {
+		return mathElement("mo", symbol), false
+	}
+	if symbol, ok := mathBigOperators[name]; ok {
+		return mathElement("mo", symbol), true
+	}
+	if symbol, ok := mathIntegrals[name]; ok {
+		return mathElement("mo", symbol), false
+	}
+	if mathFunctions[name] {
+		return mathElement("mi", name), false
+	}
+	if accent, ok := mathAccents[name]; ok {
+		return `<mover accent="true">` + p.parseArg() + mathElement("mo", accent) + "</mover>", false
+	}
+	if variant, ok := mathFonts[name]; ok {
+		saved := p.variant
+		p.variant = variant
+		arg := p.parseArg()
+		p.variant = saved
+		return arg, false
+	}
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		return "<mfrac>" + p.parseArg() + p.parseArg() + "</mfrac>", false
+	case "binom":
+		return "<mrow><mo>(</mo>" + `<mfrac linethickness="0">` + p.parseArg() + p.parseArg() + "</mfrac><mo>)</mo></mrow>", false
+	case "sqrt":
+		if p.isNext("[") {
+			p.pos++
+			index := p.parseRow(func(tok mathToken) bool { return tok.kind == mathSymbol && tok.value == "]" })
+			p.pos++
+			return "<mroot>" + p.parseArg() + mathRow(index) + "</mroot>", false
+		}
+		return "<msqrt>" + p.parseArg() + "</msqrt>", false
+	case "underline":
+		return `<munder accentunder="true">` + p.parseArg() + mathElement("mo", "_") + "</munder>", false
+	case "text", "textrm", "mbox":
+		return mathElement("mtext", tok.arg), false
+	case "operatorname":
+		return mathElement("mi", tok.arg), false
+	case "left", "right", "middle", "big", "Big", "bigg", "Bigg":
+		return p.parseFence(name), false
+	case "begin":
+		return p.parseEnvironment(tok.arg), false
+	case "\\":
+		// a line break outside a table
+		return "", false
+	}
+	return "<merror>" + mathElement("mtext", tok.value) + "</merror>", false
+}
+
+// Parse \left( ... \right), \middle| and sized delimiters such as \big(
+func (p *mathParser) parseFence(name string) string {
+	delimiter := p.delimiter()
+	if name != "left" {
+		return delimiter
+	}
+	nodes := p.parseRow(func(tok mathToken) bool { return tok.kind == mathCommand && tok.value == `\right` })
+	closing := ""
+	if p.isNext(`\right`) {
+		p.pos++
+		closing = p.delimiter()
+	}
+	return "<mrow>" + delimiter + strings.Join(nodes, "") + closing + "</mrow>"
+}
+
+// The delimiter after \left or \right, \left. has none
+func (p *mathParser) delimiter() string {
+	tok, ok := p.peek()
+	if !ok {
+		return ""
+	}
+	p.pos++
+	value := tok.value
+	if tok.kind == mathCommand {
+		value = mathOperators[tok.value[1:]]
+	}
+	if value == "" || value == "." {
+		return ""
+	}
+	return `<mo fence="true">` + html.EscapeString(value) + "</mo>"
+}
+
+// Parse a \begin{matrix} ... \end{matrix} environment into a table, rows
+// are separated by \\ and columns by &
+func (p *mathParser) parseEnvironment(name string) string {
+	delimiters, known := mathEnvironments[name]
+	if name == "array" && p.isNext("{") {
+		// the column specification is not used
+		p.parseGroup()
+	}
+	endsCell := func(tok mathToken) bool {
+		return (tok.kind == mathSymbol && tok.value == "&") || (tok.kind == mathCommand && (tok.value == `\\` || tok.value == `\end`))
+	}
+	table := &bytes.Buffer{}
+	row := &bytes.Buffer{}
+	for {
+		cell := p.parseRow(endsCell)
+		row.WriteString("<mtd>" + strings.Join(cell, "") + "</mtd>")
+		tok, ok := p.peek()
+		p.pos++
+		if ok && tok.value == "&" {
+			continue
+		}
+		table.WriteString("<mtr>" + row.String() + "</mtr>")
+		row.Reset()
+		if !ok || tok.value == `\end` {
+			break
+		}
+	}
+	attrs := ""
+	switch name {
+	case "cases":
+		attrs = ` columnalign="left"`
+	case "aligned", "align", "align*":
+		attrs = ` columnalign="right left"`
+	}
+	out := "<mtable" + attrs + ">" + table.String() + "</mtable>"
+	if !known {
+		return "<merror>" + mathElement("mtext", `\begin{`+name+"}") + "</merror>" + out
+	}
+	if delimiters[0] != "" || delimiters[1] != "" {
+		out = "<mrow>" + mathFence(delimiters[0]) + out + mathFence(delimiters[1]) + "</mrow>"
+	}
+	return out
+}
+
+func mathFence(delimiter string) string {
+	if delimiter == "" {
+		return ""
+	}
+	return `<mo fence="true">` + html.EscapeString(delimiter) + "</mo>"
+}
+
+func mathElement(tag, content string) string {
+	return "<" + tag + ">" + html.EscapeString(content) + "</" + tag + ">"
+}
+
+// Several elements are grouped in an mrow where one is expected
+func mathRow(nodes []string) string {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	return "<mrow>" + strings.Join(nodes, "") + "</mrow>"
+}
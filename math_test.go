@@ -0,0 +1,72 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestMathLexing(t *testing.T) {
+	Convey("Math is lexed as a single token", t, func() {
+		So(lexSummary("Energy $E = mc^2$ here"), ShouldResemble, []string{"Lexed text: Energy ", "Lexed math: $E = mc^2$", "Lexed text:  here"})
+		So(lexSummary("$$\\sum_{i=1}^n\nx_i$$"), ShouldResemble, []string{"Lexed math: $$\\sum_{i=1}^n\nx_i$$"})
+		So(lexSummary("$WikiWord$"), ShouldResemble, []string{"Lexed math: $WikiWord$"})
+
+		Convey("but amounts of money are not math", func() {
+			So(lexSummary("costs $5 and $10"), ShouldResemble, []string{"Lexed text: costs $5 and $10"})
+			So(lexSummary("$ x$ and $x $ and $x$5"), ShouldResemble, []string{"Lexed text: $ x$ and $x $ and $x$5"})
+			So(lexSummary("escaped \\$x$"), ShouldResemble, []string{"Lexed text: escaped \\$x$"})
+			So(lexSummary("$$ $$ and $x\ny$"), ShouldResemble, []string{"Lexed text: $$ $$ and $x\ny$"})
+		})
+	})
+}
+
+func TestMathML(t *testing.T) {
+	Convey("LaTeX is converted to MathML", t, func() {
+		So(string(mathHTML([]byte("$x^2 + y_1$"))), ShouldEqual,
+			`<math alttext="x^2 + y_1"><msup><mi>x</mi><mn>2</mn></msup><mo>+</mo><msub><mi>y</mi><mn>1</mn></msub></math>`)
+		So(string(mathHTML([]byte("$$\\frac{a}{b}$$"))), ShouldEqual,
+			`<math display="block" alttext="\frac{a}{b}"><mfrac><mi>a</mi><mi>b</mi></mfrac></math>`)
+		So(string(mathHTML([]byte("$\\frac12$"))), ShouldContainSubstring, "<mfrac><mn>1</mn><mn>2</mn></mfrac>")
+		So(string(mathHTML([]byte("$\\sqrt{x} \\sqrt[3]{y}$"))), ShouldContainSubstring, "<msqrt><mi>x</mi></msqrt><mroot><mi>y</mi><mn>3</mn></mroot>")
+		So(string(mathHTML([]byte("$\\alpha \\leq \\Omega - 3.14$"))), ShouldContainSubstring,
+			`<mi>α</mi><mo>≤</mo><mi mathvariant="normal">Ω</mi><mo>−</mo><mn>3.14</mn>`)
+		So(string(mathHTML([]byte("$\\sum_{i=1}^n i$"))), ShouldContainSubstring,
+			"<munderover><mo>∑</mo><mrow><mi>i</mi><mo>=</mo><mn>1</mn></mrow><mi>n</mi></munderover>")
+		So(string(mathHTML([]byte("$\\int_0^1 f'(x)$"))), ShouldContainSubstring,
+			"<msubsup><mo>∫</mo><mn>0</mn><mn>1</mn></msubsup><msup><mi>f</mi><mo>′</mo></msup>")
+		So(string(mathHTML([]byte("$\\left( \\frac{1}{2} \\right]$"))), ShouldContainSubstring,
+			`<mrow><mo fence="true">(</mo><mfrac><mn>1</mn><mn>2</mn></mfrac><mo fence="true">]</mo></mrow>`)
+		So(string(mathHTML([]byte("$\\text{rate} \\sin x \\mathbf{v}$"))), ShouldContainSubstring,
+			`<mtext>rate</mtext><mi>sin</mi><mi>x</mi><mi mathvariant="bold">v</mi>`)
+		So(string(mathHTML([]byte("$$\\begin{pmatrix} a & b \\\\ c & d \\end{pmatrix}$$"))), ShouldContainSubstring,
+			`<mrow><mo fence="true">(</mo><mtable><mtr><mtd><mi>a</mi></mtd><mtd><mi>b</mi></mtd></mtr><mtr><mtd><mi>c</mi></mtd><mtd><mi>d</mi></mtd></mtr></mtable><mo fence="true">)</mo></mrow>`)
+
+		Convey("and unknown commands are shown as errors", func() {
+			So(string(mathHTML([]byte("$\\nosuch{x}$"))), ShouldContainSubstring, `<merror><mtext>\nosuch</mtext></merror><mi>x</mi>`)
+			So(string(mathHTML([]byte("$x^{}} <b>$"))), ShouldContainSubstring, "<mo>&lt;</mo><mi>b</mi><mo>&gt;</mo>")
+		})
+	})
+}
+
+func TestMathRendering(t *testing.T) {
+	Convey("Math in pages is not touched by markdown or WikiWords", t, func() {
+		out := string(RenderPage("markdown", []byte("See $a*b*c_{WikiWord}$ in WikiWord"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldEqual, `<p>See <math alttext="a*b*c_{WikiWord}"><mi>a</mi><mo>∗</mo><mi>b</mi><mo>∗</mo><msub><mi>c</mi>`+
+			`<mrow><mi>W</mi><mi>i</mi><mi>k</mi><mi>i</mi><mi>W</mi><mi>o</mi><mi>r</mi><mi>d</mi></mrow></msub></math> in <a href="/WikiWord/">WikiWord</a></p>`+"\n")
+		So(string(SanitizeHTML([]byte(out))), ShouldContainSubstring, `<math alttext="a*b*c_{WikiWord}"><mi>a</mi><mo>∗</mo>`)
+
+		out = string(RenderPage("markdown", []byte("`$x$` costs $5 and $10"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldEqual, "<p><code>$x$</code> costs $5 and $10</p>\n")
+		So(string(ExpandWikiWords([]byte("$WikiWord$"))), ShouldEqual, "$WikiWord$")
+
+		out = string(SanitizeHTML(RenderPage("markdown", []byte("$$\\hat{x}\\,\\vec{v}$$"), &RenderContext{PageName: "PageOne"})))
+		So(out, ShouldContainSubstring, `<math display="block" alttext="\hat{x}\,\vec{v}"><mover accent="true"><mi>x</mi><mo>^</mo></mover><mspace width="0.167em"/>`)
+	})
+
+	Convey("Math is rendered in the other formats", t, func() {
+		out := string(RenderPage("moin", []byte("Moin $x_1$ ''here''"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldEqual, `<p>Moin <math alttext="x_1"><msub><mi>x</mi><mn>1</mn></msub></math> <em>here</em></p>`+"\n")
+		out = string(RenderPage("creole", []byte("Creole $$//x//$$"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldContainSubstring, `<math display="block" alttext="//x//"><mo>/</mo><mo>/</mo><mi>x</mi><mo>/</mo><mo>/</mo></math>`)
+	})
+}
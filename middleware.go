@@ -27,6 +27,15 @@ func NewPageLookupMiddleware(db DB, next http.Handler) http.Handler {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if !IsValidPageName(PageName) {
+			// send names that only differ in spacing to the canonical page
+			if normalized, err := NormalizePageName(PageName); err == nil && r.Method == "GET" {
+				http.Redirect(w, r, PageURL(normalized), http.StatusMovedPermanently)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 		page, err := db.GetPage(PageName)
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
@@ -76,7 +76,7 @@ func TestVieworCreateMiddleware(t *testing.T) {
 			created = false
 			viewed = false
 			record := httptest.NewRecorder()
-			req, err := http.NewRequest("GET", "/page/invalid/", nil)
+			req, err := http.NewRequest("GET", "/page/.invalid/", nil)
 			So(err, ShouldBeNil)
 
 			mx := mux.NewRouter()
@@ -90,6 +90,32 @@ func TestVieworCreateMiddleware(t *testing.T) {
 	})
 }
 
+func TestPageLookupMiddlewareNormalizesNames(t *testing.T) {
+	db, _ := newMemDB()
+	var okHandler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {}
+
+	Convey("Page names that are not in their canonical form are redirected", t, func() {
+		m := NewMuxVarMiddleware(NewPageLookupMiddleware(db, okHandler))
+		mx := mux.NewRouter()
+		mx.Path("/page/{name}/").Handler(m)
+
+		record := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/page/Release%20%20notes%20/", nil)
+		So(err, ShouldBeNil)
+		mx.ServeHTTP(record, req)
+		So(record.Code, ShouldEqual, http.StatusMovedPermanently)
+		So(record.Header().Get("Location"), ShouldEqual, "/Release%20notes/")
+
+		Convey("Canonical free form names are looked up", func() {
+			record := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/page/Release%20notes/", nil)
+			So(err, ShouldBeNil)
+			mx.ServeHTTP(record, req)
+			So(record.Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
+
 func TestPageLookupMiddleware(t *testing.T) {
 	called := false
 	var pageData Page
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pages named like MeetingNotesTemplate are offered as the starting point
+// for new pages
+const templateSuffix = "Template"
+
+func isTemplatePage(name string) bool {
+	return len(name) > len(templateSuffix) && strings.HasSuffix(name, templateSuffix)
+}
+
+// The template pages, none if the user making the request may not read pages
+func listTemplates(reqInfo *RequestInfo) ([]string, error) {
+	names := make([]string, 0)
+	if !reqInfo.CanRead() {
+		return names, nil
+	}
+	pages, err := reqInfo.DB.ListPages()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range pages {
+		if isTemplatePage(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Fill in the placeholders of a template for a new page, @DATE@ is the
+// date, @USER@ the user creating the page and @PAGE@ its name
+func expandTemplate(src []byte, pageName string, user *UserInfo, now time.Time) []byte {
+	replacer := strings.NewReplacer(
+		"@DATE@", now.Format("2006-01-02"),
+		"@USER@", user.Username(),
+		"@PAGE@", pageName,
+	)
+	return []byte(replacer.Replace(string(src)))
+}
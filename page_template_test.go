@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	Convey("Template pages are named ending in Template", t, func() {
+		So(isTemplatePage("MeetingNotesTemplate"), ShouldBeTrue)
+		So(isTemplatePage("Team/ReportTemplate"), ShouldBeTrue)
+		So(isTemplatePage("Template"), ShouldBeFalse)
+		So(isTemplatePage("TemplateGuide"), ShouldBeFalse)
+	})
+
+	Convey("The placeholders of a template are filled in", t, func() {
+		now := time.Date(2024, 3, 7, 10, 0, 0, 0, time.UTC)
+		out := expandTemplate([]byte("# @PAGE@\n\nBy @USER@ on @DATE@, @OTHER@"), "Meetings/Monday", &UserInfo{username: "UserOne"}, now)
+		So(string(out), ShouldEqual, "# Meetings/Monday\n\nBy UserOne on 2024-03-07, @OTHER@")
+		So(string(expandTemplate([]byte("@USER@"), "PageOne", nil, now)), ShouldEqual, AnonymousUser)
+	})
+}
+
+func TestPageTemplates(t *testing.T) {
+	wiki, _ := newMemDB()
+	user := &UserInfo{username: "UserOne"}
+
+	Convey("Given a wiki with template pages", t, func() {
+		template, _ := wiki.GetPage("MeetingNotesTemplate")
+		template.AddRevisionWithMeta([]byte("= @PAGE@ =\nTaken by @USER@ on @DATE@"), RevisionMeta{Format: "moin"})
+		other, _ := wiki.GetPage("AgendaTemplate")
+		other.AddRevision([]byte("agenda"))
+		plain, _ := wiki.GetPage("PageOne")
+		plain.AddRevision([]byte("not a template"))
+		reqInfo := &RequestInfo{Params: map[string]string{"name": "NewNotes"}, DB: wiki, User: user}
+
+		Convey("they are offered when creating a page", func() {
+			newPage, _ := wiki.GetPage("NewNotes")
+			record := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/NewNotes/", nil)
+			context.Set(req, keyPage, newPage)
+			CreatePageHandler(reqInfo, record, req)
+			context.Clear(req)
+			body := record.Body.String()
+			So(body, ShouldContainSubstring, `<li><a href="/edit/NewNotes/?template=AgendaTemplate">AgendaTemplate</a></li>`)
+			So(body, ShouldContainSubstring, `<li><a href="/edit/NewNotes/?template=MeetingNotesTemplate">MeetingNotesTemplate</a></li>`)
+			So(body, ShouldNotContainSubstring, "template=PageOne")
+
+			Convey("but not to users who cannot edit", func() {
+				record := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/NewNotes/", nil)
+				context.Set(req, keyPage, newPage)
+				CreatePageHandler(&RequestInfo{Params: reqInfo.Params, DB: wiki, Policy: &EditPolicy{Mode: PolicyReadOnly}}, record, req)
+				context.Clear(req)
+				So(record.Body.String(), ShouldNotContainSubstring, "template=")
+			})
+		})
+
+		Convey("the edit page of a new page is filled in from the template", func() {
+			record := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/edit/NewNotes/?template=MeetingNotesTemplate", nil)
+			ShowEditPageHandler(reqInfo, record, req)
+			So(record.Code, ShouldEqual, http.StatusOK)
+			body := record.Body.String()
+			So(body, ShouldContainSubstring, "<textarea name=\"entry\" rows=\"25\">= NewNotes =\nTaken by UserOne on "+time.Now().Format("2006-01-02")+"</textarea>")
+			So(body, ShouldContainSubstring, `<option value="moin" selected>`)
+			So(body, ShouldContainSubstring, `Starting from <a href="/MeetingNotesTemplate/">MeetingNotesTemplate</a>`)
+
+			Convey("while existing pages keep their own source", func() {
+				record := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/edit/PageOne/?template=MeetingNotesTemplate", nil)
+				ShowEditPageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki, User: user}, record, req)
+				So(record.Body.String(), ShouldContainSubstring, `<textarea name="entry" rows="25">not a template</textarea>`)
+				So(record.Body.String(), ShouldNotContainSubstring, "Starting from")
+			})
+		})
+
+		Convey("only readable template pages can be used", func() {
+			edit := func(reqInfo *RequestInfo, template string) int {
+				record := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/edit/NewNotes/?template="+template, nil)
+				ShowEditPageHandler(reqInfo, record, req)
+				return record.Code
+			}
+			So(edit(reqInfo, "PageOne"), ShouldEqual, http.StatusBadRequest)
+			So(edit(reqInfo, "MissingTemplate"), ShouldEqual, http.StatusNotFound)
+			token := &RequestInfo{Params: reqInfo.Params, DB: wiki, User: &UserInfo{username: "UserOne", scopes: []string{ScopeWrite}}}
+			So(edit(token, "AgendaTemplate"), ShouldEqual, http.StatusForbidden)
+		})
+	})
+}
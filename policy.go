@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PolicyMode selects who may modify the wiki
+type PolicyMode int
+
+const (
+	PolicyOpen     PolicyMode = iota // everyone, including anonymous users, can edit
+	PolicyLoggedIn                   // only logged in users can edit
+	PolicyRoles                      // only users with one of the policy roles can edit
+	PolicyReadOnly                   // nobody can edit
+)
+
+// EditPolicy is the wiki wide edit policy.  A nil policy is treated as PolicyOpen.
+type EditPolicy struct {
+	Mode  PolicyMode
+	Roles []string
+}
+
+// ParseEditPolicy builds an EditPolicy from its textual form, one of
+// "open", "users", "roles:role1,role2" or "readonly"
+func ParseEditPolicy(value string) (*EditPolicy, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "open" || value == "":
+		return &EditPolicy{Mode: PolicyOpen}, nil
+	case value == "users":
+		return &EditPolicy{Mode: PolicyLoggedIn}, nil
+	case value == "readonly":
+		return &EditPolicy{Mode: PolicyReadOnly}, nil
+	case strings.HasPrefix(value, "roles:"):
+		roles := make([]string, 0)
+		for _, role := range strings.Split(value[len("roles:"):], ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles = append(roles, role)
+			}
+		}
+		if len(roles) == 0 {
+			return nil, errors.New("A roles policy needs at least one role")
+		}
+		return &EditPolicy{Mode: PolicyRoles, Roles: roles}, nil
+	}
+	return nil, errors.New("Unknown edit policy " + value)
+}
+
+func (p *EditPolicy) String() string {
+	if p == nil {
+		return "open"
+	}
+	switch p.Mode {
+	case PolicyLoggedIn:
+		return "users"
+	case PolicyRoles:
+		return "roles:" + strings.Join(p.Roles, ",")
+	case PolicyReadOnly:
+		return "readonly"
+	}
+	return "open"
+}
+
+// Is the wiki read only, if so the edit routes are not even registered
+func (p *EditPolicy) ReadOnly() bool {
+	return p != nil && p.Mode == PolicyReadOnly
+}
+
+// CanEdit reports if the given user may modify pages and attachments
+func (p *EditPolicy) CanEdit(u *UserInfo) bool {
+	if p == nil {
+		return true
+	}
+	switch p.Mode {
+	case PolicyOpen:
+		return true
+	case PolicyLoggedIn:
+		return !u.IsAnonymous()
+	case PolicyRoles:
+		for _, role := range u.Roles() {
+			for _, allowed := range p.Roles {
+				if role == allowed {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Refuse a request, anonymous users are sent to the login page when
+// logging in could help, everyone else gets a 403.  Refusals are audited.
+func denyRequest(w http.ResponseWriter, r *http.Request, log *auditLog, canLogin bool) {
+	log.RecordRequest(r, AuditDenied, CurParams(r)["name"], r.Method+" "+r.URL.Path)
+	if canLogin && CurUser(r).IsAnonymous() && r.Method == "GET" {
+		http.Redirect(w, r, "/login/?next="+url.QueryEscape(r.URL.Path), http.StatusFound)
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+}
+
+// The EditPolicyMiddleware guards the routes that modify the wiki.
+func NewEditPolicyMiddleware(policy *EditPolicy, log *auditLog, next http.Handler) http.Handler {
+	var f http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		if policy.CanEdit(CurUser(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		denyRequest(w, r, log, !policy.ReadOnly())
+	}
+	return f
+}
+
+// The RoleMiddleware only lets users with the given role through
+func NewRoleMiddleware(role string, log *auditLog, next http.Handler) http.Handler {
+	var f http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		for _, userRole := range CurUser(r).Roles() {
+			if userRole == role {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		denyRequest(w, r, log, true)
+	}
+	return f
+}
+
+// The ScopeMiddleware refuses API token users whose token does not cover scope
+func NewScopeMiddleware(scope string, log *auditLog, next http.Handler) http.Handler {
+	var f http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		if CurUser(r).HasScope(scope) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		denyRequest(w, r, log, false)
+	}
+	return f
+}
+
+// The LoginMiddleware only lets users with a login session through
+func NewLoginMiddleware(log *auditLog, next http.Handler) http.Handler {
+	var f http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		user := CurUser(r)
+		if !user.IsAnonymous() && !user.IsToken() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		denyRequest(w, r, log, true)
+	}
+	return f
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseEditPolicy(t *testing.T) {
+	Convey("Edit policies are parsed from their textual form", t, func() {
+		p, err := ParseEditPolicy("open")
+		So(err, ShouldBeNil)
+		So(p.Mode, ShouldEqual, PolicyOpen)
+
+		p, err = ParseEditPolicy("users")
+		So(err, ShouldBeNil)
+		So(p.Mode, ShouldEqual, PolicyLoggedIn)
+
+		p, err = ParseEditPolicy("readonly")
+		So(err, ShouldBeNil)
+		So(p.Mode, ShouldEqual, PolicyReadOnly)
+		So(p.ReadOnly(), ShouldBeTrue)
+
+		p, err = ParseEditPolicy("roles:editor, admin")
+		So(err, ShouldBeNil)
+		So(p.Mode, ShouldEqual, PolicyRoles)
+		So(p.Roles, ShouldContain, "editor")
+		So(p.Roles, ShouldContain, "admin")
+		So(p.String(), ShouldEqual, "roles:editor,admin")
+
+		Convey("Invalid policies are rejected", func() {
+			_, err = ParseEditPolicy("everyone")
+			So(err, ShouldNotBeNil)
+			_, err = ParseEditPolicy("roles:")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestEditPolicyCanEdit(t *testing.T) {
+	anonymous := &UserInfo{}
+	user := &UserInfo{username: "UserOne"}
+	editor := &UserInfo{username: "EditorOne"}
+	editor.AddRole("editor")
+
+	Convey("A nil policy lets everyone edit", t, func() {
+		var p *EditPolicy
+		So(p.CanEdit(anonymous), ShouldBeTrue)
+		So(p.ReadOnly(), ShouldBeFalse)
+	})
+	Convey("An open policy lets everyone edit", t, func() {
+		p := &EditPolicy{Mode: PolicyOpen}
+		So(p.CanEdit(nil), ShouldBeTrue)
+		So(p.CanEdit(anonymous), ShouldBeTrue)
+		So(p.CanEdit(user), ShouldBeTrue)
+	})
+	Convey("A logged in policy requires a user", t, func() {
+		p := &EditPolicy{Mode: PolicyLoggedIn}
+		So(p.CanEdit(nil), ShouldBeFalse)
+		So(p.CanEdit(anonymous), ShouldBeFalse)
+		So(p.CanEdit(user), ShouldBeTrue)
+	})
+	Convey("A roles policy requires one of the roles", t, func() {
+		p := &EditPolicy{Mode: PolicyRoles, Roles: []string{"admin", "editor"}}
+		So(p.CanEdit(anonymous), ShouldBeFalse)
+		So(p.CanEdit(user), ShouldBeFalse)
+		So(p.CanEdit(editor), ShouldBeTrue)
+	})
+	Convey("A read only policy lets nobody edit", t, func() {
+		p := &EditPolicy{Mode: PolicyReadOnly}
+		So(p.CanEdit(anonymous), ShouldBeFalse)
+		So(p.CanEdit(editor), ShouldBeFalse)
+	})
+}
+
+func TestEditPolicyMiddleware(t *testing.T) {
+	called := false
+	var okHandler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}
+
+	Convey("The EditPolicyMiddleware only calls the next handler when the policy allows it", t, func() {
+		m := NewEditPolicyMiddleware(&EditPolicy{Mode: PolicyLoggedIn}, nil, okHandler)
+
+		Convey("Anonymous GET requests are sent to the login page", func() {
+			called = false
+			record := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", "/edit/PageOne/", nil)
+			So(err, ShouldBeNil)
+			m.ServeHTTP(record, req)
+			So(called, ShouldBeFalse)
+			So(record.Code, ShouldEqual, http.StatusFound)
+			So(record.Header().Get("Location"), ShouldStartWith, "/login/")
+		})
+		Convey("Anonymous POST requests are forbidden", func() {
+			called = false
+			record := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "/edit/PageOne/", nil)
+			So(err, ShouldBeNil)
+			m.ServeHTTP(record, req)
+			So(called, ShouldBeFalse)
+			So(record.Code, ShouldEqual, http.StatusForbidden)
+		})
+		Convey("Logged in users are passed through", func() {
+			called = false
+			record := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "/edit/PageOne/", nil)
+			So(err, ShouldBeNil)
+			context.Set(req, keyUser, &UserInfo{username: "UserOne"})
+			m.ServeHTTP(record, req)
+			context.Clear(req)
+			So(called, ShouldBeTrue)
+		})
+	})
+}
+
+func TestEditLinkFollowsPolicy(t *testing.T) {
+	wiki, _ := newMemDB()
+	page, _ := wiki.GetPage("PageOne")
+	page.AddRevision([]byte("Hello"))
+
+	render := func(policy *EditPolicy) string {
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/PageOne/", nil)
+		context.Set(req, keyPage, page)
+		PageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki, Policy: policy}, record, req)
+		context.Clear(req)
+		return record.Body.String()
+	}
+
+	Convey("The edit link is only shown when the user may edit", t, func() {
+		So(strings.Contains(render(nil), "/edit/PageOne/"), ShouldBeTrue)
+		So(strings.Contains(render(&EditPolicy{Mode: PolicyReadOnly}), "/edit/PageOne/"), ShouldBeFalse)
+		So(strings.Contains(render(&EditPolicy{Mode: PolicyLoggedIn}), "/edit/PageOne/"), ShouldBeFalse)
+	})
+}
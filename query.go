@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// <<Query(status=open AND owner=@me, columns=owner,due, sort=due)>> shows a
+// table of the pages whose properties match a condition.  The condition is
+// the first argument, the options follow it:
+//
+//   - columns are the properties to show beside the page name
+//   - sort and order sort the pages by a property, or by page
+//   - limit is the most pages to show
+//
+// Conditions compare properties with =, !=, <, <=, > and >=, a property
+// name on its own matches pages that set it.  They are combined with AND,
+// OR, NOT and brackets.  Values are words or quoted text, @me is the reader
+// and @today today's date.  A list property = a value when it holds it.
+// API tokens without the read scope are refused, that is the only read
+// check as pages have no read permissions of their own.
+func queryMacro(reqInfo *RequestInfo, page Page, args []string) ([]byte, error) {
+	if len(args) == 0 || args[0] == "" {
+		return nil, errors.New("use Query(condition, columns=a,b, sort=a)")
+	}
+	if reqInfo == nil || reqInfo.DB == nil {
+		return nil, noWikiErr
+	}
+	if !reqInfo.CanRead() {
+		return nil, errors.New("you may not read pages")
+	}
+	positional, options := macroOptions(args[1:])
+	if len(positional) > 0 {
+		return nil, fmt.Errorf("%s is not an option, the condition cannot hold a comma", positional[0])
+	}
+	condition, names, err := parseQuery(args[0], reqInfo.User, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, 0)
+	if options["columns"] != "" {
+		for _, column := range strings.Split(options["columns"], ",") {
+			column = strings.ToLower(strings.TrimSpace(column))
+			if !propertyNameRe.MatchString(column) {
+				return nil, fmt.Errorf("%s is not a property name", column)
+			}
+			columns = append(columns, column)
+			names[column] = true
+		}
+	}
+	sortBy := strings.ToLower(options["sort"])
+	if sortBy != "" && sortBy != "page" {
+		if !propertyNameRe.MatchString(sortBy) {
+			return nil, fmt.Errorf("%s is not a property name", sortBy)
+		}
+		names[sortBy] = true
+	}
+	descending := false
+	switch options["order"] {
+	case "", "asc":
+	case "desc":
+		descending = true
+	default:
+		return nil, fmt.Errorf("order is asc or desc, not %s", options["order"])
+	}
+	limit := -1
+	if options["limit"] != "" {
+		if limit, err = strconv.Atoi(options["limit"]); err != nil || limit < 0 {
+			return nil, fmt.Errorf("%s is not a page limit", options["limit"])
+		}
+	}
+
+	properties, err := queryProperties(reqInfo.DB, names)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := reqInfo.DB.ListPages()
+	if err != nil {
+		return nil, err
+	}
+	// each row is the page name, the columns and the value to sort by
+	rows := make([][]string, 0)
+	for _, name := range pages {
+		props := properties[name]
+		if !condition.match(props) {
+			continue
+		}
+		row := []string{name}
+		for _, column := range columns {
+			row = append(row, props[column].String())
+		}
+		if sortBy == "" || sortBy == "page" {
+			row = append(row, name)
+		} else {
+			row = append(row, props[sortBy].String())
+		}
+		rows = append(rows, row)
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+	sortTableRows(rows, len(columns)+1, descending)
+	total := len(rows)
+	if limit >= 0 && limit < total {
+		rows = rows[:limit]
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(`<div class="data-table">` + "\n")
+	if total == 0 {
+		buf.WriteString("<p>No pages match " + html.EscapeString(args[0]) + "</p>\n</div>\n")
+		return buf.Bytes(), nil
+	}
+	buf.WriteString("<table>\n<thead>\n<tr><th>Page</th>")
+	for _, column := range columns {
+		buf.WriteString("<th>" + html.EscapeString(column) + "</th>")
+	}
+	buf.WriteString("</tr>\n</thead>\n<tbody>\n")
+	for _, row := range rows {
+		buf.WriteString("<tr><td>" + pageLinkHTML(row[0], row[0]) + "</td>")
+		for _, cell := range row[1 : len(columns)+1] {
+			if isTableNumber(cell) {
+				buf.WriteString(`<td class="number">` + html.EscapeString(cell) + "</td>")
+			} else {
+				buf.WriteString("<td>" + html.EscapeString(cell) + "</td>")
+			}
+		}
+		buf.WriteString("</tr>\n")
+	}
+	buf.WriteString("</tbody>\n</table>\n")
+	if len(rows) < total {
+		buf.WriteString(fmt.Sprintf("<p>Showing %d of %d pages</p>\n", len(rows), total))
+	}
+	buf.WriteString("</div>\n")
+	return buf.Bytes(), nil
+}
+
+// The named properties of every page that sets any of them
+func queryProperties(db DB, names map[string]bool) (map[string]Properties, error) {
+	results := make(map[string]Properties)
+	for name := range names {
+		values, err := db.PagesWithProperty(name)
+		if err != nil {
+			return nil, err
+		}
+		for page, value := range values {
+			if results[page] == nil {
+				results[page] = make(Properties)
+			}
+			results[page][name] = value
+		}
+	}
+	return results, nil
+}
+
+// A condition on the properties of a page
+type queryExpr interface {
+	match(props Properties) bool
+}
+
+type queryAnd struct{ left, right queryExpr }
+type queryOr struct{ left, right queryExpr }
+type queryNot struct{ expr queryExpr }
+
+// The page sets the property
+type queryHas struct{ name string }
+
+// The property compares with value, pages without the property only match !=
+type queryCompare struct {
+	name, op, value string
+}
+
+func (q queryAnd) match(props Properties) bool { return q.left.match(props) && q.right.match(props) }
+func (q queryOr) match(props Properties) bool  { return q.left.match(props) || q.right.match(props) }
+func (q queryNot) match(props Properties) bool { return !q.expr.match(props) }
+
+func (q queryHas) match(props Properties) bool {
+	_, ok := props[q.name]
+	return ok
+}
+
+func (q queryCompare) match(props Properties) bool {
+	prop, ok := props[q.name]
+	if !ok {
+		return q.op == "!="
+	}
+	if prop.Type == PropertyList {
+		found := false
+		for _, item := range prop.List {
+			if strings.EqualFold(item, q.value) {
+				found = true
+			}
+		}
+		switch q.op {
+		case "=":
+			return found
+		case "!=":
+			return !found
+		}
+		return false
+	}
+	c := compareQueryValues(prop.Value, q.value)
+	switch q.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// Numbers compare by value, everything else as text ignoring case, dates
+// are written so they sort as text
+func compareQueryValues(a, b string) int {
+	x, numberA := tableNumber(a)
+	y, numberB := tableNumber(b)
+	if numberA && numberB {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// The parts of a condition, words, quoted text, operators and brackets
+type queryToken struct {
+	text   string
+	quoted bool
+}
+
+var queryOperators = []string{"!=", "<=", ">=", "=", "<", ">"}
+
+func tokenizeQuery(src string) ([]queryToken, error) {
+	tokens := make([]queryToken, 0)
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '(' || c == ')':
+			tokens = append(tokens, queryToken{text: src[i : i+1]})
+			i++
+			continue
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(src[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("%s is never closed", src[i:])
+			}
+			tokens = append(tokens, queryToken{text: src[i+1 : i+1+end], quoted: true})
+			i += end + 2
+			continue
+		}
+		op := ""
+		for _, o := range queryOperators {
+			if strings.HasPrefix(src[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op != "" {
+			tokens = append(tokens, queryToken{text: op})
+			i += len(op)
+			continue
+		}
+		start := i
+		for i < len(src) && !strings.ContainsRune(" \t()\"'=!<>", rune(src[i])) {
+			i++
+		}
+		if i == start {
+			return nil, fmt.Errorf("%s is not understood", src[i:])
+		}
+		tokens = append(tokens, queryToken{text: src[start:i]})
+	}
+	return tokens, nil
+}
+
+// Reads a condition, NOT binds tightest, then AND, then OR
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	user   *UserInfo
+	now    time.Time
+	names  map[string]bool // the properties the condition looks at
+}
+
+// Parse a condition for the user running the query, the names of the
+// properties it looks at are returned with it
+func parseQuery(src string, user *UserInfo, now time.Time) (queryExpr, map[string]bool, error) {
+	tokens, err := tokenizeQuery(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &queryParser{tokens: tokens, user: user, now: now, names: make(map[string]bool)}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, nil, fmt.Errorf("%s is not expected", p.tokens[p.pos].text)
+	}
+	return expr, p.names, nil
+}
+
+// Is the next token the keyword, which can be written in any case
+func (p *queryParser) keyword(word string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = queryOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = queryAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseNot() (queryExpr, error) {
+	if p.keyword("NOT") {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return queryNot{expr}, nil
+	}
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("the condition ends too soon")
+	}
+	if p.tokens[p.pos].text == "(" && !p.tokens[p.pos].quoted {
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].text != ")" {
+			return nil, errors.New("( is never closed with )")
+		}
+		p.pos++
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseComparison() (queryExpr, error) {
+	name := p.tokens[p.pos]
+	if name.quoted || !propertyNameRe.MatchString(name.text) {
+		return nil, fmt.Errorf("%s is not a property name", name.text)
+	}
+	p.pos++
+	property := strings.ToLower(name.text)
+	p.names[property] = true
+	if p.pos >= len(p.tokens) || !isQueryOperator(p.tokens[p.pos]) {
+		return queryHas{property}, nil
+	}
+	op := p.tokens[p.pos].text
+	p.pos++
+	if p.pos >= len(p.tokens) || (!p.tokens[p.pos].quoted && (isQueryOperator(p.tokens[p.pos]) || p.tokens[p.pos].text == "(" || p.tokens[p.pos].text == ")")) {
+		return nil, fmt.Errorf("%s %s needs a value", name.text, op)
+	}
+	value := p.tokens[p.pos]
+	p.pos++
+	if value.quoted || !strings.HasPrefix(value.text, "@") {
+		return queryCompare{property, op, value.text}, nil
+	}
+	switch strings.ToLower(value.text) {
+	case "@me":
+		return queryCompare{property, op, p.user.Username()}, nil
+	case "@today":
+		return queryCompare{property, op, p.now.Format(propertyDateFormat)}, nil
+	}
+	return nil, fmt.Errorf("%s is not a value, use @me or @today", value.text)
+}
+
+func isQueryOperator(token queryToken) bool {
+	if token.quoted {
+		return false
+	}
+	for _, op := range queryOperators {
+		if token.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+// The properties of the current revision of each page, the databases keep
+// one up to date as revisions are added
+type propertyIndex struct {
+	lock  sync.Mutex
+	pages map[string]Properties
+}
+
+func newPropertyIndex() *propertyIndex {
+	return &propertyIndex{pages: make(map[string]Properties)}
+}
+
+// Set the properties of a page, replacing the ones it had
+func (pi *propertyIndex) update(page string, props Properties) {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+
+	if len(props) == 0 {
+		delete(pi.pages, page)
+		return
+	}
+	pi.pages[page] = props
+}
+
+// The value of a property on each page that sets it
+func (pi *propertyIndex) withProperty(name string) map[string]Property {
+	pi.lock.Lock()
+	defer pi.lock.Unlock()
+
+	results := make(map[string]Property)
+	for page, props := range pi.pages {
+		if value, ok := props[name]; ok {
+			results[page] = value
+		}
+	}
+	return results
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	user := &UserInfo{username: "UserOne"}
+	now := time.Date(2024, 3, 7, 10, 0, 0, 0, time.UTC)
+	matches := func(query string, props Properties) bool {
+		expr, _, err := parseQuery(query, user, now)
+		So(err, ShouldBeNil)
+		return expr.match(props)
+	}
+	props := Properties{
+		"status":    {Type: PropertyText, Value: "Open"},
+		"owner":     {Type: PropertyText, Value: "UserOne"},
+		"estimate":  {Type: PropertyNumber, Value: "12"},
+		"review-by": {Type: PropertyDate, Value: "2024-03-01"},
+		"tags":      {Type: PropertyList, List: []string{"design", "api"}},
+	}
+
+	Convey("Conditions compare the properties of a page", t, func() {
+		So(matches("status=open AND owner=@me", props), ShouldBeTrue)
+		So(matches("status = 'closed' OR NOT (owner != UserOne)", props), ShouldBeTrue)
+		So(matches("status=open and not owner=@me", props), ShouldBeFalse)
+		So(matches("estimate > 9 AND estimate <= 12", props), ShouldBeTrue)
+		So(matches("review-by < @today", props), ShouldBeTrue)
+		So(matches("tags=API AND tags!=backend", props), ShouldBeTrue)
+		So(matches("tags>a", props), ShouldBeFalse)
+		So(matches("estimate", props), ShouldBeTrue)
+
+		Convey("and pages without a property only match !=", func() {
+			So(matches("due < 2025-01-01", props), ShouldBeFalse)
+			So(matches("due != 2025-01-01", props), ShouldBeTrue)
+			So(matches("due", props), ShouldBeFalse)
+		})
+	})
+
+	Convey("The properties a condition looks at are returned", t, func() {
+		_, names, err := parseQuery("(Status=open OR due) AND NOT owner=x", user, now)
+		So(err, ShouldBeNil)
+		So(names, ShouldResemble, map[string]bool{"status": true, "due": true, "owner": true})
+	})
+
+	Convey("Bad conditions are reported", t, func() {
+		problem := func(query string) string {
+			_, _, err := parseQuery(query, user, now)
+			So(err, ShouldNotBeNil)
+			return err.Error()
+		}
+		So(problem("status="), ShouldEqual, "status = needs a value")
+		So(problem("status=open AND"), ShouldEqual, "the condition ends too soon")
+		So(problem("(status=open"), ShouldEqual, "( is never closed with )")
+		So(problem("status=open)"), ShouldEqual, ") is not expected")
+		So(problem("status='open"), ShouldEqual, "'open is never closed")
+		So(problem("1st=x"), ShouldEqual, "1st is not a property name")
+		So(problem("owner=@you"), ShouldEqual, "@you is not a value, use @me or @today")
+	})
+}
+
+func TestQueryMacro(t *testing.T) {
+	Convey("Given pages with properties", t, func() {
+		db, _ := newMemDB()
+		for name, src := range map[string]string{
+			"Design":      "---\nstatus: open\nowner: UserOne\ndue: 2024-05-01\nestimate: 3\n---\n# Design",
+			"Api":         "---\nstatus: open\nowner: UserOne\ndue: 2024-04-01\n---\n# Api",
+			"Release":     "---\nstatus: open\nowner: UserTwo\ndue: 2024-01-01\n---\n# Release",
+			"Done":        "---\nstatus: closed\nowner: UserOne\n---\n# Done",
+			"NoFrontPage": "text",
+		} {
+			page, _ := db.GetPage(name)
+			page.AddRevision([]byte(src))
+		}
+		reqInfo := &RequestInfo{DB: db, User: &UserInfo{username: "UserOne"}}
+		query := func(args ...string) string {
+			out, err := queryMacro(reqInfo, nil, args)
+			if err != nil {
+				return "error: " + err.Error()
+			}
+			return string(out)
+		}
+
+		Convey("the pages that match are shown in a table", func() {
+			out := query("status=open AND owner=@me", "columns=owner", "due", "estimate", "sort=due")
+			So(out, ShouldEqual, `<div class="data-table">`+"\n<table>\n<thead>\n<tr><th>Page</th><th>owner</th><th>due</th><th>estimate</th></tr>\n</thead>\n<tbody>\n"+
+				`<tr><td><a href="/Api/">Api</a></td><td>UserOne</td><td>2024-04-01</td><td></td></tr>`+"\n"+
+				`<tr><td><a href="/Design/">Design</a></td><td>UserOne</td><td>2024-05-01</td><td class="number">3</td></tr>`+"\n"+
+				"</tbody>\n</table>\n</div>\n")
+
+			out = string(RenderPage("markdown", []byte("Open work\n\n<<Query(status=open, sort=due, order=desc, limit=2)>>\n"), &RenderContext{PageName: "Report", ReqInfo: reqInfo}))
+			So(out, ShouldStartWith, "<p>Open work</p>\n\n"+`<div class="data-table">`)
+			So(strings.Index(out, "Design"), ShouldBeLessThan, strings.Index(out, "Api"))
+			So(out, ShouldNotContainSubstring, "Release")
+			So(out, ShouldContainSubstring, "<p>Showing 2 of 3 pages</p>")
+			So(query("status=closed OR status=open", "sort=page"), ShouldContainSubstring, `<tr><td><a href="/Api/">Api</a></td></tr>`+"\n"+`<tr><td><a href="/Design/">Design</a></td></tr>`)
+		})
+
+		Convey("pages with new revisions are found by their new properties", func() {
+			page, _ := db.GetPage("Release")
+			page.AddRevision([]byte("---\nstatus: closed\n---\n"))
+			So(query("status=closed", "columns=owner"), ShouldContainSubstring, `<tr><td><a href="/Release/">Release</a></td><td></td></tr>`)
+			So(query("owner=UserTwo"), ShouldEqual, `<div class="data-table">`+"\n<p>No pages match owner=UserTwo</p>\n</div>\n")
+		})
+
+		Convey("readers who may not read pages are refused", func() {
+			reqInfo.User = &UserInfo{username: "UserOne", scopes: []string{ScopeWrite}}
+			So(query("status"), ShouldEqual, "error: you may not read pages")
+		})
+
+		Convey("problems are reported", func() {
+			So(query(), ShouldStartWith, "error: use Query")
+			So(query("status=open", "owner"), ShouldEqual, "error: owner is not an option, the condition cannot hold a comma")
+			So(query("status=open", "columns=a b"), ShouldEqual, "error: a b is not a property name")
+			So(query("status=open", "order=up"), ShouldEqual, "error: order is asc or desc, not up")
+			So(query("status=open", "limit=x"), ShouldEqual, "error: x is not a page limit")
+			_, err := queryMacro(nil, nil, []string{"status=open"})
+			So(err, ShouldEqual, noWikiErr)
+		})
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how many requests between sweeps for idle buckets
+	rateLimitSweep = 1000
+)
+
+// A token bucket rate, Rate tokens are added per second up to Burst
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A token bucket rate limiter with one bucket per key.  A nil
+// *rateLimiter allows everything.
+type rateLimiter struct {
+	lock     sync.Mutex
+	limit    RateLimit
+	buckets  map[string]*tokenBucket
+	requests int
+	now      func() time.Time
+}
+
+// ParseRateLimit reads a limit of the form "count/unit" or "count/unit,burst"
+// where unit is one of s, m or h, ie "30/m" or "30/m,5".  The burst defaults to
+// count.  An empty string or "off" means no limit and returns nil.
+func ParseRateLimit(value string) (*RateLimit, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "off" {
+		return nil, nil
+	}
+	burstPart := ""
+	if i := strings.Index(value, ","); i >= 0 {
+		value, burstPart = value[:i], strings.TrimSpace(value[i+1:])
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Rate limits must be of the form count/unit")
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || count <= 0 {
+		return nil, errors.New("Invalid rate limit count " + parts[0])
+	}
+	var period time.Duration
+	switch strings.TrimSpace(parts[1]) {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		return nil, errors.New("Invalid rate limit unit " + parts[1])
+	}
+	limit := &RateLimit{Rate: float64(count) / period.Seconds(), Burst: count}
+	if burstPart != "" {
+		if limit.Burst, err = strconv.Atoi(burstPart); err != nil || limit.Burst <= 0 {
+			return nil, errors.New("Invalid rate limit burst " + burstPart)
+		}
+	}
+	return limit, nil
+}
+
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	if limit == nil {
+		return nil
+	}
+	return &rateLimiter{limit: *limit, buckets: make(map[string]*tokenBucket), now: time.Now}
+}
+
+// Take a token from the bucket of each key, either all of them or none.
+// If a bucket is empty the time until each has a token is returned.
+func (rl *rateLimiter) Allow(keys ...string) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := rl.now()
+	rl.requests++
+	if rl.requests%rateLimitSweep == 0 {
+		rl.sweep(now)
+	}
+
+	buckets := make([]*tokenBucket, len(keys))
+	var wait time.Duration
+	for i, key := range keys {
+		b, ok := rl.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(rl.limit.Burst), last: now}
+			rl.buckets[key] = b
+		}
+		b.tokens = math.Min(float64(rl.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*rl.limit.Rate)
+		b.last = now
+		if b.tokens < 1 {
+			wait = time.Duration(math.Max(float64(wait), (1-b.tokens)/rl.limit.Rate*float64(time.Second)))
+		}
+		buckets[i] = b
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// forget buckets that have refilled, they are the same as a new bucket
+func (rl *rateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.limit.Rate >= float64(rl.limit.Burst) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// The keys a request is limited by, every request is limited per address
+// and those of logged in users per user as well
+func rateLimitKeys(r *http.Request) []string {
+	keys := []string{"ip:" + remoteHost(r)}
+	if user := CurUser(r); !user.IsAnonymous() {
+		keys = append(keys, "user:"+user.Username())
+	}
+	return keys
+}
+
+// The RateLimitMiddleware refuses requests over the limit with a 429 and
+// a Retry-After header.  It must run after the user has been determined.
+func NewRateLimitMiddleware(limiter *rateLimiter, next http.Handler) http.Handler {
+	var f http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := limiter.Allow(rateLimitKeys(r)...); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return f
+}
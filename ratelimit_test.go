@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	Convey("Rate limits are parsed as count/unit with an optional burst", t, func() {
+		limit, err := ParseRateLimit("30/m")
+		So(err, ShouldBeNil)
+		So(limit.Rate, ShouldEqual, 0.5)
+		So(limit.Burst, ShouldEqual, 30)
+
+		limit, err = ParseRateLimit("2/s,5")
+		So(err, ShouldBeNil)
+		So(limit.Rate, ShouldEqual, 2)
+		So(limit.Burst, ShouldEqual, 5)
+
+		limit, err = ParseRateLimit("off")
+		So(err, ShouldBeNil)
+		So(limit, ShouldBeNil)
+
+		Convey("Invalid limits are rejected", func() {
+			for _, value := range []string{"30", "x/m", "0/m", "30/d", "30/m,0"} {
+				_, err = ParseRateLimit(value)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	Convey("A rate limiter allows a burst and then refills at the rate", t, func() {
+		now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		rl := newRateLimiter(&RateLimit{Rate: 1, Burst: 2})
+		rl.now = func() time.Time { return now }
+
+		ok, _ := rl.Allow("a")
+		So(ok, ShouldBeTrue)
+		ok, _ = rl.Allow("a")
+		So(ok, ShouldBeTrue)
+		ok, wait := rl.Allow("a")
+		So(ok, ShouldBeFalse)
+		So(wait, ShouldEqual, time.Second)
+
+		Convey("Other keys have their own bucket", func() {
+			ok, _ := rl.Allow("b")
+			So(ok, ShouldBeTrue)
+		})
+		Convey("Several keys are allowed together or not at all", func() {
+			ok, wait := rl.Allow("c", "a")
+			So(ok, ShouldBeFalse)
+			So(wait, ShouldEqual, time.Second)
+			ok, _ = rl.Allow("c", "d")
+			So(ok, ShouldBeTrue)
+			ok, _ = rl.Allow("c")
+			So(ok, ShouldBeTrue)
+			ok, _ = rl.Allow("c")
+			So(ok, ShouldBeFalse)
+		})
+		Convey("Tokens come back over time", func() {
+			now = now.Add(500 * time.Millisecond)
+			ok, wait := rl.Allow("a")
+			So(ok, ShouldBeFalse)
+			So(wait, ShouldEqual, 500*time.Millisecond)
+			now = now.Add(500 * time.Millisecond)
+			ok, _ = rl.Allow("a")
+			So(ok, ShouldBeTrue)
+		})
+	})
+	Convey("A nil rate limiter allows everything", t, func() {
+		var rl *rateLimiter
+		ok, _ := rl.Allow("a")
+		So(ok, ShouldBeTrue)
+		So(newRateLimiter(nil), ShouldBeNil)
+	})
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	var okHandler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {}
+
+	request := func(m http.Handler, addr string, user *UserInfo) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/edit/PageOne/", nil)
+		req.RemoteAddr = addr
+		if user != nil {
+			context.Set(req, keyUser, user)
+		}
+		m.ServeHTTP(record, req)
+		context.Clear(req)
+		return record
+	}
+
+	Convey("Requests over the limit get a 429 with Retry-After", t, func() {
+		m := NewRateLimitMiddleware(newRateLimiter(&RateLimit{Rate: 1.0 / 60, Burst: 1}), okHandler)
+		So(request(m, "10.0.0.1:1000", nil).Code, ShouldEqual, http.StatusOK)
+		record := request(m, "10.0.0.1:1001", nil)
+		So(record.Code, ShouldEqual, http.StatusTooManyRequests)
+		So(record.Header().Get("Retry-After"), ShouldEqual, "60")
+
+		Convey("Other addresses are limited separately", func() {
+			So(request(m, "10.0.0.2:1000", nil).Code, ShouldEqual, http.StatusOK)
+		})
+		Convey("Logged in users are limited per user and per address", func() {
+			user := &UserInfo{username: "UserOne"}
+			So(request(m, "10.0.0.3:1000", user).Code, ShouldEqual, http.StatusOK)
+			So(request(m, "10.0.0.4:1000", user).Code, ShouldEqual, http.StatusTooManyRequests)
+			So(request(m, "10.0.0.1:1002", &UserInfo{username: "UserTwo"}).Code, ShouldEqual, http.StatusTooManyRequests)
+
+			Convey("and a refused request uses up neither limit", func() {
+				So(request(m, "10.0.0.4:1001", nil).Code, ShouldEqual, http.StatusOK)
+				So(request(m, "10.0.0.5:1000", &UserInfo{username: "UserTwo"}).Code, ShouldEqual, http.StatusOK)
+			})
+		})
+	})
+}
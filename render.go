@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+const DefaultFormat = "markdown"
+
+var unknownFormatErr = errors.New("Unknown page format")
+
+// Everything a renderer may need to know about the page being rendered
+type RenderContext struct {
+	PageName  string
+	Page      Page
+	ReqInfo   *RequestInfo
+	Including []string // the pages that included this one, outermost first
+	Tasks     bool     // task list items can be ticked by the reader, see ToggleTaskHandler
+	FirstLine int      // the line of the page source being rendered the source starts at, front matter is skipped
+}
+
+// A Renderer turns the source of a page in one markup language into HTML.
+// Each renderer decides how WikiWords and links to other pages are found.
+type Renderer interface {
+	Name() string  // the name pages use to select the format, ie "markdown"
+	Label() string // a name to show people, ie "Markdown"
+	Render(src []byte, ctx *RenderContext) []byte
+}
+
+// Renderers that can point out problems in a page source implement this,
+// the problems are shown on the edit page
+type SourceChecker interface {
+	Check(src []byte) []LexWarning
+}
+
+// Renderers that can find a section of a page by its heading implement
+// this, {{Include(Page#Section)}} uses it to include part of a page
+type SectionFinder interface {
+	Section(src []byte, heading string) ([]byte, bool)
+}
+
+// Renderers that show task list items as checkboxes implement this, the
+// pattern matches a line of the page source that is a task, see taskLines
+type TaskRenderer interface {
+	TaskPattern() *regexp.Regexp
+}
+
+var renderersLock sync.Mutex
+var renderers = make(map[string]Renderer)
+
+func init() {
+	RegisterRenderer(markdownRenderer{})
+	RegisterRenderer(plainRenderer{})
+	RegisterRenderer(moinRenderer)
+	RegisterRenderer(creoleRenderer)
+}
+
+// Make a format available to pages, it replaces any renderer of the same name
+func RegisterRenderer(r Renderer) {
+	renderersLock.Lock()
+	defer renderersLock.Unlock()
+
+	renderers[r.Name()] = r
+}
+
+// Find the renderer for a format, "" is the default format
+func GetRenderer(format string) (Renderer, error) {
+	if format == "" {
+		format = DefaultFormat
+	}
+	renderersLock.Lock()
+	defer renderersLock.Unlock()
+
+	if r, ok := renderers[format]; ok {
+		return r, nil
+	}
+	return nil, unknownFormatErr
+}
+
+// All of the registered renderers sorted by name
+func Renderers() []Renderer {
+	renderersLock.Lock()
+	defer renderersLock.Unlock()
+
+	results := make([]Renderer, 0, len(renderers))
+	for _, r := range renderers {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name() < results[j].Name() })
+	return results
+}
+
+// Render a page source in the given format, unknown formats are shown as
+// plain text.  The front matter of the page is not shown.
+func RenderPage(format string, src []byte, ctx *RenderContext) []byte {
+	r, err := GetRenderer(format)
+	if err != nil {
+		r = plainRenderer{}
+	}
+	if lines := frontMatterLines(src); lines > 0 {
+		body := *ctx
+		body.FirstLine += lines
+		src, ctx = stripFrontMatter(src), &body
+	}
+	return fillTableOfContents(addHeadingIds(r.Render(src, ctx)))
+}
+
+// Markdown, with WikiWords and [[Free Links]] expanded by the Lexer and
+// fenced code blocks highlighted
+type markdownRenderer struct{}
+
+func (markdownRenderer) Name() string  { return "markdown" }
+func (markdownRenderer) Label() string { return "Markdown" }
+
+func (markdownRenderer) TaskPattern() *regexp.Regexp { return taskRe }
+
+func (markdownRenderer) Render(src []byte, ctx *RenderContext) []byte {
+	buf := &bytes.Buffer{}
+
+	// macros and math are rendered to HTML markdown must not change
+	macros := newMacroOutput()
+	src = markdownTasks(src, ctx, macros)
+	buf.Write(expandPageSource(src, ctx, func(out *bytes.Buffer, item LexedItem) {
+		if item.Type == TokenMath {
+			out.WriteString(macros.placeholder(mathHTML(item.Value)))
+		} else if html, ok := renderMacro(item.Value, ctx); ok {
+			out.WriteString(macros.placeholder(html))
+		} else {
+			out.Write(item.Value)
+		}
+	}))
+	return macros.substitute(renderMarkdown(buf.Bytes()))
+}
+
+// The section starts at a # or underlined heading and runs to the next
+// heading of the same or a higher level
+func (markdownRenderer) Section(src []byte, heading string) ([]byte, bool) {
+	lines := bytes.SplitAfter(src, []byte("\n"))
+	start, startLevel := -1, 0
+	inFence := false
+	for i, line := range lines {
+		trimmed := bytes.TrimSpace(line)
+		if bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~")) {
+			inFence = !inFence
+		}
+		if inFence {
+			continue
+		}
+		level, text := markdownHeading(lines, i)
+		if level == 0 {
+			continue
+		}
+		if start >= 0 && level <= startLevel {
+			return bytes.Join(lines[start:i], nil), true
+		}
+		if start < 0 && headingSlug(text) == headingSlug(heading) {
+			start, startLevel = i, level
+		}
+	}
+	if start < 0 {
+		return nil, false
+	}
+	return bytes.Join(lines[start:], nil), true
+}
+
+// The level and text of the heading starting at lines[i], level is 0 if
+// there is not one
+func markdownHeading(lines [][]byte, i int) (int, string) {
+	line := bytes.TrimSpace(lines[i])
+	if level := runLength(line, '#'); level > 0 && level <= 6 {
+		if level < len(line) && line[level] != ' ' {
+			return 0, ""
+		}
+		return level, string(bytes.TrimSpace(bytes.TrimRight(line[level:], "#")))
+	}
+	if len(line) == 0 || i+1 >= len(lines) {
+		return 0, ""
+	}
+	next := bytes.TrimSpace(lines[i+1])
+	switch {
+	case len(next) > 0 && runLength(next, '=') == len(next):
+		return 1, string(line)
+	case len(next) > 0 && runLength(next, '-') == len(next):
+		return 2, string(line)
+	}
+	return 0, ""
+}
+
+func (markdownRenderer) Check(src []byte) []LexWarning {
+	return CheckPageSource(src)
+}
+
+// Plain text, shown exactly as it was written
+type plainRenderer struct{}
+
+func (plainRenderer) Name() string  { return "plain" }
+func (plainRenderer) Label() string { return "Plain text" }
+
+func (plainRenderer) Render(src []byte, ctx *RenderContext) []byte {
+	return []byte("<pre>" + html.EscapeString(string(src)) + "</pre>\n")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestRendererRegistry(t *testing.T) {
+	Convey("The built in formats are registered", t, func() {
+		names := make([]string, 0)
+		for _, r := range Renderers() {
+			names = append(names, r.Name())
+		}
+		So(names, ShouldResemble, []string{"creole", "markdown", "moin", "plain"})
+
+		r, err := GetRenderer("")
+		So(err, ShouldBeNil)
+		So(r.Name(), ShouldEqual, DefaultFormat)
+		_, err = GetRenderer("nosuchformat")
+		So(err, ShouldEqual, unknownFormatErr)
+
+		Convey("Unknown formats are rendered as plain text", func() {
+			out := string(RenderPage("nosuchformat", []byte("<b>WikiWord</b>"), &RenderContext{PageName: "PageOne"}))
+			So(out, ShouldEqual, "<pre>&lt;b&gt;WikiWord&lt;/b&gt;</pre>\n")
+		})
+	})
+}
+
+func TestMarkdownRenderer(t *testing.T) {
+	Convey("Markdown expands WikiWords and references attachments", t, func() {
+		db, _ := newMemDB()
+		page, _ := db.GetPage("ProjectX/Notes")
+		page.AddAttachment(strings.NewReader("data"), "diagram.png")
+
+		out := string(RenderPage("markdown", []byte("See OtherPage and [[../Plan]] ![x](attachment:diagram.png)"), &RenderContext{PageName: "ProjectX/Notes", Page: page}))
+		So(out, ShouldContainSubstring, `<a href="/OtherPage/">OtherPage</a>`)
+		So(out, ShouldContainSubstring, `<a href="/ProjectX/Plan/">../Plan</a>`)
+		So(out, ShouldContainSubstring, `<img src="/ProjectX/Notes/diagram.png" alt="x" />`)
+		out = string(RenderPage("markdown", []byte("[diagram.png] is not a reference"), &RenderContext{PageName: "ProjectX/Notes", Page: page}))
+		So(out, ShouldEqual, "<p>[diagram.png] is not a reference</p>\n")
+
+		Convey("and can check the page source", func() {
+			r, _ := GetRenderer("markdown")
+			checker, ok := r.(SourceChecker)
+			So(ok, ShouldBeTrue)
+			So(len(checker.Check([]byte("[unclosed"))), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"github.com/microcosm-cc/bluemonday"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// elements that can run code or change the page around them, they cannot be
+// allowed even by the configuration
+var unsafeElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"iframe":   true,
+	"frame":    true,
+	"frameset": true,
+	"object":   true,
+	"embed":    true,
+	"applet":   true,
+	"base":     true,
+	"link":     true,
+	"meta":     true,
+	"form":     true,
+}
+
+// The policy rendered pages are cleaned with
+var sanitizer = newSanitizerPolicy()
+
+// class names the wiki uses on the HTML it generates, ie for included pages,
+// interwiki links, highlighted code, tasks and tables
+var classNames = regexp.MustCompile("^[a-zA-Z0-9_ -]+$")
+
+var headingIds = regexp.MustCompile(`^[\p{L}\p{N}_-]+$`)
+
+// the only buttons pages may have are task list checkboxes
+var (
+	taskButtonType     = regexp.MustCompile("^submit$")
+	taskButtonName     = regexp.MustCompile("^task$")
+	taskButtonValue    = regexp.MustCompile("^[0-9]+$")
+	taskButtonDisabled = regexp.MustCompile("^(disabled)?$")
+)
+
+// the MathML elements formulas are rendered with
+var mathElements = []string{"math", "mrow", "mi", "mn", "mo", "mtext", "mspace", "msub", "msup", "msubsup",
+	"munder", "mover", "munderover", "mfrac", "msqrt", "mroot", "mtable", "mtr", "mtd", "merror"}
+
+// values of the MathML presentation attributes, ie block, bold or 0.167em
+var mathValues = regexp.MustCompile("^[a-z0-9. -]+$")
+
+// The default allowlist keeps text formatting, links, lists, tables,
+// images and formulas.  Scripts, event handlers, styles and javascript: URLs
+// are removed.
+func newSanitizerPolicy() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(classNames).OnElements("a", "div", "span", "pre", "code", "button", "td")
+	// heading ids are made from the heading text, which may be in any language
+	policy.AllowAttrs("id").Matching(headingIds).OnElements("h1", "h2", "h3", "h4", "h5", "h6")
+	// task list checkboxes, the page is put in a form when they can be ticked
+	policy.AllowAttrs("type").Matching(taskButtonType).OnElements("button")
+	policy.AllowAttrs("name").Matching(taskButtonName).OnElements("button")
+	policy.AllowAttrs("value").Matching(taskButtonValue).OnElements("button")
+	policy.AllowAttrs("title").OnElements("button")
+	policy.AllowAttrs("disabled").Matching(taskButtonDisabled).OnElements("button")
+	// most MathML elements have no attributes, which would otherwise drop them
+	policy.AllowNoAttrs().OnElements(mathElements...)
+	policy.AllowAttrs("display", "alttext").OnElements("math")
+	policy.AllowAttrs("mathvariant").Matching(mathValues).OnElements("mi")
+	policy.AllowAttrs("fence").Matching(mathValues).OnElements("mo")
+	policy.AllowAttrs("accent").Matching(mathValues).OnElements("mover")
+	policy.AllowAttrs("accentunder").Matching(mathValues).OnElements("munder")
+	policy.AllowAttrs("width").Matching(mathValues).OnElements("mspace")
+	policy.AllowAttrs("linethickness").Matching(mathValues).OnElements("mfrac")
+	policy.AllowAttrs("columnalign").Matching(mathValues).OnElements("mtable")
+	return policy
+}
+
+func newFileSanitizer(fname string) (*bluemonday.Policy, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return newSanitizer(f)
+}
+
+// Build a policy from the default allowlist plus the extra elements in
+// input.  Each line is an element followed by the attributes it may have,
+// ie "abbr title".  Blank lines and lines starting with # are ignored.
+func newSanitizer(input io.Reader) (*bluemonday.Policy, error) {
+	policy := newSanitizerPolicy()
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(strings.ToLower(line))
+		element, attrs := fields[0], fields[1:]
+		if unsafeElements[element] {
+			return nil, errors.New("The " + element + " element cannot be allowed in pages")
+		}
+		for _, attr := range attrs {
+			if strings.HasPrefix(attr, "on") || attr == "style" {
+				return nil, errors.New("The " + attr + " attribute cannot be allowed in pages")
+			}
+		}
+		policy.AllowElements(element)
+		if len(attrs) > 0 {
+			policy.AllowAttrs(attrs...).OnElements(element)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Clean rendered HTML so it is safe to show to readers
+func SanitizeHTML(input []byte) []byte {
+	return sanitizer.SanitizeBytes(input)
+}
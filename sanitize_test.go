@@ -0,0 +1,78 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	Convey("Common XSS payloads are removed", t, func() {
+		payloads := []string{
+			`<script>alert(1)</script>`,
+			`<img src="x" onerror="alert(1)">`,
+			`<a href="javascript:alert(1)">x</a>`,
+			`<a href="JaVaScRiPt:alert(1)">x</a>`,
+			`<a href="&#106;avascript:alert(1)">x</a>`,
+			`<a href=" javascript:alert(1)">x</a>`,
+			`<svg onload="alert(1)"></svg>`,
+			`<body onload="alert(1)">`,
+			`<iframe src="http://evil.example.com/"></iframe>`,
+			`<object data="evil.swf"></object>`,
+			`<div style="background:url(javascript:alert(1))">x</div>`,
+			`<img src="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">`,
+			`<form action="http://evil.example.com/"><input name="password"></form>`,
+			`<math><a xlink:href="javascript:alert(1)">x</a></math>`,
+			`<<script>script>alert(1)<</script>/script>`,
+		}
+		for _, payload := range payloads {
+			out := strings.ToLower(string(SanitizeHTML([]byte(payload))))
+			So(out, ShouldNotContainSubstring, "<script")
+			So(out, ShouldNotContainSubstring, "javascript:")
+			So(out, ShouldNotContainSubstring, "onerror")
+			So(out, ShouldNotContainSubstring, "onload")
+			So(out, ShouldNotContainSubstring, "<iframe")
+			So(out, ShouldNotContainSubstring, "<object")
+			So(out, ShouldNotContainSubstring, "style=")
+			So(out, ShouldNotContainSubstring, "data:")
+			So(out, ShouldNotContainSubstring, "<form")
+		}
+
+		Convey("Links in markdown are cleaned too", func() {
+			out := string(SanitizeHTML(RenderPage("markdown", []byte("[x](javascript:alert(1)) <script>alert(1)</script>"), &RenderContext{PageName: "PageOne"})))
+			So(out, ShouldNotContainSubstring, "javascript:")
+			So(out, ShouldNotContainSubstring, "<script")
+		})
+	})
+
+	Convey("Safe formatting is kept", t, func() {
+		safe := []string{
+			`<p><strong>bold</strong> <em>italic</em> <code>code</code></p>`,
+			`<h2>Heading</h2>`,
+			`<table><thead><tr><th>a</th></tr></thead><tbody><tr><td>b</td></tr></tbody></table>`,
+			`<ul><li>one</li></ul>`,
+			`<img src="/PageOne/diagram.png" alt="diagram"/>`,
+			`<a href="/OtherPage/" rel="nofollow">OtherPage</a>`,
+			`<pre>x &lt; 1</pre>`,
+		}
+		for _, html := range safe {
+			So(string(SanitizeHTML([]byte(html))), ShouldEqual, html)
+		}
+	})
+}
+
+func TestSanitizerConfig(t *testing.T) {
+	Convey("Extra elements can be allowed", t, func() {
+		policy, err := newSanitizer(strings.NewReader("# extras\n\nabbr title\ncenter\n"))
+		So(err, ShouldBeNil)
+		So(policy.Sanitize(`<abbr title="HyperText">HTML</abbr> <center>hi</center>`), ShouldEqual, `<abbr title="HyperText">HTML</abbr> <center>hi</center>`)
+		So(newSanitizerPolicy().Sanitize(`<center>hi</center>`), ShouldEqual, "hi")
+
+		Convey("but not unsafe ones", func() {
+			for _, config := range []string{"script", "iframe src", "img onerror", "p style"} {
+				_, err := newSanitizer(strings.NewReader(config))
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Larger attachments are refused by the Table macro
+const maxTableRows = 10000
+
+// <<Table(attachment:results.csv)>> shows a CSV or TSV attachment as a
+// table.  Options follow the attachment, ie
+// <<Table(attachment:results.csv, columns=Name,Time, limit=20, sort=Time, order=desc, header=yes)>>
+//
+//   - header is yes, no or auto, by default the first row is a header when
+//     it looks like one
+//   - columns picks the columns to show by name or number, counting from 1
+//   - limit is the most rows to show
+//   - sort and order sort the rows by a column, ascending or descending
+//
+// Readers sort the table by its column headings, the table, sort, order and
+// limit query parameters override the options of the table they name.  A
+// reader's values that are not valid are ignored, only the options written
+// in the page are reported as errors.
+func tableMacro(reqInfo *RequestInfo, page Page, args []string) ([]byte, error) {
+	positional, options := macroOptions(args)
+	if len(positional) != 1 || !strings.HasPrefix(positional[0], attachmentPrefix) {
+		return nil, errors.New("use Table(attachment:name.csv, options)")
+	}
+	if page == nil {
+		return nil, errors.New("there is no page")
+	}
+	target := positional[0]
+	rows, err := readTableAttachment(&RenderContext{PageName: page.Name(), Page: page, ReqInfo: reqInfo}, target)
+	if err != nil {
+		return nil, err
+	}
+
+	table := strings.TrimPrefix(target, attachmentPrefix)
+	query := url.Values{}
+	if reqInfo != nil && reqInfo.Query != nil {
+		query = reqInfo.Query
+	}
+
+	header := false
+	switch options["header"] {
+	case "", "auto":
+		header = detectTableHeader(rows)
+	case "yes":
+		header = true
+	case "no":
+	default:
+		return nil, fmt.Errorf("header is yes, no or auto, not %s", options["header"])
+	}
+	var names []string
+	if header && len(rows) > 0 {
+		names, rows = rows[0], rows[1:]
+	}
+	width := 0
+	for _, row := range rows {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+	if len(names) > width {
+		width = len(names)
+	}
+	for i := len(names); i < width; i++ {
+		names = append(names, "Column "+strconv.Itoa(i+1))
+	}
+
+	columns := make([]int, 0, width)
+	if options["columns"] == "" {
+		for i := 0; i < width; i++ {
+			columns = append(columns, i)
+		}
+	} else {
+		for _, name := range strings.Split(options["columns"], ",") {
+			column, ok := tableColumn(names, strings.TrimSpace(name))
+			if !ok {
+				return nil, fmt.Errorf("%s has no column %s", table, name)
+			}
+			columns = append(columns, column)
+		}
+	}
+
+	sortColumn, descending := -1, false
+	if options["sort"] != "" {
+		column, ok := tableColumn(names, options["sort"])
+		if !ok {
+			return nil, fmt.Errorf("%s has no column %s", table, options["sort"])
+		}
+		sortColumn = column
+	}
+	switch options["order"] {
+	case "", "asc":
+	case "desc":
+		descending = true
+	default:
+		return nil, fmt.Errorf("order is asc or desc, not %s", options["order"])
+	}
+	limit, ok := tableLimit(options["limit"], len(rows))
+	if !ok {
+		return nil, fmt.Errorf("%s is not a row limit", options["limit"])
+	}
+
+	// the reader's choices for this table
+	if query.Get("table") == table {
+		if value := query.Get("sort"); value != "" {
+			if column, ok := tableColumn(names, value); ok {
+				sortColumn = column
+			}
+		}
+		if order := query.Get("order"); order == "asc" || order == "desc" {
+			descending = order == "desc"
+		}
+		if value := query.Get("limit"); value != "" {
+			if readerLimit, ok := tableLimit(value, len(rows)); ok {
+				limit = readerLimit
+			}
+		}
+	}
+	if sortColumn >= 0 {
+		sortTableRows(rows, sortColumn, descending)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(`<div class="data-table">` + "\n<table>\n<thead>\n<tr>")
+	for _, column := range columns {
+		order := "asc"
+		label := html.EscapeString(names[column])
+		if column == sortColumn {
+			if descending {
+				label += " ▼"
+			} else {
+				order, label = "desc", label+" ▲"
+			}
+		}
+		href := tableQuery(query, table, map[string]string{"sort": names[column], "order": order})
+		buf.WriteString(`<th><a href="` + html.EscapeString(href) + `">` + label + "</a></th>")
+	}
+	buf.WriteString("</tr>\n</thead>\n<tbody>\n")
+	for _, row := range rows[:limit] {
+		buf.WriteString("<tr>")
+		for _, column := range columns {
+			cell := ""
+			if column < len(row) {
+				cell = row[column]
+			}
+			if isTableNumber(cell) {
+				buf.WriteString(`<td class="number">` + html.EscapeString(cell) + "</td>")
+			} else {
+				buf.WriteString("<td>" + html.EscapeString(cell) + "</td>")
+			}
+		}
+		buf.WriteString("</tr>\n")
+	}
+	buf.WriteString("</tbody>\n</table>\n")
+	if limit < len(rows) {
+		href := tableQuery(query, table, map[string]string{"limit": "all"})
+		buf.WriteString(fmt.Sprintf(`<p>Showing %d of %d rows, <a href="%s">show all</a></p>`+"\n", limit, len(rows), html.EscapeString(href)))
+	}
+	buf.WriteString("</div>\n")
+	return buf.Bytes(), nil
+}
+
+// Read the rows of a CSV attachment, or a TSV one if it is named .tsv or .tab
+func readTableAttachment(ctx *RenderContext, target string) ([][]string, error) {
+	pageName, name, exists, err := resolveAttachment(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("there is no attachment %s", strings.TrimPrefix(target, attachmentPrefix))
+	}
+	page := ctx.Page
+	if pageName != ctx.PageName {
+		if ctx.ReqInfo == nil || ctx.ReqInfo.DB == nil {
+			return nil, noWikiErr
+		}
+		if page, err = ctx.ReqInfo.DB.GetPage(pageName); err != nil {
+			return nil, err
+		}
+	}
+	attachment, err := page.GetAttachment(name)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := attachment.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	reader := csv.NewReader(stream)
+	switch strings.ToLower(path.Ext(name)) {
+	case ".tsv", ".tab":
+		reader.Comma = '\t'
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	rows := make([][]string, 0)
+	for {
+		row, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				return rows, nil
+			}
+			return nil, fmt.Errorf("%s cannot be read: %s", name, err)
+		}
+		if len(rows) == maxTableRows {
+			return nil, fmt.Errorf("%s has more than %d rows", name, maxTableRows)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// The first row is taken to be a header when its cells are all different
+// and none of them are empty or numbers
+func detectTableHeader(rows [][]string) bool {
+	if len(rows) < 2 {
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, cell := range rows[0] {
+		cell = strings.TrimSpace(cell)
+		if cell == "" || isTableNumber(cell) || seen[cell] {
+			return false
+		}
+		seen[cell] = true
+	}
+	return true
+}
+
+// Find a column by its name or number, counting from 1
+func tableColumn(names []string, column string) (int, bool) {
+	for i, name := range names {
+		if name == column {
+			return i, true
+		}
+	}
+	if n, err := strconv.Atoi(column); err == nil && n >= 1 && n <= len(names) {
+		return n - 1, true
+	}
+	return 0, false
+}
+
+// The number of rows a limit option allows out of count, "" and all allow
+// every row
+func tableLimit(value string, count int) (int, bool) {
+	if value == "" || value == "all" {
+		return count, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, false
+	}
+	if limit > count {
+		limit = count
+	}
+	return limit, true
+}
+
+// The value of a cell holding a number, words such as NaN are not numbers
+func tableNumber(cell string) (float64, bool) {
+	cell = strings.TrimSpace(cell)
+	if !strings.ContainsAny(cell, "0123456789") {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(cell, 64)
+	return value, err == nil
+}
+
+func isTableNumber(cell string) bool {
+	_, ok := tableNumber(cell)
+	return ok
+}
+
+// Numbers sort by value and before text, text sorts ignoring case
+func sortTableRows(rows [][]string, column int, descending bool) {
+	cell := func(row []string) string {
+		if column < len(row) {
+			return strings.TrimSpace(row[column])
+		}
+		return ""
+	}
+	less := func(a, b string) bool {
+		x, numberX := tableNumber(a)
+		y, numberY := tableNumber(b)
+		switch {
+		case numberX && numberY:
+			return x < y
+		case numberX || numberY:
+			return numberX
+		}
+		return strings.ToLower(a) < strings.ToLower(b)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if descending {
+			return less(cell(rows[j]), cell(rows[i]))
+		}
+		return less(cell(rows[i]), cell(rows[j]))
+	})
+}
+
+// A link to the page being shown with the given choices for a table, the
+// rest of the query, ie the revision, is kept
+func tableQuery(query url.Values, table string, set map[string]string) string {
+	values := url.Values{}
+	for key, value := range query {
+		values[key] = value
+	}
+	if query.Get("table") != table {
+		values.Del("sort")
+		values.Del("order")
+		values.Del("limit")
+	}
+	values.Set("table", table)
+	for key, value := range set {
+		values.Set(key, value)
+	}
+	return "?" + values.Encode()
+}
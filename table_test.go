@@ -0,0 +1,111 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testResultsCSV = `Name,Time,Status
+beta,12.5,ok
+alpha,3,failed
+"gamma, the third",100,ok
+`
+
+func TestMacroOptions(t *testing.T) {
+	Convey("Macro arguments are split into positional arguments and options", t, func() {
+		positional, options := macroOptions([]string{"attachment:a.csv", "columns=Name", "Time", "limit=5"})
+		So(positional, ShouldResemble, []string{"attachment:a.csv"})
+		So(options, ShouldResemble, map[string]string{"columns": "Name,Time", "limit": "5"})
+	})
+}
+
+func TestTableMacro(t *testing.T) {
+	Convey("Given a page with data attachments", t, func() {
+		db, _ := newMemDB()
+		page, _ := db.GetPage("PageOne")
+		page.AddRevision([]byte("text"))
+		page.AddAttachment(strings.NewReader(testResultsCSV), "results.csv")
+		page.AddAttachment(strings.NewReader("1\t2\n3\t4\n"), "numbers.tsv")
+		other, _ := db.GetPage("Data")
+		other.AddRevision([]byte("text"))
+		other.AddAttachment(strings.NewReader("a;b\n"), "odd.csv")
+		reqInfo := &RequestInfo{DB: db, Query: url.Values{}}
+		table := func(args ...string) string {
+			out, err := tableMacro(reqInfo, page, args)
+			if err != nil {
+				return "error: " + err.Error()
+			}
+			return string(out)
+		}
+
+		Convey("A CSV attachment is shown as a table with its header", func() {
+			out := table("attachment:results.csv")
+			So(out, ShouldStartWith, `<div class="data-table">`+"\n<table>\n<thead>\n<tr>"+
+				`<th><a href="?order=asc&amp;sort=Name&amp;table=results.csv">Name</a></th>`)
+			So(out, ShouldContainSubstring, "<tr><td>beta</td><td class=\"number\">12.5</td><td>ok</td></tr>\n")
+			So(out, ShouldContainSubstring, "<td>gamma, the third</td>")
+			So(strings.Count(out, "<tr>"), ShouldEqual, 4)
+
+			out = string(RenderPage("markdown", []byte("Results\n\n<<Table(attachment:results.csv, columns=Status,1)>>\n"), &RenderContext{PageName: "PageOne", Page: page, ReqInfo: reqInfo}))
+			So(out, ShouldStartWith, "<p>Results</p>\n\n"+`<div class="data-table">`)
+			So(out, ShouldContainSubstring, "<tr><td>ok</td><td>beta</td></tr>")
+			So(string(SanitizeHTML([]byte(table("attachment:results.csv")))), ShouldContainSubstring, `<td class="number">12.5</td>`)
+		})
+
+		Convey("Headers are detected", func() {
+			out := table("attachment:numbers.tsv")
+			So(out, ShouldContainSubstring, `>Column 1</a></th>`)
+			So(out, ShouldContainSubstring, `<tr><td class="number">1</td><td class="number">2</td></tr>`)
+			out = table("attachment:results.csv", "header=no")
+			So(out, ShouldContainSubstring, "<tr><td>Name</td><td>Time</td><td>Status</td></tr>")
+			out = table("attachment:numbers.tsv", "header=yes")
+			So(out, ShouldContainSubstring, `>1</a></th>`)
+			So(strings.Count(out, "<tr>"), ShouldEqual, 2)
+		})
+
+		Convey("Rows are sorted and limited", func() {
+			out := table("attachment:results.csv", "sort=Time", "order=desc", "limit=2")
+			So(out, ShouldContainSubstring, `<a href="?order=asc&amp;sort=Time&amp;table=results.csv">Time ▼</a>`)
+			So(strings.Index(out, "gamma"), ShouldBeLessThan, strings.Index(out, "beta"))
+			So(out, ShouldNotContainSubstring, "alpha")
+			So(out, ShouldContainSubstring, `<p>Showing 2 of 3 rows, <a href="?limit=all&amp;table=results.csv">show all</a></p>`)
+
+			Convey("by the reader, for the table they chose", func() {
+				reqInfo.Query = url.Values{"table": {"results.csv"}, "sort": {"Name"}, "order": {"asc"}, "limit": {"all"}, "rev": {"0"}}
+				out := table("attachment:results.csv", "sort=Time", "order=desc", "limit=2")
+				So(strings.Index(out, "alpha"), ShouldBeLessThan, strings.Index(out, "beta"))
+				So(out, ShouldContainSubstring, `<a href="?limit=all&amp;order=desc&amp;rev=0&amp;sort=Name&amp;table=results.csv">Name ▲</a>`)
+				So(out, ShouldNotContainSubstring, "Showing")
+
+				out = table("attachment:numbers.tsv")
+				So(out, ShouldContainSubstring, `<a href="?order=asc&amp;rev=0&amp;sort=Column+1&amp;table=numbers.tsv">`)
+			})
+
+			Convey("but choices that are not valid fall back to the page's options", func() {
+				reqInfo.Query = url.Values{"table": {"results.csv"}, "sort": {"nope"}, "order": {"up"}, "limit": {"x"}}
+				out := table("attachment:results.csv", "sort=Time", "order=desc", "limit=2")
+				So(out, ShouldNotStartWith, "error")
+				So(out, ShouldContainSubstring, `Time ▼</a>`)
+				So(strings.Index(out, "gamma"), ShouldBeLessThan, strings.Index(out, "beta"))
+				So(out, ShouldContainSubstring, "Showing 2 of 3 rows")
+			})
+		})
+
+		Convey("Attachments on other pages can be shown", func() {
+			So(table("attachment:Data/odd.csv"), ShouldContainSubstring, "<tr><td>a;b</td></tr>")
+		})
+
+		Convey("Problems are reported", func() {
+			So(table(), ShouldStartWith, "error: use Table")
+			So(table("results.csv"), ShouldStartWith, "error: use Table")
+			So(table("attachment:missing.csv"), ShouldEqual, "error: there is no attachment missing.csv")
+			So(table("attachment:results.csv", "columns=Nope"), ShouldEqual, "error: results.csv has no column Nope")
+			So(table("attachment:results.csv", "sort=9"), ShouldEqual, "error: results.csv has no column 9")
+			So(table("attachment:results.csv", "limit=x"), ShouldEqual, "error: x is not a row limit")
+			So(table("attachment:results.csv", "order=up"), ShouldEqual, "error: order is asc or desc, not up")
+			So(table("attachment:results.csv", "header=maybe"), ShouldEqual, "error: header is yes, no or auto, not maybe")
+		})
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Pages are tagged with #tag in their text or with the tags property of
+// their front matter.  Tags are lower case, so #Design and #design are the
+// same tag.
+var tagRe = regexp.MustCompile(`^\p{L}[\p{L}\p{N}_-]*$`)
+
+// The URL path of the page listing the pages with a tag
+func TagURL(tag string) string {
+	return "/tag/" + url.PathEscape(tag) + "/"
+}
+
+// A link to the page of a tag as HTML
+func tagLinkHTML(tag string) string {
+	return `<a class="tag" href="` + html.EscapeString(TagURL(normalizeTag(tag))) + `">#` + html.EscapeString(tag) + "</a>"
+}
+
+// The tag a name stands for, "" if it cannot be one.  Spaces become -.
+func normalizeTag(name string) string {
+	tag := strings.ToLower(strings.Join(strings.Fields(strings.TrimPrefix(name, "#")), "-"))
+	if !tagRe.MatchString(tag) {
+		return ""
+	}
+	return tag
+}
+
+// The length of the #tag at the start of input, 0 if there is not one
+func tagLength(input []byte) int {
+	if len(input) < 2 || input[0] != '#' {
+		return 0
+	}
+	if r, _ := utf8.DecodeRune(input[1:]); !unicode.IsLetter(r) {
+		return 0
+	}
+	n := 1
+	for n < len(input) {
+		r, size := utf8.DecodeRune(input[n:])
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-') {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+// A #tag starts a word, it must follow a space, an opening bracket or a
+// table cell separator so HTML entities and links to headings are not tags
+func isTagBoundary(r rune) bool {
+	return unicode.IsSpace(r) || r == '(' || r == '|'
+}
+
+// The tags of a page source in the given format, sorted
+func pageTags(src []byte, format string) []string {
+	seen := make(map[string]bool)
+	if prop, ok := pageProperties(src)["tags"]; ok {
+		names := prop.List
+		if prop.Type != PropertyList {
+			names = strings.Split(prop.Value, ",")
+		}
+		for _, name := range names {
+			if tag := normalizeTag(name); tag != "" {
+				seen[tag] = true
+			}
+		}
+	}
+
+	body := stripFrontMatter(src)
+	r, err := GetRenderer(format)
+	if err != nil {
+		r = plainRenderer{}
+	}
+	switch renderer := r.(type) {
+	case plainRenderer:
+		body = nil
+	case *wikiRenderer:
+		body = renderer.tagText(body)
+	}
+	l := NewPullLexer(body)
+	for item := l.NextToken(); item.Type != TokenEOF && item.Type != TokenErr; item = l.NextToken() {
+		if item.Type == TokenTag {
+			seen[normalizeTag(string(item.Value))] = true
+		}
+	}
+
+	tags := make([]string, 0, len(seen))
+	for tag := range seen {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// The text of a wiki markup page that can hold tags, processing
+// instructions and {{{ }}} blocks are blanked out and list items lose their
+// bullets, a Creole # bullet is not a tag
+func (wr *wikiRenderer) tagText(src []byte) []byte {
+	lines := bytes.Split(src, []byte("\n"))
+	i := 0
+	if wr.dialect.instructions {
+		for ; i < len(lines) && bytes.HasPrefix(lines[i], []byte("#")); i++ {
+			lines[i] = nil
+		}
+	}
+	inPre := false
+	for ; i < len(lines); i++ {
+		trimmed := bytes.TrimSpace(lines[i])
+		switch {
+		case inPre:
+			inPre = !bytes.Equal(trimmed, []byte("}}}"))
+			lines[i] = nil
+		case bytes.HasPrefix(trimmed, []byte("{{{")) && !bytes.Contains(trimmed[3:], []byte("}}}")):
+			inPre = true
+			lines[i] = nil
+		default:
+			if _, _, text, ok := wr.dialect.listItem(string(lines[i]), true); ok {
+				lines[i] = []byte(" " + text)
+			}
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// The pages each tag is on, the databases keep one up to date as revisions
+// are added
+type tagIndex struct {
+	lock  sync.Mutex
+	pages map[string]map[string]bool // the pages with each tag
+	tags  map[string][]string        // the tags of each page
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{pages: make(map[string]map[string]bool), tags: make(map[string][]string)}
+}
+
+// Set the tags of a page, replacing the ones it had
+func (ti *tagIndex) update(page string, tags []string) {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+
+	for _, tag := range ti.tags[page] {
+		delete(ti.pages[tag], page)
+		if len(ti.pages[tag]) == 0 {
+			delete(ti.pages, tag)
+		}
+	}
+	ti.tags[page] = tags
+	for _, tag := range tags {
+		if ti.pages[tag] == nil {
+			ti.pages[tag] = make(map[string]bool)
+		}
+		ti.pages[tag][page] = true
+	}
+}
+
+// The pages with a tag, sorted by name
+func (ti *tagIndex) pagesTagged(tag string) []string {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+
+	results := make([]string, 0, len(ti.pages[tag]))
+	for page := range ti.pages[tag] {
+		results = append(results, page)
+	}
+	sort.Strings(results)
+	return results
+}
+
+// Every tag with the number of pages it is on
+func (ti *tagIndex) counts() map[string]int {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+
+	results := make(map[string]int, len(ti.pages))
+	for tag, pages := range ti.pages {
+		results[tag] = len(pages)
+	}
+	return results
+}
+
+// A tag in the tag cloud, Size runs from 1 for the least used tags to 5
+// for the most used
+type tagCloudItem struct {
+	Name  string
+	Count int
+	Size  int
+}
+
+// The tag cloud of the wiki, sorted by tag
+func tagCloud(db DB) ([]tagCloudItem, error) {
+	counts, err := db.Tags()
+	if err != nil {
+		return nil, err
+	}
+	most := 0
+	for _, count := range counts {
+		if count > most {
+			most = count
+		}
+	}
+	cloud := make([]tagCloudItem, 0, len(counts))
+	for tag, count := range counts {
+		size := 1
+		if most > 1 {
+			size = 1 + 4*(count-1)/(most-1)
+		}
+		cloud = append(cloud, tagCloudItem{Name: tag, Count: count, Size: size})
+	}
+	sort.Slice(cloud, func(i, j int) bool { return cloud[i].Name < cloud[j].Name })
+	return cloud, nil
+}
+
+// The pages that have all of the tags, none if the user may not read pages
+func filterTagged(reqInfo *RequestInfo, pages []string, tags []string) ([]string, error) {
+	results := make([]string, 0, len(pages))
+	if !reqInfo.CanRead() {
+		return results, nil
+	}
+	keep := make(map[string]int)
+	wanted := make(map[string]bool)
+	for _, tag := range tags {
+		wanted[tag] = true
+	}
+	for tag := range wanted {
+		tagged, err := reqInfo.DB.PagesTagged(tag)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range tagged {
+			keep[name]++
+		}
+	}
+	for _, name := range pages {
+		if keep[name] == len(wanted) {
+			results = append(results, name)
+		}
+	}
+	return results, nil
+}
+
+// /tag/{tag}/ lists the pages with a tag
+func TagPageHandler(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
+	var details struct {
+		Tag     string
+		Pages   []string
+		ReqInfo *RequestInfo
+	}
+	details.ReqInfo = reqInfo
+	details.Tag = normalizeTag(reqInfo.Params["tag"])
+	if details.Tag == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	tagged, err := reqInfo.DB.PagesTagged(details.Tag)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	details.Pages, _ = filterTagged(reqInfo, tagged, []string{details.Tag})
+	templates["tag_page"].Execute(w, &details)
+}
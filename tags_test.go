@@ -0,0 +1,136 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestTagLexing(t *testing.T) {
+	Convey("Tags are lexed after spaces", t, func() {
+		So(lexSummary("#design and (#back-end) here"), ShouldResemble, []string{"Lexed tag: #design", "Lexed text:  and (", "Lexed tag: #back-end", "Lexed text: ) here"})
+
+		Convey("but headings, anchors and entities are not tags", func() {
+			So(lexSummary("# Heading"), ShouldResemble, []string{"Lexed text: # Heading"})
+			So(lexSummary("a#b &#x27; ##c #1"), ShouldResemble, []string{"Lexed text: a#b &#x27; ##c #1"})
+			So(lexSummary("OtherPage#Usage"), ShouldResemble, []string{"Lexed WikiWord: OtherPage#Usage"})
+			So(lexSummary("`#code`"), ShouldResemble, []string{"Lexed code: `#code`"})
+		})
+	})
+}
+
+func TestPageTags(t *testing.T) {
+	Convey("The tags of a page come from its text and front matter", t, func() {
+		So(pageTags([]byte("---\ntags: [Design, \"back end\", \"!\"]\n---\nSee #Design and #api\n```\n#code\n```"), "markdown"), ShouldResemble, []string{"api", "back-end", "design"})
+		So(pageTags([]byte("+++\ntags = \"one, two\"\n+++\n"), "markdown"), ShouldResemble, []string{"one", "two"})
+		So(pageTags([]byte("#format moin\n#pragma x\n= Heading =\n #moin\n{{{\n#code\n}}}"), "moin"), ShouldResemble, []string{"moin"})
+		So(pageTags([]byte("#plain text"), "plain"), ShouldBeEmpty)
+		So(normalizeTag("#Two Words"), ShouldEqual, "two-words")
+		So(normalizeTag("1st"), ShouldEqual, "")
+	})
+
+	Convey("Tags are linked to their page", t, func() {
+		out := string(RenderPage("markdown", []byte("Tagged #Design"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldEqual, `<p>Tagged <a class="tag" href="/tag/design/">#Design</a></p>`+"\n")
+		So(string(SanitizeHTML([]byte(out))), ShouldContainSubstring, `<a class="tag" href="/tag/design/" rel="nofollow">#Design</a>`)
+		out = string(RenderPage("moin", []byte("#format moin\nA #moin ''tag'' a#b"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldEqual, `<p>A <a class="tag" href="/tag/moin/">#moin</a> <em>tag</em> a#b</p>`+"\n")
+		out = string(RenderPage("creole", []byte("# item #creole\n|#cell|"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldContainSubstring, `<li>item <a class="tag" href="/tag/creole/">#creole</a>`)
+		So(out, ShouldContainSubstring, `<td><a class="tag" href="/tag/cell/">#cell</a></td>`)
+		So(pageTags([]byte("# item #creole\n|#cell|\n#list"), "creole"), ShouldResemble, []string{"cell", "creole"})
+	})
+}
+
+func TestTagIndex(t *testing.T) {
+	Convey("The tag index follows the current revision of each page", t, func() {
+		db, _ := newMemDB()
+		one, _ := db.GetPage("PageOne")
+		two, _ := db.GetPage("PageTwo")
+		one.AddRevision([]byte("#design #api"))
+		two.AddRevisionWithMeta([]byte("= Two =\n#design"), RevisionMeta{Format: "moin"})
+		pages, _ := db.PagesTagged("design")
+		So(pages, ShouldResemble, []string{"PageOne", "PageTwo"})
+		tags, _ := db.Tags()
+		So(tags, ShouldResemble, map[string]int{"design": 2, "api": 1})
+
+		one.AddRevision([]byte("#api only"))
+		pages, _ = db.PagesTagged("design")
+		So(pages, ShouldResemble, []string{"PageTwo"})
+		cloud, _ := tagCloud(db)
+		So(cloud, ShouldResemble, []tagCloudItem{{Name: "api", Count: 1, Size: 1}, {Name: "design", Count: 1, Size: 1}})
+	})
+
+	Convey("A file database indexes the pages it already has", t, func() {
+		tempPath, err := ioutil.TempDir("", "dbTest")
+		if err != nil {
+			t.Fatal("Unable to generate tempPath")
+		}
+		defer os.RemoveAll(tempPath)
+		db, _ := newFileDB(tempPath)
+		page, _ := db.GetPage("Project/Plan")
+		page.AddRevision([]byte("#old"))
+		page.AddRevision([]byte("---\ntags: [plan]\n---\n#new"))
+		pages, _ := db.PagesTagged("new")
+		So(pages, ShouldResemble, []string{"Project/Plan"})
+
+		reopened, err := newFileDB(tempPath)
+		So(err, ShouldBeNil)
+		tags, _ := reopened.Tags()
+		So(tags, ShouldResemble, map[string]int{"new": 1, "plan": 1})
+	})
+}
+
+func TestTagHandlers(t *testing.T) {
+	wiki, _ := newMemDB()
+	for name, src := range map[string]string{"Design": "#design #api", "Api": "#api", "Plain": "no tags"} {
+		page, _ := wiki.GetPage(name)
+		page.AddRevision([]byte(src))
+	}
+
+	Convey("A tag's page lists the pages with it", t, func() {
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/tag/api/", nil)
+		TagPageHandler(&RequestInfo{Params: map[string]string{"tag": "API"}, DB: wiki}, record, req)
+		So(record.Code, ShouldEqual, http.StatusOK)
+		So(record.Body.String(), ShouldContainSubstring, `<li><a href="/Api/">Api</a></li>`)
+		So(record.Body.String(), ShouldContainSubstring, `<li><a href="/Design/">Design</a></li>`)
+
+		record = httptest.NewRecorder()
+		TagPageHandler(&RequestInfo{Params: map[string]string{"tag": "none"}, DB: wiki}, record, req)
+		So(record.Body.String(), ShouldContainSubstring, "No pages are tagged #none.")
+		record = httptest.NewRecorder()
+		TagPageHandler(&RequestInfo{Params: map[string]string{"tag": "1"}, DB: wiki}, record, req)
+		So(record.Code, ShouldEqual, http.StatusNotFound)
+
+		Convey("but not to readers who may not see pages", func() {
+			record := httptest.NewRecorder()
+			token := &UserInfo{username: "UserOne", scopes: []string{ScopeWrite}}
+			TagPageHandler(&RequestInfo{Params: map[string]string{"tag": "api"}, DB: wiki, User: token}, record, req)
+			So(record.Body.String(), ShouldNotContainSubstring, "<li>")
+		})
+	})
+
+	Convey("The page list has a tag cloud and filters by tag", t, func() {
+		list := func(query url.Values) string {
+			record := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/?"+query.Encode(), nil)
+			ListPagesHandler(&RequestInfo{DB: wiki, Query: query}, record, req)
+			return record.Body.String()
+		}
+		out := list(url.Values{})
+		So(out, ShouldContainSubstring, `<a class="tag tag-size-5" href="/?tag=api" title="2 pages">#api</a>`)
+		So(out, ShouldContainSubstring, `<a class="tag tag-size-1" href="/?tag=design" title="1 pages">#design</a>`)
+		So(out, ShouldContainSubstring, `<a href="/Plain/">Plain</a>`)
+
+		out = list(url.Values{"tag": {"api", "Design"}})
+		So(out, ShouldContainSubstring, `The pages tagged <a href="/tag/api/">#api</a> <a href="/tag/design/">#design</a>`)
+		So(out, ShouldContainSubstring, `<a href="/Design/">Design</a>`)
+		So(out, ShouldNotContainSubstring, `<a href="/Api/">Api</a>`)
+		So(out, ShouldNotContainSubstring, `<a href="/Plain/">Plain</a>`)
+	})
+}
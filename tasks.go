@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// A task list item, ie "- [ ] write the docs", "1. [x] done" or in Moin
+// " * [ ] item".  The second group is the space or x between the brackets.
+var taskRe = regexp.MustCompile(`^(\s*(?:[-*+]|[0-9]+[.)])\s+\[)([ xX])\](?:\s|$)`)
+
+// Creole nests lists by repeating the bullet, "** [ ] item"
+var creoleTaskRe = regexp.MustCompile(`^(\s*(?:\*+|[0-9]+[.)])\s+\[)([ xX])\](?:\s|$)`)
+
+// A markdown list item, it may hold indented lines that are not code
+var markdownListRe = regexp.MustCompile(`^\s*(?:[-*+]|[0-9]+[.)])(?:\s|$)`)
+
+// The pattern of a task list item in a format, nil if the format does not
+// render task list items
+func taskPattern(format string) *regexp.Regexp {
+	r, err := GetRenderer(format)
+	if err != nil {
+		return nil
+	}
+	if tr, ok := r.(TaskRenderer); ok {
+		return tr.TaskPattern()
+	}
+	return nil
+}
+
+// The lines of src, counted from 0, that are task list items in the given
+// format.  Lines in fenced or indented code blocks, {{{ }}} blocks and the
+// front matter are not tasks, formats that do not render tasks have none.
+func taskLines(src []byte, format string) map[int]bool {
+	tasks := make(map[int]bool)
+	re := taskPattern(format)
+	if re == nil {
+		return tasks
+	}
+	r, _ := GetRenderer(format)
+	_, markdown := r.(markdownRenderer)
+	fence, inPre := "", false
+	inCode, inList, afterBlank := false, false, true
+	skip := frontMatterLines(src)
+	for i, line := range bytes.Split(src, []byte("\n")) {
+		trimmed := string(bytes.TrimSpace(line))
+		blank := trimmed == ""
+		indented := bytes.HasPrefix(line, []byte("    ")) || bytes.HasPrefix(line, []byte("\t"))
+		if inCode && !blank && !indented {
+			inCode = false
+		}
+		switch {
+		case i < skip:
+			blank = true
+		case fence != "":
+			if len(trimmed) >= len(fence) && trimmed == string(bytes.Repeat([]byte{fence[0]}, len(trimmed))) {
+				fence = ""
+			}
+		case inPre:
+			inPre = trimmed != "}}}"
+		case inCode:
+		case markdown && indented && afterBlank && !inList:
+			// an indented code block
+			inCode = true
+		case len(trimmed) >= 3 && (trimmed[:3] == "```" || trimmed[:3] == "~~~"):
+			fence = trimmed[:runLength([]byte(trimmed), trimmed[0])]
+		case len(trimmed) >= 3 && trimmed[:3] == "{{{" && !bytes.Contains(line, []byte("}}}")):
+			inPre = true
+		case re.Match(line):
+			tasks[i] = true
+		}
+		if i >= skip && !inCode && fence == "" && !inPre {
+			if markdownListRe.Match(line) {
+				inList = true
+			} else if afterBlank && !blank && line[0] != ' ' && line[0] != '\t' {
+				inList = false
+			}
+		}
+		afterBlank = blank
+	}
+	return tasks
+}
+
+// Tick or untick the task on the given line of src in the given format,
+// false is returned if the line is not a task
+func toggleTask(src []byte, format string, line int) ([]byte, bool) {
+	if !taskLines(src, format)[line] {
+		return nil, false
+	}
+	lines := bytes.Split(src, []byte("\n"))
+	mark := taskPattern(format).FindSubmatchIndex(lines[line])[4]
+	toggled := make([]byte, 0, len(src))
+	for i, text := range lines {
+		if i > 0 {
+			toggled = append(toggled, '\n')
+		}
+		if i != line {
+			toggled = append(toggled, text...)
+			continue
+		}
+		toggled = append(toggled, text[:mark]...)
+		if text[mark] == ' ' {
+			toggled = append(toggled, 'x')
+		} else {
+			toggled = append(toggled, ' ')
+		}
+		toggled = append(toggled, text[mark+1:]...)
+	}
+	return toggled, true
+}
+
+// The checkbox for the task on the given line of the source being rendered.
+// It submits the form the page is shown in, so it is disabled unless
+// ctx.Tasks allows toggling.
+func taskCheckbox(ctx *RenderContext, line int, done bool) string {
+	class, mark, title := "task", "☐", "Mark as done"
+	if done {
+		class, mark, title = "task task-done", "☑", "Mark as not done"
+	}
+	disabled := ""
+	if !ctx.Tasks {
+		disabled = " disabled"
+	}
+	return fmt.Sprintf(`<button type="submit" class="%s" name="task" value="%d" title="%s"%s>%s</button>`, class, ctx.FirstLine+line, title, disabled, mark)
+}
+
+// Replace the [ ] or [x] of the markdown task list items in src with
+// placeholders for their checkboxes
+func markdownTasks(src []byte, ctx *RenderContext, macros *macroOutput) []byte {
+	tasks := taskLines(src, markdownRenderer{}.Name())
+	if len(tasks) == 0 {
+		return src
+	}
+	lines := bytes.Split(src, []byte("\n"))
+	for i := range tasks {
+		match := taskRe.FindSubmatchIndex(lines[i])
+		open, mark := match[3]-1, match[4]
+		checkbox := macros.placeholder([]byte(taskCheckbox(ctx, i, lines[i][mark] != ' ')))
+		lines[i] = append(append(append([]byte{}, lines[i][:open]...), checkbox...), lines[i][mark+2:]...)
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
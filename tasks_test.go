@@ -0,0 +1,174 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testTaskPage = "Things to do\n\n- [ ] write the docs\n- [x] fix the build\n  * [ ] nested\n1. [X] numbered\n\n```\n- [ ] not a task\n```\n- [] not a task\n"
+
+func TestTaskLines(t *testing.T) {
+	Convey("Task list items are found outside of code", t, func() {
+		So(taskLines([]byte(testTaskPage), "markdown"), ShouldResemble, map[int]bool{2: true, 3: true, 4: true, 5: true})
+		So(taskLines([]byte("{{{\n * [ ] code\n}}}\n * [ ] moin"), "moin"), ShouldResemble, map[int]bool{3: true})
+		So(taskLines([]byte("* [ ] one\n** [x] nested"), "creole"), ShouldResemble, map[int]bool{0: true, 1: true})
+	})
+
+	Convey("Only single bullets start a task", t, func() {
+		So(taskLines([]byte("** [x] bold?\n-- [ ] dashes"), "markdown"), ShouldBeEmpty)
+		So(taskLines([]byte("** [x] bold?"), "moin"), ShouldBeEmpty)
+	})
+
+	Convey("Markdown indented code is not a task", t, func() {
+		So(taskLines([]byte("intro\n\n    - [ ] in code\n\t- [ ] tab\n\n    - [ ] still code\nafter\n- [ ] task"), "markdown"), ShouldResemble, map[int]bool{7: true})
+		So(taskLines([]byte("    - [ ] first line"), "markdown"), ShouldBeEmpty)
+
+		Convey("but indented list items are", func() {
+			So(taskLines([]byte("- item\n\n    - [ ] nested\n\ntext\n\n    - [ ] code"), "markdown"), ShouldResemble, map[int]bool{2: true})
+			So(taskLines([]byte("intro\n\n     * [ ] moin"), "moin"), ShouldResemble, map[int]bool{2: true})
+		})
+
+		out := string(RenderPage("markdown", []byte("intro\n\n    - [ ] in code"), &RenderContext{PageName: "PageOne", Tasks: true}))
+		So(out, ShouldNotContainSubstring, "<button")
+		So(out, ShouldContainSubstring, "<pre><code>- [ ] in code")
+		_, ok := toggleTask([]byte("intro\n\n    - [ ] in code"), "markdown", 2)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Only the task's mark is toggled", t, func() {
+		toggled, ok := toggleTask([]byte(testTaskPage), "markdown", 2)
+		So(ok, ShouldBeTrue)
+		So(string(toggled), ShouldEqual, strings.Replace(testTaskPage, "- [ ] write", "- [x] write", 1))
+		toggled, ok = toggleTask([]byte("a\r\n1. [X] numbered\r\n"), "markdown", 1)
+		So(ok, ShouldBeTrue)
+		So(string(toggled), ShouldEqual, "a\r\n1. [ ] numbered\r\n")
+
+		_, ok = toggleTask([]byte(testTaskPage), "markdown", 0)
+		So(ok, ShouldBeFalse)
+		_, ok = toggleTask([]byte(testTaskPage), "markdown", 8)
+		So(ok, ShouldBeFalse)
+		_, ok = toggleTask([]byte(testTaskPage), "markdown", 99)
+		So(ok, ShouldBeFalse)
+	})
+}
+
+func TestTaskRendering(t *testing.T) {
+	Convey("Tasks are rendered as checkboxes", t, func() {
+		out := string(RenderPage("markdown", []byte("- [ ] write the WikiWord docs\n- [x] done"), &RenderContext{PageName: "PageOne", Tasks: true}))
+		So(out, ShouldEqual, "<ul>\n"+
+			`<li><button type="submit" class="task" name="task" value="0" title="Mark as done">☐</button> write the <a href="/WikiWord/">WikiWord</a> docs</li>`+"\n"+
+			`<li><button type="submit" class="task task-done" name="task" value="1" title="Mark as not done">☑</button> done</li>`+"\n</ul>\n")
+		So(string(SanitizeHTML([]byte(out))), ShouldContainSubstring, `<button type="submit" class="task" name="task" value="0" title="Mark as done">☐</button>`)
+
+		out = string(RenderPage("moin", []byte("#format moin\n * [ ] one\n * [x] ''two''"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldContainSubstring, `<li><button type="submit" class="task" name="task" value="1" title="Mark as done" disabled>☐</button> one</li>`)
+		So(out, ShouldContainSubstring, `value="2" title="Mark as not done" disabled>☑</button> <em>two</em></li>`)
+		out = string(RenderPage("creole", []byte("* [ ] one"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldContainSubstring, `<li><button type="submit" class="task" name="task" value="0"`)
+
+		Convey("and pages cannot add other buttons", func() {
+			clean := string(SanitizeHTML([]byte(`<button type="button" name="other" value="x" onclick="alert(1)">b</button>`)))
+			So(clean, ShouldEqual, "<button>b</button>")
+		})
+	})
+}
+
+func TestToggleTaskHandler(t *testing.T) {
+	wiki, _ := newMemDB()
+	user := &UserInfo{username: "UserOne"}
+	toggle := func(reqInfo *RequestInfo, task, rev string) *httptest.ResponseRecorder {
+		form := url.Values{"task": {task}, "rev": {rev}}
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/edit/PageOne/task/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ToggleTaskHandler(reqInfo, record, req)
+		return record
+	}
+
+	Convey("Given a page with tasks", t, func() {
+		page, _ := wiki.GetPage("PageOne")
+		page.AddRevisionWithMeta([]byte("== Tasks ==\n * [ ] one\n * [x] two"), RevisionMeta{Format: "moin"})
+		reqInfo := &RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki, User: user}
+		rev := page.Revisions() - 1
+
+		Convey("The page view is a form for logged in users", func() {
+			record := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/PageOne/", nil)
+			context.Set(req, keyPage, page)
+			PageHandler(reqInfo, record, req)
+			context.Clear(req)
+			So(record.Body.String(), ShouldContainSubstring, `<form method="POST" action="/edit/PageOne/task/">`)
+			So(record.Body.String(), ShouldContainSubstring, `<input type="hidden" name="rev" value="`+strconv.Itoa(rev)+`"/>`)
+			So(record.Body.String(), ShouldContainSubstring, `<button type="submit" class="task" name="task" value="1" title="Mark as done">`)
+
+			Convey("but not for anonymous users or old revisions", func() {
+				record := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", "/PageOne/", nil)
+				context.Set(req, keyPage, page)
+				PageHandler(&RequestInfo{Params: map[string]string{"name": "PageOne"}, DB: wiki}, record, req)
+				context.Clear(req)
+				So(record.Body.String(), ShouldNotContainSubstring, "<form")
+				So(record.Body.String(), ShouldContainSubstring, `title="Mark as done" disabled="">`)
+
+				page.AddRevisionWithMeta([]byte("== Tasks ==\n * [x] one\n * [x] two"), RevisionMeta{Format: "moin"})
+				record = httptest.NewRecorder()
+				req, _ = http.NewRequest("GET", "/PageOne/?rev="+strconv.Itoa(rev), nil)
+				context.Set(req, keyPage, page)
+				context.Set(req, keyRev, rev)
+				PageHandler(reqInfo, record, req)
+				context.Clear(req)
+				So(record.Body.String(), ShouldNotContainSubstring, "<form")
+			})
+		})
+
+		Convey("Toggling a task adds a revision with just that line changed", func() {
+			record := toggle(reqInfo, "1", strconv.Itoa(rev))
+			So(record.Code, ShouldEqual, http.StatusFound)
+			So(page.Revisions(), ShouldEqual, rev+2)
+			src, _ := page.GetData(CURRENT_REVISION)
+			So(string(src), ShouldEqual, "== Tasks ==\n * [x] one\n * [x] two")
+			meta, _ := page.GetMeta(CURRENT_REVISION)
+			So(meta.Format, ShouldEqual, "moin")
+
+			Convey("and a toggle from the older revision is refused", func() {
+				record := toggle(reqInfo, "2", strconv.Itoa(rev))
+				So(record.Code, ShouldEqual, http.StatusConflict)
+				So(page.Revisions(), ShouldEqual, rev+2)
+			})
+		})
+
+		Convey("Bad toggles are refused", func() {
+			So(toggle(&RequestInfo{Params: reqInfo.Params, DB: wiki}, "1", strconv.Itoa(rev)).Code, ShouldEqual, http.StatusForbidden)
+			So(toggle(reqInfo, "0", strconv.Itoa(rev)).Code, ShouldEqual, http.StatusBadRequest)
+			So(toggle(reqInfo, "x", strconv.Itoa(rev)).Code, ShouldEqual, http.StatusBadRequest)
+			So(toggle(reqInfo, "1", "").Code, ShouldEqual, http.StatusBadRequest)
+			missing := &RequestInfo{Params: map[string]string{"name": "NoSuchPage"}, DB: wiki, User: user}
+			So(toggle(missing, "1", "0").Code, ShouldEqual, http.StatusNotFound)
+			So(page.Revisions(), ShouldEqual, rev+1)
+		})
+
+		Convey("Pages in a format without checkboxes have no tasks", func() {
+			page.AddRevisionWithMeta([]byte("- [ ] one"), RevisionMeta{Format: "plain"})
+			So(taskLines([]byte("- [ ] one"), "plain"), ShouldBeEmpty)
+			So(taskLines([]byte("- [ ] one"), "unknown"), ShouldBeEmpty)
+
+			record := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/PageOne/", nil)
+			context.Set(req, keyPage, page)
+			PageHandler(reqInfo, record, req)
+			context.Clear(req)
+			So(record.Body.String(), ShouldNotContainSubstring, "<form")
+
+			So(toggle(reqInfo, "0", strconv.Itoa(rev+1)).Code, ShouldEqual, http.StatusBadRequest)
+			So(page.Revisions(), ShouldEqual, rev+2)
+			src, _ := page.GetData(CURRENT_REVISION)
+			So(string(src), ShouldEqual, "- [ ] one")
+		})
+	})
+}
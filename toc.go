@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// <<TableOfContents>> leaves this in the page until it has been rendered,
+// then it is replaced by a list of the headings on the page
+const tocPlaceholder = "<!--wiki-toc-->"
+
+var (
+	headingRe   = regexp.MustCompile(`(?s)<h([1-6])([^>]*)>(.*?)</h[1-6]>`)
+	headingIdRe = regexp.MustCompile(`\bid="([^"]*)"`)
+	htmlTagRe   = regexp.MustCompile(`<[^>]*>`)
+)
+
+func tableOfContentsMacro(reqInfo *RequestInfo, page Page, args []string) ([]byte, error) {
+	if len(args) > 0 {
+		return nil, errors.New("TableOfContents takes no arguments")
+	}
+	return []byte(tocPlaceholder), nil
+}
+
+// Replace any table of contents placeholders in a rendered page
+func fillTableOfContents(rendered []byte) []byte {
+	if !bytes.Contains(rendered, []byte(tocPlaceholder)) {
+		return rendered
+	}
+	toc := tableOfContents(rendered)
+	rendered = bytes.Replace(rendered, []byte("<p>"+tocPlaceholder+"</p>"), toc, -1)
+	return bytes.Replace(rendered, []byte(tocPlaceholder), toc, -1)
+}
+
+// A nested list of the headings in rendered linking to them
+func tableOfContents(rendered []byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(`<div class="toc">` + "\n")
+	levels := make([]int, 0)
+	for _, match := range headingRe.FindAllSubmatch(rendered, -1) {
+		level := int(match[1][0] - '0')
+		for len(levels) > 0 && levels[len(levels)-1] > level {
+			buf.WriteString("</li>\n</ul>\n")
+			levels = levels[:len(levels)-1]
+		}
+		if len(levels) == 0 || levels[len(levels)-1] < level {
+			buf.WriteString("<ul>\n")
+			levels = append(levels, level)
+		} else {
+			buf.WriteString("</li>\n")
+		}
+		// the heading is already escaped, only the markup in it is dropped
+		text := htmlTagRe.ReplaceAll(match[3], nil)
+		if id := headingIdRe.FindSubmatch(match[2]); id != nil {
+			buf.WriteString(`<li><a href="#` + string(id[1]) + `">` + string(text) + "</a>")
+		} else {
+			buf.WriteString("<li>" + string(text))
+		}
+	}
+	for range levels {
+		buf.WriteString("</li>\n</ul>\n")
+	}
+	buf.WriteString("</div>\n")
+	return buf.Bytes()
+}
+
+// The id of a heading, its text in lower case with every run of anything
+// but letters and digits replaced by '-', ie "Design notes: v2" is
+// "design-notes-v2"
+func headingSlug(text string) string {
+	buf := &bytes.Buffer{}
+	gap := false
+	for _, r := range strings.ToLower(text) {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') {
+			gap = true
+			continue
+		}
+		if gap && buf.Len() > 0 {
+			buf.WriteByte('-')
+		}
+		gap = false
+		buf.WriteRune(r)
+	}
+	if buf.Len() == 0 {
+		return "section"
+	}
+	return buf.String()
+}
+
+// Give every heading in rendered that does not have an id one made from its
+// text, a heading that would repeat an id has -1, -2, ... added to it
+func addHeadingIds(rendered []byte) []byte {
+	matches := headingRe.FindAllSubmatchIndex(rendered, -1)
+	if len(matches) == 0 {
+		return rendered
+	}
+	used := make(map[string]bool)
+	for _, m := range matches {
+		if id := headingIdRe.FindSubmatch(rendered[m[4]:m[5]]); id != nil {
+			used[string(id[1])] = true
+		}
+	}
+	buf := &bytes.Buffer{}
+	last := 0
+	for _, m := range matches {
+		if headingIdRe.Match(rendered[m[4]:m[5]]) {
+			continue
+		}
+		slug := headingSlug(html.UnescapeString(string(htmlTagRe.ReplaceAll(rendered[m[6]:m[7]], nil))))
+		id := slug
+		for i := 1; used[id]; i++ {
+			id = fmt.Sprintf("%s-%d", slug, i)
+		}
+		used[id] = true
+		// the id goes straight after the h1 to h6
+		buf.Write(rendered[last:m[3]])
+		buf.WriteString(` id="` + id + `"`)
+		last = m[3]
+	}
+	buf.Write(rendered[last:])
+	return buf.Bytes()
+}
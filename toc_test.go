@@ -0,0 +1,31 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestHeadingIds(t *testing.T) {
+	Convey("Heading slugs are made from the heading text", t, func() {
+		So(headingSlug("Design notes: v2"), ShouldEqual, "design-notes-v2")
+		So(headingSlug("  Über  größe "), ShouldEqual, "über-größe")
+		So(headingSlug("snake_case"), ShouldEqual, "snake_case")
+		So(headingSlug("?!"), ShouldEqual, "section")
+	})
+
+	Convey("Every heading is given an id", t, func() {
+		out := string(RenderPage("markdown", []byte("# Intro\n\n## Usage\n\n# Intro\n\n## Fish &amp; *chips*\n\n## Given {#usage-1}\n"), &RenderContext{PageName: "PageOne"}))
+		So(out, ShouldContainSubstring, `<h1 id="intro">Intro</h1>`)
+		So(out, ShouldContainSubstring, `<h2 id="usage">Usage</h2>`)
+		So(out, ShouldContainSubstring, `<h1 id="intro-1">Intro</h1>`)
+		So(out, ShouldContainSubstring, `<h2 id="fish-chips">Fish &amp; <em>chips</em></h2>`)
+		// ids given in the page are kept and not reused
+		So(out, ShouldContainSubstring, `<h2 id="usage-1">Given</h2>`)
+
+		Convey("and the ids survive sanitizing", func() {
+			clean := string(SanitizeHTML(RenderPage("creole", []byte("= Größe\n== x <y>"), &RenderContext{PageName: "PageOne"})))
+			So(clean, ShouldContainSubstring, `<h1 id="größe">Größe</h1>`)
+			So(clean, ShouldContainSubstring, `<h2 id="x-y">x &lt;y&gt;</h2>`)
+		})
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenPrefix = "wk_"
+)
+
+var (
+	tokenErr = errors.New("Invalid API token")
+
+	validScopes = []string{ScopeRead, ScopeWrite, ScopeAttach}
+)
+
+// A personal access token, only a hash of the secret is kept
+type APIToken struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// The personal access tokens for all users, saved as JSON in a single file
+type tokenStore struct {
+	lock   sync.Mutex
+	path   string // if empty the tokens are only kept in memory
+	tokens []*APIToken
+}
+
+func newTokenStore(fname string) (*tokenStore, error) {
+	ts := &tokenStore{path: fname, tokens: make([]*APIToken, 0)}
+	if fname == "" {
+		return ts, nil
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ts, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ts.tokens); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// write the tokens out, must be called with the lock held
+func (ts *tokenStore) save() error {
+	if ts.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(ts.tokens, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(path.Dir(ts.path), "tt_")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+
+	if err := writeAndClose(f, data); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, ts.path)
+}
+
+// Create a new token for the user, returning the secret which is not stored anywhere
+func (ts *tokenStore) Create(username, name string, scopes []string) (string, *APIToken, error) {
+	if username == "" || username == AnonymousUser {
+		return "", nil, tokenErr
+	}
+	if len(scopes) == 0 {
+		return "", nil, errors.New("A token needs at least one scope")
+	}
+	for _, scope := range scopes {
+		valid := false
+		for _, validScope := range validScopes {
+			valid = valid || scope == validScope
+		}
+		if !valid {
+			return "", nil, errors.New("Unknown scope " + scope)
+		}
+	}
+	id, err := randomToken(4)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	secret = tokenPrefix + secret
+
+	token := &APIToken{ID: id, User: username, Name: strings.TrimSpace(name), Scopes: append([]string{}, scopes...), Hash: hashToken(secret), Created: time.Now()}
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.tokens = append(ts.tokens, token)
+	if err := ts.save(); err != nil {
+		ts.tokens = ts.tokens[:len(ts.tokens)-1]
+		return "", nil, err
+	}
+	return secret, token, nil
+}
+
+// List the tokens that belong to a user
+func (ts *tokenStore) List(username string) []APIToken {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	results := make([]APIToken, 0)
+	for _, token := range ts.tokens {
+		if token.User == username {
+			results = append(results, *token)
+		}
+	}
+	return results
+}
+
+// Remove one of the users tokens
+func (ts *tokenStore) Revoke(username, id string) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	remaining := make([]*APIToken, 0, len(ts.tokens))
+	for _, token := range ts.tokens {
+		if token.User != username || token.ID != id {
+			remaining = append(remaining, token)
+		}
+	}
+	if len(remaining) == len(ts.tokens) {
+		return tokenErr
+	}
+	previous := ts.tokens
+	ts.tokens = remaining
+	if err := ts.save(); err != nil {
+		ts.tokens = previous
+		return err
+	}
+	return nil
+}
+
+// Find the token matching the secret, nil if there is none
+func (ts *tokenStore) Authenticate(secret string) *APIToken {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil
+	}
+	hash := hashToken(secret)
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	for _, token := range ts.tokens {
+		if token.Hash == hash {
+			return token
+		}
+	}
+	return nil
+}
+
+// The BearerTokenMiddleware resolves an "Authorization: Bearer" API token into
+// the owning user and stores it in the context, replacing any session user.
+// The user keeps their roles, except admin, and is limited to the token scopes.
+// Requests with an invalid token are refused with a 401.
+func NewBearerTokenMiddleware(tokens *tokenStore, users UserStore, log *auditLog, next http.Handler) http.Handler {
+	var f http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		if !isBearerRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var user *UserInfo
+		if token := tokens.Authenticate(strings.TrimSpace(r.Header.Get("Authorization")[len("Bearer "):])); token != nil && users != nil {
+			if owner, err := users.Lookup(token.User); err == nil {
+				user = &UserInfo{username: owner.Username(), scopes: append(make([]string, 0, len(token.Scopes)), token.Scopes...)}
+				for _, role := range owner.Roles() {
+					if role != "admin" {
+						user.AddRole(role)
+					}
+				}
+			}
+		}
+		if user == nil {
+			log.RecordRequest(r, AuditDenied, "", "invalid api token for "+r.Method+" "+r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="wiki"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		context.Set(r, keyUser, user)
+		next.ServeHTTP(w, r)
+	}
+	return f
+}
+
+func newSettingsHandler(tokens *tokenStore) func(*RequestInfo, http.ResponseWriter, *http.Request) {
+	return func(reqInfo *RequestInfo, w http.ResponseWriter, r *http.Request) {
+		var details struct {
+			Tokens   []APIToken
+			NewToken string
+			Scopes   []string
+			Error    string
+			ReqInfo  *RequestInfo
+		}
+		details.ReqInfo = reqInfo
+		details.Scopes = validScopes
+		username := reqInfo.User.Username()
+
+		if r.Method == "POST" {
+			if err := r.ParseForm(); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			switch r.FormValue("action") {
+			case "create":
+				secret, _, err := tokens.Create(username, r.FormValue("name"), r.Form["scope"])
+				if err != nil {
+					details.Error = err.Error()
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				details.NewToken = secret
+			case "revoke":
+				if err := tokens.Revoke(username, r.FormValue("id")); err != nil {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				http.Redirect(w, r, "/Special/Settings/", http.StatusFound)
+				return
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		details.Tokens = tokens.List(username)
+		templates["settings"].Execute(w, &details)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTokenStore(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "tokenTest")
+	if err != nil {
+		t.Fatal("Unable to generate tempPath")
+	}
+	defer os.RemoveAll(tempPath)
+
+	Convey("Tokens can be created, listed and revoked", t, func() {
+		fname := path.Join(tempPath, "tokens.json")
+		os.Remove(fname)
+		ts, err := newTokenStore(fname)
+		So(err, ShouldBeNil)
+
+		secret, token, err := ts.Create("UserOne", "ci", []string{ScopeRead, ScopeWrite})
+		So(err, ShouldBeNil)
+		So(secret, ShouldStartWith, tokenPrefix)
+		So(token.Hash, ShouldNotEqual, secret)
+		So(ts.Authenticate(secret).ID, ShouldEqual, token.ID)
+		So(ts.Authenticate(secret+"x"), ShouldBeNil)
+
+		list := ts.List("UserOne")
+		So(len(list), ShouldEqual, 1)
+		So(list[0].Name, ShouldEqual, "ci")
+		So(len(ts.List("UserTwo")), ShouldEqual, 0)
+
+		Convey("The secret is not written to disk", func() {
+			data, err := ioutil.ReadFile(fname)
+			So(err, ShouldBeNil)
+			So(strings.Contains(string(data), secret), ShouldBeFalse)
+
+			Convey("But the tokens survive a reload", func() {
+				ts2, err := newTokenStore(fname)
+				So(err, ShouldBeNil)
+				So(ts2.Authenticate(secret), ShouldNotBeNil)
+			})
+		})
+		Convey("Only the owner can revoke a token", func() {
+			So(ts.Revoke("UserTwo", token.ID), ShouldNotBeNil)
+			So(ts.Revoke("UserOne", token.ID), ShouldBeNil)
+			So(ts.Authenticate(secret), ShouldBeNil)
+			So(len(ts.List("UserOne")), ShouldEqual, 0)
+		})
+		Convey("Tokens need valid scopes and a real user", func() {
+			_, _, err = ts.Create("UserOne", "bad", []string{})
+			So(err, ShouldNotBeNil)
+			_, _, err = ts.Create("UserOne", "bad", []string{"delete"})
+			So(err, ShouldNotBeNil)
+			_, _, err = ts.Create(AnonymousUser, "bad", []string{ScopeRead})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestBearerTokenMiddleware(t *testing.T) {
+	users := testUserStore(t)
+	ts, _ := newTokenStore("")
+	secret, _, _ := ts.Create("UserOne", "ci", []string{ScopeWrite})
+
+	var user *UserInfo
+	called := false
+	var okHandler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		user = CurUser(r)
+	}
+	m := NewBearerTokenMiddleware(ts, users, nil, okHandler)
+
+	request := func(auth string) *httptest.ResponseRecorder {
+		called = false
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/edit/PageOne/", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		m.ServeHTTP(record, req)
+		context.Clear(req)
+		return record
+	}
+
+	Convey("A valid bearer token resolves to a restricted version of its user", t, func() {
+		request("Bearer " + secret)
+		So(called, ShouldBeTrue)
+		So(user.Username(), ShouldEqual, "UserOne")
+		So(user.IsToken(), ShouldBeTrue)
+		So(user.HasScope(ScopeWrite), ShouldBeTrue)
+		So(user.HasScope(ScopeAttach), ShouldBeFalse)
+		So(user.Roles(), ShouldContain, "editor")
+		So(user.Roles(), ShouldNotContain, "admin")
+
+		Convey("Requests without a token are passed through untouched", func() {
+			request("")
+			So(called, ShouldBeTrue)
+			So(user.IsAnonymous(), ShouldBeTrue)
+		})
+		Convey("Invalid tokens are refused", func() {
+			record := request("Bearer wk_nope")
+			So(called, ShouldBeFalse)
+			So(record.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+
+	Convey("Token users are limited to their scopes", t, func() {
+		var next http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {}
+		scoped := NewBearerTokenMiddleware(ts, users, nil, NewScopeMiddleware(ScopeAttach, nil, next))
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/edit/PageOne/attachment/", nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		scoped.ServeHTTP(record, req)
+		context.Clear(req)
+		So(record.Code, ShouldEqual, http.StatusForbidden)
+
+		Convey("But session users are not", func() {
+			So((&UserInfo{username: "UserOne"}).HasScope(ScopeAttach), ShouldBeTrue)
+		})
+	})
+}
+
+func TestSettingsHandler(t *testing.T) {
+	var ts *tokenStore
+	var settings func(*RequestInfo, http.ResponseWriter, *http.Request)
+	user := &UserInfo{username: "UserOne"}
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		record := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/Special/Settings/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		settings(&RequestInfo{Params: make(map[string]string), User: user}, record, req)
+		return record
+	}
+
+	Convey("Tokens are created from the settings page and shown once", t, func() {
+		ts, _ = newTokenStore("")
+		settings = newSettingsHandler(ts)
+		record := post(url.Values{"action": {"create"}, "name": {"ci"}, "scope": {ScopeRead, ScopeAttach}})
+		So(record.Code, ShouldEqual, http.StatusOK)
+		So(record.Body.String(), ShouldContainSubstring, tokenPrefix)
+		list := ts.List("UserOne")
+		So(len(list), ShouldEqual, 1)
+		So(list[0].Scopes, ShouldContain, ScopeAttach)
+
+		Convey("The token list does not show the secret", func() {
+			record := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/Special/Settings/", nil)
+			settings(&RequestInfo{Params: make(map[string]string), User: user}, record, req)
+			So(record.Body.String(), ShouldContainSubstring, "ci")
+			So(record.Body.String(), ShouldNotContainSubstring, tokenPrefix)
+		})
+		Convey("Tokens are revoked from the settings page", func() {
+			record := post(url.Values{"action": {"revoke"}, "id": {list[0].ID}})
+			So(record.Code, ShouldEqual, http.StatusFound)
+			So(len(ts.List("UserOne")), ShouldEqual, 0)
+		})
+	})
+}
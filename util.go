@@ -2,41 +2,265 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/gorilla/context"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
 	keyParams = "params"
 	keyPage   = "page"
 	keyRev    = "rev"
+	keyUser   = "user"
+	keyCSRF   = "csrf"
 
 	_WIKIWORD_RE      = "([A-Z]+[A-Za-z0-9_]*){2,}"
 	_WIKIWORD_ONLY_RE = "^" + _WIKIWORD_RE + "$"
+
+	maxPageNameLength = 200 // in bytes
 )
 
 var WIKIWORD_RE = regexp.MustCompile(_WIKIWORD_RE)
 var WIKIWORD_ONLY_RE = regexp.MustCompile(_WIKIWORD_ONLY_RE)
 
+var pageNameErr = errors.New("Invalid page name")
+
+// names that are used by the wiki itself and cannot be pages
+var reservedPageNames = map[string]bool{
+	"About":   true,
+	"Special": true,
+	"edit":    true,
+	"login":   true,
+	"logout":  true,
+	"static":  true,
+	"tag":     true,
+}
+
+// names that cannot be used for sub pages as they clash with a route
+var reservedSubPageNames = map[string]bool{
+	"attachment": true,
+	"task":       true,
+}
+
+var markdownLabelEscaper = strings.NewReplacer("\\", "\\\\", "[", "\\[", "]", "\\]")
+
 // Is the given string a WikiWord
 func IsWikiWord(word string) bool {
 	return WIKIWORD_ONLY_RE.MatchString(word)
 }
 
+// NormalizePageName returns the canonical form of a page name.  Sub pages
+// are separated by '/', ie ProjectX/DesignNotes.  In each part leading and
+// trailing whitespace is removed and internal runs of whitespace become a
+// single space.  Names that cannot be pages return pageNameErr.
+func NormalizePageName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", pageNameErr
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		part = strings.Join(strings.Fields(part), " ")
+		if part == "" || strings.HasPrefix(part, ".") {
+			return "", pageNameErr
+		}
+		if (i == 0 && reservedPageNames[part]) || (i > 0 && reservedSubPageNames[part]) {
+			return "", pageNameErr
+		}
+		for _, r := range part {
+			if unicode.IsControl(r) || r == utf8.RuneError {
+				return "", pageNameErr
+			}
+		}
+		parts[i] = part
+	}
+	name = strings.Join(parts, "/")
+	if len(name) > maxPageNameLength {
+		return "", pageNameErr
+	}
+	return name, nil
+}
+
+// Is the given string a page name in its canonical form.  All WikiWords are.
+func IsValidPageName(name string) bool {
+	normalized, err := NormalizePageName(name)
+	return err == nil && normalized == name
+}
+
+// The URL path of a page
+func PageURL(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return "/" + strings.Join(parts, "/") + "/"
+}
+
+// The URL path of the edit page for a page
+func EditURL(name string) string {
+	return "/edit" + PageURL(name)
+}
+
+// The parent of a sub page, "" for top level pages
+func ParentPageName(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// The last part of a page name, ie DesignNotes for ProjectX/DesignNotes
+func BasePageName(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// Resolve a link target found on the page current.  "/Child" is a sub page of
+// current, "../Sibling" is relative to the parent of current (and may be
+// repeated), anything else is a full page name.
+func ResolvePageName(current, target string) (string, error) {
+	target = strings.TrimSpace(target)
+	switch {
+	case strings.HasPrefix(target, "/"):
+		if current == "" {
+			return "", pageNameErr
+		}
+		target = current + target
+	case strings.HasPrefix(target, "../"):
+		dir := ParentPageName(current)
+		target = target[len("../"):]
+		for strings.HasPrefix(target, "../") {
+			if dir == "" {
+				return "", pageNameErr
+			}
+			dir = ParentPageName(dir)
+			target = target[len("../"):]
+		}
+		if dir != "" {
+			target = dir + "/" + target
+		}
+	}
+	return NormalizePageName(target)
+}
+
+// The URL of a link target on the page current.  The target may end in
+// #Heading to link to a heading on the page, a target of just #Heading is a
+// heading on the current page.
+func ResolveLinkURL(current, target string) (string, error) {
+	anchor := ""
+	if i := strings.IndexByte(target, '#'); i >= 0 {
+		if heading := strings.TrimSpace(target[i+1:]); heading != "" {
+			anchor = "#" + headingSlug(heading)
+		}
+		target = target[:i]
+	}
+	if strings.TrimSpace(target) == "" {
+		if anchor == "" {
+			return "", pageNameErr
+		}
+		return anchor, nil
+	}
+	name, err := ResolvePageName(current, target)
+	if err != nil {
+		return "", err
+	}
+	return PageURL(name) + anchor, nil
+}
+
+// Encode one part of a page name so that it is safe to use as a file name.
+// Letters, digits, '_' and '-' are kept so WikiWords are stored as
+// themselves, every other byte is written as %XX.
+func encodePageName(name string) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || c == '_' || c == '-' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// Decode a file name made by encodePageName, it fails for any file name
+// that encodePageName would not have made.  The caller must still check
+// that the full page name is valid.
+func decodePageName(fname string) (string, error) {
+	name, err := url.PathUnescape(fname)
+	if err != nil || name == "" || strings.Contains(name, "/") || encodePageName(name) != fname {
+		return "", pageNameErr
+	}
+	return name, nil
+}
+
+// Expand a [[Page Name]] or [[Page Name|label]] free link on the page current
+// into a markdown link, the name may end in #Heading.  [[Site:target]] links
+// to an interwiki site and [[attachment:name]] to an attachment.  Anything
+// that is not a valid page name is left as it was.
+func writeFreeLink(buf *bytes.Buffer, value []byte, ctx *RenderContext) {
+	current := ctx.PageName
+	inner := string(value[2 : len(value)-2])
+	target, label := inner, inner
+	if i := strings.Index(inner, "|"); i >= 0 {
+		target, label = inner[:i], inner[i+1:]
+	}
+	target = strings.TrimSpace(target)
+	if label = strings.TrimSpace(label); label == "" {
+		label = target
+	}
+	if link, ok := interWiki.LinkHTML(target, label); ok {
+		buf.WriteString(link)
+		return
+	}
+	if strings.HasPrefix(target, attachmentPrefix) {
+		if link, ok := attachmentLinkHTML(ctx, target, label); ok {
+			buf.WriteString(link)
+		} else {
+			buf.Write(value)
+		}
+		return
+	}
+	href, err := ResolveLinkURL(current, target)
+	if err != nil {
+		buf.Write(value)
+		return
+	}
+	buf.WriteString("[" + markdownLabelEscaper.Replace(label) + "](" + href + ")")
+}
+
 func ExpandWikiWords(input []byte) []byte {
-	l, ch := NewLexer(input)
-	go l.Run()
+	return ExpandPageWikiWords(input, "")
+}
+
+// Expand the wiki words and free links in the source of the page current,
+// relative links such as [[../Sibling]] are resolved against current
+func ExpandPageWikiWords(input []byte, current string) []byte {
+	return expandPageSource(input, &RenderContext{PageName: current}, nil)
+}
+
+// Expand the source of the page being rendered as ExpandPageWikiWords does,
+// attachment links are checked against the page.  Macros and math are
+// written by expand or left as they are when it is nil.
+func expandPageSource(input []byte, ctx *RenderContext, expand func(buf *bytes.Buffer, item LexedItem)) []byte {
+	l := NewPullLexer(input)
 
 	buf := &bytes.Buffer{}
+	buf.Grow(len(input))
 
 	done := false
 	for !done {
-		item := <-ch
+		item := l.NextToken()
 		switch item.Type {
 		case TokenErr:
 			done = true
@@ -44,11 +268,37 @@ func ExpandWikiWords(input []byte) []byte {
 			//fmt.Println("Got an EOF")
 			done = true
 		case TokenWikiWord:
-			buf.Write([]byte("["))
-			buf.Write(item.Value)
-			buf.Write([]byte("](/"))
-			buf.Write(item.Value)
-			buf.Write([]byte("/)"))
+			// the WikiWord may link to a heading, ie OtherPage#Heading
+			href, err := ResolveLinkURL("", string(item.Value))
+			if err != nil {
+				buf.Write(item.Value)
+				continue
+			}
+			buf.WriteString("[" + string(item.Value) + "](" + href + ")")
+		case TokenFreeLink:
+			writeFreeLink(buf, item.Value, ctx)
+		case TokenEscape:
+			// drop the ! so the WikiWord is shown as plain text
+			buf.Write(item.Value[1:])
+		case TokenAttachment:
+			if link, ok := attachmentLinkHTML(ctx, string(item.Value), string(item.Value)); ok {
+				buf.WriteString(link)
+			} else {
+				buf.Write(item.Value)
+			}
+		case TokenLink, TokenImage:
+			writeAttachmentLink(buf, item.Value, ctx)
+		case TokenInterWiki:
+			link, _ := interWiki.LinkHTML(string(item.Value), string(item.Value))
+			buf.WriteString(link)
+		case TokenTag:
+			buf.WriteString(tagLinkHTML(string(item.Value[1:])))
+		case TokenMacro, TokenMath:
+			if expand != nil {
+				expand(buf, item)
+			} else {
+				buf.Write(item.Value)
+			}
 		default:
 			buf.Write(item.Value)
 		}
@@ -57,6 +307,14 @@ func ExpandWikiWords(input []byte) []byte {
 	return buf.Bytes()
 }
 
+// Lex the source of a page and return the problems found in it
+func CheckPageSource(input []byte) []LexWarning {
+	l := NewPullLexer(input)
+	for item := l.NextToken(); item.Type != TokenEOF && item.Type != TokenErr; item = l.NextToken() {
+	}
+	return l.Warnings()
+}
+
 func writeAndClose(wc io.WriteCloser, value []byte) error {
 	defer wc.Close()
 	_, err := wc.Write(value)
@@ -127,6 +385,15 @@ func generateInt(begin, end int) <-chan int {
 	return ch
 }
 
+// Generate a random hex encoded token from size random bytes
+func randomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
 func getListenAddress() string {
 	return ""
 }
@@ -164,3 +431,25 @@ func CurRev(r *http.Request) int {
 	}
 	return CURRENT_REVISION
 }
+
+// CurUser retrieves the user making this request from the context.
+// Returns an anonymous user if no user has been set
+func CurUser(r *http.Request) *UserInfo {
+	if val, ok := context.GetOk(r, keyUser); ok {
+		if u, ok := val.(*UserInfo); ok && u != nil {
+			return u
+		}
+	}
+	return &UserInfo{}
+}
+
+// CurCSRFToken retrieves the CSRF token for this request from the context.
+// Returns an empty string if the CSRFMiddleware has not run
+func CurCSRFToken(r *http.Request) string {
+	if val, ok := context.GetOk(r, keyCSRF); ok {
+		if token, ok := val.(string); ok {
+			return token
+		}
+	}
+	return ""
+}
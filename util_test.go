@@ -69,6 +69,112 @@ func TestWikiWordRe(t *testing.T) {
 	})
 }
 
+func TestNormalizePageName(t *testing.T) {
+	Convey("Page names are normalized to a canonical form", t, func() {
+		name, err := NormalizePageName("  Release \t notes\n2026 ")
+		So(err, ShouldBeNil)
+		So(name, ShouldEqual, "Release notes 2026")
+
+		So(IsValidPageName("WikiWord"), ShouldBeTrue)
+		So(IsValidPageName("API"), ShouldBeTrue)
+		So(IsValidPageName("Ünïcödé 名前"), ShouldBeTrue)
+		So(IsValidPageName("Release  notes"), ShouldBeFalse)
+
+		Convey("Sub pages are normalized part by part", func() {
+			name, err := NormalizePageName(" ProjectX / Design  notes ")
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, "ProjectX/Design notes")
+			So(IsValidPageName("ProjectX/About"), ShouldBeTrue)
+			So(ParentPageName("ProjectX/Design/Notes"), ShouldEqual, "ProjectX/Design")
+			So(ParentPageName("ProjectX"), ShouldEqual, "")
+			So(BasePageName("ProjectX/Design/Notes"), ShouldEqual, "Notes")
+			So(BasePageName("ProjectX"), ShouldEqual, "ProjectX")
+		})
+
+		Convey("Some names can never be pages", func() {
+			for _, bad := range []string{"", "   ", ".hidden", "..", "a//b", "/a", "a/", "a/../b", "a/attachment", "Project/task", "edit/a", "tag/Foo", "bell\a", "edit", "About", string([]byte{0xff, 0xfe}), strings.Repeat("x", maxPageNameLength+1)} {
+				_, err = NormalizePageName(bad)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestPageNameEncoding(t *testing.T) {
+	Convey("Page names are encoded for use in URLs and on disk", t, func() {
+		So(PageURL("WikiWord"), ShouldEqual, "/WikiWord/")
+		So(PageURL("Release notes 2026"), ShouldEqual, "/Release%20notes%202026/")
+		So(PageURL("What? (sure)"), ShouldEqual, "/What%3F%20%28sure%29/")
+		So(EditURL("Release notes"), ShouldEqual, "/edit/Release%20notes/")
+		So(PageURL("ProjectX/Design notes"), ShouldEqual, "/ProjectX/Design%20notes/")
+
+		So(encodePageName("WikiWord_1-2"), ShouldEqual, "WikiWord_1-2")
+		So(encodePageName("a b.c%"), ShouldEqual, "a%20b%2Ec%25")
+		So(encodePageName("名"), ShouldEqual, "%E5%90%8D")
+
+		for _, name := range []string{"WikiWord", "Release notes 2026", "Ünïcödé 名前", "100% (sure)?"} {
+			decoded, err := decodePageName(encodePageName(name))
+			So(err, ShouldBeNil)
+			So(decoded, ShouldEqual, name)
+		}
+		Convey("File names that were not made by encodePageName are not pages", func() {
+			for _, fname := range []string{"a%20b%2ec", "a b", "a%2Fb", "%ZZ"} {
+				_, err := decodePageName(fname)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestExpandFreeLinks(t *testing.T) {
+	Convey("Free links are expanded to markdown links", t, func() {
+		So(string(ExpandWikiWords([]byte("See [[Release notes 2026]] now"))), ShouldEqual, "See [Release notes 2026](/Release%20notes%202026/) now")
+		So(string(ExpandWikiWords([]byte("[[ API |the api]]"))), ShouldEqual, "[the api](/API/)")
+		So(string(ExpandWikiWords([]byte("[[a [b]]]"))), ShouldEqual, "[a \\[b](/a%20%5Bb/)]")
+
+		Convey("Links can point to a heading on a page", func() {
+			So(string(ExpandWikiWords([]byte("See OtherPage#Design_notes-2, now"))), ShouldEqual, "See [OtherPage#Design_notes-2](/OtherPage/#design_notes-2), now")
+			So(string(ExpandWikiWords([]byte("OtherPage# alone"))), ShouldEqual, "[OtherPage](/OtherPage/)# alone")
+			So(string(ExpandWikiWords([]byte("[[Other Page#Usage Notes]] [[#Intro|top]]"))), ShouldEqual, "[Other Page#Usage Notes](/Other%20Page/#usage-notes) [top](#intro)")
+			So(string(ExpandPageWikiWords([]byte("[[../Sibling#Intro]]"), "ProjectX/Design")), ShouldEqual, "[../Sibling#Intro](/ProjectX/Sibling/#intro)")
+			So(string(ExpandWikiWords([]byte("[[#]]"))), ShouldEqual, "[[#]]")
+		})
+
+		Convey("Invalid targets are left alone", func() {
+			So(string(ExpandWikiWords([]byte("[[.hidden]] and [[]]"))), ShouldEqual, "[[.hidden]] and [[]]")
+		})
+	})
+}
+
+func TestResolvePageName(t *testing.T) {
+	Convey("Link targets are resolved relative to the current page", t, func() {
+		cases := []struct{ current, target, expected string }{
+			{"ProjectX", "Other", "Other"},
+			{"ProjectX", "/Design", "ProjectX/Design"},
+			{"ProjectX/Design", "../Sibling", "ProjectX/Sibling"},
+			{"ProjectX/Design/Notes", "../../Plan", "ProjectX/Plan"},
+			{"ProjectX", "../Top", "Top"},
+			{"ProjectX/Design", "../Sub/Page", "ProjectX/Sub/Page"},
+		}
+		for _, c := range cases {
+			name, err := ResolvePageName(c.current, c.target)
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, c.expected)
+		}
+
+		Convey("Links cannot climb above the top of the wiki", func() {
+			_, err := ResolvePageName("ProjectX", "../../Top")
+			So(err, ShouldNotBeNil)
+			_, err = ResolvePageName("", "/Child")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Free links use the current page", func() {
+			So(string(ExpandPageWikiWords([]byte("[[../Sibling]] [[/Child|kid]]"), "ProjectX/Design")), ShouldEqual, "[../Sibling](/ProjectX/Sibling/) [kid](/ProjectX/Design/Child/)")
+		})
+	})
+}
+
 func TestExpandWikiWords(t *testing.T) {
 	test0 := []byte("There are no wiki words in\nthis piece of text.")
 	test1 := []byte("There is only\nOneWikiWord in this text.")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"github.com/gorilla/mux"
 	"github.com/jonhanks/middleware"
 	"github.com/justinas/alice"
@@ -9,37 +10,143 @@ import (
 )
 
 var wiki DB
+var editPolicy *EditPolicy
+var sessions = newSessionStore(sessionLifetime)
+var audit *auditLog
+var users UserStore
+var tokens *tokenStore
 
 func mdlPageLookup(next http.Handler) http.Handler {
 	return NewPageLookupMiddleware(wiki, next)
 }
 
+func mdlSession(next http.Handler) http.Handler {
+	return NewSessionMiddleware(sessions, next)
+}
+
+func mdlBearerToken(next http.Handler) http.Handler {
+	return NewBearerTokenMiddleware(tokens, users, audit, next)
+}
+
+func mdlCSRF(next http.Handler) http.Handler {
+	return NewCSRFMiddleware(audit, next)
+}
+
+func mdlEditPolicy(next http.Handler) http.Handler {
+	return NewEditPolicyMiddleware(editPolicy, audit, next)
+}
+
+func mdlAdmin(next http.Handler) http.Handler {
+	return NewRoleMiddleware("admin", audit, next)
+}
+
+func mdlLogin(next http.Handler) http.Handler {
+	return NewLoginMiddleware(audit, next)
+}
+
+func mdlScope(scope string) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return NewScopeMiddleware(scope, audit, next)
+	}
+}
+
+func mdlRateLimit(limiter *rateLimiter) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		return NewRateLimitMiddleware(limiter, next)
+	}
+}
+
+func mustRateLimiter(value string) *rateLimiter {
+	limit, err := ParseRateLimit(value)
+	if err != nil {
+		panic(err.Error())
+	}
+	return newRateLimiter(limit)
+}
+
 func main() {
 	var err error
 
 	endpoint := ":3000"
 
+	policyName := flag.String("policy", "open", "who may edit: open, users, roles:role1,role2 or readonly")
+	usersFile := flag.String("users", "", "file of user accounts (username:bcrypt hash:roles)")
+	auditFile := flag.String("audit", "", "file to write the audit log to, no audit log is kept if empty")
+	auditSize := flag.Int64("audit-size", 10, "size in MB at which the audit log is rotated")
+	auditKeep := flag.Int("audit-keep", 5, "number of rotated audit logs to keep")
+	tokensFile := flag.String("tokens", "", "file to keep personal API tokens in, they are lost on restart if empty")
+	viewRate := flag.String("rate-view", "off", "rate limit for page views per user and per address, ie 60/m or 60/m,10 with a burst of 10")
+	editRate := flag.String("rate-edit", "off", "rate limit for page edits per user and per address")
+	uploadRate := flag.String("rate-upload", "off", "rate limit for attachment uploads per user and per address")
+	htmlAllowFile := flag.String("html-allow", "", "file of extra HTML elements allowed in pages, one 'element attr1 attr2' per line")
+	interWikiFile := flag.String("interwiki", "", "file of interwiki sites, one 'Name URL' per line, $PAGE in the URL is replaced by the link target")
+	flag.Parse()
+
+	if editPolicy, err = ParseEditPolicy(*policyName); err != nil {
+		panic(err.Error())
+	}
+	if *usersFile != "" {
+		if users, err = newFileUserStore(*usersFile); err != nil {
+			panic(err.Error())
+		}
+	}
+	if tokens, err = newTokenStore(*tokensFile); err != nil {
+		panic(err.Error())
+	}
+	if *htmlAllowFile != "" {
+		if sanitizer, err = newFileSanitizer(*htmlAllowFile); err != nil {
+			panic(err.Error())
+		}
+	}
+	if *interWikiFile != "" {
+		if interWiki, err = newFileInterWikiMap(*interWikiFile); err != nil {
+			panic(err.Error())
+		}
+	}
+	if *auditFile != "" {
+		if audit, err = newAuditLog(*auditFile, *auditSize*1024*1024, *auditKeep); err != nil {
+			panic(err.Error())
+		}
+	}
+
 	wiki, err = newFileDB("wiki_db")
 	//wiki, err = newMemDB()
 	if err != nil {
 		panic(err.Error())
 	}
 
-	stdMw := alice.New(middleware.MustGet("middleware.LoggingStdOut")) //, middleware.MustGet("middleware.Panic"))
-	viewMw := stdMw.Append(NewRevMiddleware, NewMuxVarMiddleware, mdlPageLookup)
+	stdMw := alice.New(middleware.MustGet("middleware.LoggingStdOut"), mdlSession, mdlBearerToken, mdlCSRF) //, middleware.MustGet("middleware.Panic"))
+	readMw := stdMw.Append(mdlScope(ScopeRead), mdlRateLimit(mustRateLimiter(*viewRate)))
+	viewMw := readMw.Append(NewRevMiddleware, NewMuxVarMiddleware, mdlPageLookup)
+	editMw := stdMw.Append(NewMuxVarMiddleware, mdlEditPolicy, mdlScope(ScopeWrite))
+	saveMw := editMw.Append(mdlRateLimit(mustRateLimiter(*editRate)))
+	attachMw := stdMw.Append(NewMuxVarMiddleware, mdlEditPolicy, mdlScope(ScopeAttach), mdlRateLimit(mustRateLimiter(*uploadRate)))
+	adminMw := stdMw.Append(mdlAdmin)
+	loginMw := stdMw.Append(mdlLogin)
 
 	r := mux.NewRouter()
 
-	r.Handle("/", stdMw.Then(adapt(wiki, ListPagesHandler))).Methods("GET")
+	r.Handle("/", readMw.Then(adapt(wiki, ListPagesHandler))).Methods("GET")
 	r.Handle("/About/", stdMw.Then(adapt(wiki, AboutPageHandler))).Methods("GET")
+	r.Handle("/login/", stdMw.Then(adapt(wiki, ShowLoginHandler))).Methods("GET")
+	r.Handle("/login/", stdMw.Then(adapt(wiki, newLoginHandler(users, sessions, audit)))).Methods("POST")
+	r.Handle("/logout/", stdMw.Then(adapt(wiki, newLogoutHandler(sessions)))).Methods("GET")
+	r.Handle("/Special/AuditLog/", adminMw.Then(adapt(wiki, newAuditLogHandler(audit)))).Methods("GET")
+	r.Handle("/Special/InterWiki/", readMw.Then(adapt(wiki, newInterWikiHandler(interWiki)))).Methods("GET")
+	r.Handle("/Special/Settings/", loginMw.Then(adapt(wiki, newSettingsHandler(tokens)))).Methods("GET", "POST")
+	r.Handle("/tag/{tag}/", readMw.Then(adapt(wiki, TagPageHandler))).Methods("GET")
 	r.Handle("/static/{path:.*}", http.FileServer(http.Dir("public/")))
-	r.Handle("/edit/{name}/", stdMw.Then(adapt(wiki, ShowEditPageHandler))).Methods("GET")
-	r.Handle("/edit/{name}/", stdMw.Then(adapt(wiki, EditPageHandler))).Methods("POST")
-	r.Handle("/edit/:name/attachment/", stdMw.Then(adapt(wiki, AddAttachmentHandler))).Methods("POST")
+	if !editPolicy.ReadOnly() {
+		// names may hold '/' for sub pages, so the attachment and task routes must come first
+		r.Handle("/edit/{name:.+}/attachment/", attachMw.Then(adapt(wiki, AddAttachmentHandler))).Methods("POST")
+		r.Handle("/edit/{name:.+}/task/", saveMw.Then(adapt(wiki, ToggleTaskHandler))).Methods("POST")
+		r.Handle("/edit/{name:.+}/", editMw.Then(adapt(wiki, ShowEditPageHandler))).Methods("GET")
+		r.Handle("/edit/{name:.+}/", saveMw.Then(adapt(wiki, EditPageHandler))).Methods("POST")
+	}
 	//r.Handle("/{name}/", viewMw.Then(adapt(wiki, PageHandler))).Methods("GET")
-	r.Handle("/{name}/", viewMw.Then(NewViewCreateMiddleware(adapt(wiki, PageHandler), adapt(wiki, CreatePageHandler)))).Methods("GET")
-	r.Handle("/{name}/{attachment}", stdMw.Then(adapt(wiki, AttachmentHandler))).Methods("GET")
+	r.Handle("/{name:.+}/", viewMw.Then(NewViewCreateMiddleware(adapt(wiki, PageHandler), adapt(wiki, CreatePageHandler)))).Methods("GET")
+	r.Handle("/{name:.+}/{attachment}", readMw.Then(adapt(wiki, AttachmentHandler))).Methods("GET")
 
-	os.Stdout.WriteString("Staring wiki at " + endpoint + "\n")
+	os.Stdout.WriteString("Staring wiki at " + endpoint + " with edit policy " + editPolicy.String() + "\n")
 	http.ListenAndServe(endpoint, r)
 }